@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo3/frame"
+)
+
+// flushPolicy 写缓存的刷新策略，可以同时启用多个；都不启用时只在写缓存满和连接关闭时刷新，
+// 发送一个请求后等待响应的客户端会一直收不到响应
+type flushPolicy struct {
+	onIdle   bool          // 读缓存中没有待处理的请求时刷新，客户端不再有请求时立即收到响应
+	interval time.Duration // 写缓存中的响应最长等待时间，0 表示不启用
+	bytes    int           // 写缓存中的数据达到该字节数时刷新，0 表示不启用
+}
+
+// flushWriter 按 flushPolicy 刷新的写缓存。定时刷新在 time.AfterFunc 的 goroutine 中进行，
+// 所以对写缓存的访问都要加锁
+type flushWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	codec  frame.StreamFrameCodec
+	policy flushPolicy
+	timer  *time.Timer // 写缓存由空变为非空时启动，刷新后停止
+	armed  bool        // timer 已启动且尚未触发
+	err    error       // 写连接出错后，之后的写入都返回该错误
+}
+
+func newFlushWriter(c net.Conn, codec frame.StreamFrameCodec, policy flushPolicy) *flushWriter {
+	return &flushWriter{w: bufio.NewWriter(c), codec: codec, policy: policy}
+}
+
+// writeFrame 把 ack frame 写入写缓存并按策略刷新，idle 表示读缓存中没有待处理的请求
+func (fw *flushWriter) writeFrame(framePayload []byte, idle bool) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.err != nil {
+		return fw.err
+	}
+	// 写缓存满时 bufio 会直接写入连接
+	if fw.err = fw.codec.Encode(fw.w, framePayload); fw.err != nil {
+		return fw.err
+	}
+	if (fw.policy.onIdle && idle) || (fw.policy.bytes > 0 && fw.w.Buffered() >= fw.policy.bytes) {
+		return fw.flushLocked()
+	}
+	if fw.policy.interval > 0 && !fw.armed && fw.w.Buffered() > 0 {
+		// 写缓存中第一个未刷新的响应开始计时
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.policy.interval, fw.timedFlush)
+		} else {
+			fw.timer.Reset(fw.policy.interval)
+		}
+		fw.armed = true
+	}
+	return nil
+}
+
+// timedFlush 定时刷新，出错时由下一次写入返回错误
+func (fw *flushWriter) timedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.armed = false
+	if fw.err == nil {
+		fw.flushLocked()
+	}
+}
+
+// Close 停止定时刷新，把写缓存中剩余的数据写入连接
+func (fw *flushWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	if fw.err != nil {
+		return fw.err
+	}
+	return fw.flushLocked()
+}
+
+func (fw *flushWriter) flushLocked() error {
+	if fw.armed {
+		fw.timer.Stop()
+		fw.armed = false
+	}
+	fw.err = fw.w.Flush()
+	return fw.err
+}
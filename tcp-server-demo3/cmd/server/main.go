@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"net"
 
@@ -41,7 +42,7 @@ func handlePacket(framePayload []byte) (ackFramePayload []byte, err error) {
 }
 
 // handle client connection
-func handleConn(c net.Conn) {
+func handleConn(c net.Conn, policy flushPolicy) {
 	metrics.ClientConnected.Inc() //连接建立，ClientConnected + 1
 	defer func() {
 		metrics.ClientConnected.Dec() // 连接断开，ClientConnected - 1
@@ -54,9 +55,9 @@ func handleConn(c net.Conn) {
 
 	// 读缓存变量，避免每次都从 net.Conn 读取，降低 Syscall 调用频率
 	rbuf := bufio.NewReader(c)
-	// 写缓存变量
-	wbuf := bufio.NewWriter(c)
-	defer wbuf.Flush()
+	// 写缓存变量，按 policy 刷新，否则响应一直留在写缓存中，直到写缓存满或连接关闭
+	wbuf := newFlushWriter(c, frameCodec, policy)
+	defer wbuf.Close()
 	for {
 		// read from the connection
 
@@ -78,7 +79,7 @@ func handleConn(c net.Conn) {
 		}
 
 		//write ack frame to the connection
-		err = frameCodec.Encode(wbuf, ackFramePayload)
+		err = wbuf.writeFrame(ackFramePayload, rbuf.Buffered() == 0)
 		if err != nil {
 			fmt.Println("handleConn: frame encode error:", err)
 			return
@@ -88,6 +89,12 @@ func handleConn(c net.Conn) {
 }
 
 func main() {
+	var policy flushPolicy
+	flag.BoolVar(&policy.onIdle, "flush-on-idle", true, "flush the write buffer when no more requests are buffered")
+	flag.DurationVar(&policy.interval, "flush-interval", 0, "maximum time a response stays in the write buffer, 0 disables")
+	flag.IntVar(&policy.bytes, "flush-bytes", 0, "flush the write buffer once it holds this many bytes, 0 disables")
+	flag.Parse()
+
 	l, err := net.Listen("tcp", ":8888")
 	if err != nil {
 		fmt.Println("listen error:", err)
@@ -106,6 +113,6 @@ func main() {
 
 		// start a new goroutine to handle the new connection.
 		// the new connection
-		go handleConn(c)
+		go handleConn(c, policy)
 	}
 }
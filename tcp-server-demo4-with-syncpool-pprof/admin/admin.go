@@ -0,0 +1,598 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/logging"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+// admin 包提供管理运行中服务端的 HTTP 接口，挂载在 metrics http server 的 /admin/ 下
+/*
+认证
+	所有请求都要带 Authorization: Bearer <token>，token 为空时拒绝所有请求
+接口(响应都是 JSON，出错时为 {"error": "..."})
+	GET    /admin/sessions[?client_id=]     列出会话和收发计数
+	POST   /admin/sessions/kick             强制断开会话，body 为 {"id": 1} 或 {"client_id": "x"}，可选 "reason"
+	GET    /admin/drain                     排空状态
+	POST   /admin/drain                     开始排空，拒绝新连接
+	DELETE /admin/drain                     撤销排空
+	GET    /admin/limits                    运行时限制
+	PATCH  /admin/limits                    修改运行时限制，只修改 body 中出现的字段；EngineEpoll 不支持 submit_rate 和 submit_burst
+	GET    /admin/ipfilter                  源 IP 过滤的 allow 和 deny 列表
+	PUT    /admin/ipfilter                  替换 allow 和 deny 列表，body 为 {"allow": [...], "deny": [...]}
+	PATCH  /admin/ipfilter                  增删列表项，body 为 {"allow_add": [...], "deny_remove": [...]} 等，先删除后添加
+	POST   /admin/profile/heap              采集 heap profile，写入 ProfileDir
+	POST   /admin/profile/cpu[?seconds=30]  采集 CPU profile，写入 ProfileDir，采集结束后返回
+运行时修改与重新加载配置
+	通过 /admin/limits 修改的 Submit 限流和通过 /admin/ipfilter 修改的源 IP 过滤记录在 Options.Overrides 中，
+	之后收到 SIGHUP 重新加载配置时保留这些修改，直到进程重启
+*/
+
+const (
+	defaultKickReason        = "disconnected by administrator"
+	defaultCPUProfileSeconds = 30
+	maxCPUProfileSeconds     = 300
+)
+
+// Options 管理接口的配置
+type Options struct {
+	Token      string         // 访问令牌，为空时拒绝所有请求
+	Server     *server.Server // 被管理的服务端
+	LogLevel   *slog.LevelVar // 日志级别，为 nil 时不能查看和修改
+	ProfileDir string         // profile 文件的保存目录，为空时使用 os.TempDir()
+	Overrides  *Overrides     // 记录通过管理接口修改过的配置项，为 nil 时不记录
+}
+
+// Overrides 通过管理接口修改过、重新加载配置时不应覆盖的配置项，可以在任意 goroutine 中调用
+type Overrides struct {
+	submitRate atomic.Bool
+	ipFilter   atomic.Bool
+}
+
+// SubmitRate Submit 限流是否通过 PATCH /admin/limits 修改过
+func (o *Overrides) SubmitRate() bool {
+	return o.submitRate.Load()
+}
+
+// IPFilter 源 IP 过滤是否通过 PUT 或 PATCH /admin/ipfilter 修改过
+func (o *Overrides) IPFilter() bool {
+	return o.ipFilter.Load()
+}
+
+type handler struct {
+	opts Options
+	mux  *http.ServeMux
+
+	ipFilterMu sync.Mutex // 串行化对源 IP 过滤的修改，避免并发的 PATCH 互相覆盖
+}
+
+// NewHandler 创建管理接口的 http.Handler
+func NewHandler(opts Options) http.Handler {
+	if opts.ProfileDir == "" {
+		opts.ProfileDir = os.TempDir()
+	}
+	h := &handler{opts: opts, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/admin/sessions", h.listSessions)
+	h.mux.HandleFunc("/admin/sessions/kick", h.kick)
+	h.mux.HandleFunc("/admin/drain", h.drain)
+	h.mux.HandleFunc("/admin/limits", h.limits)
+	h.mux.HandleFunc("/admin/ipfilter", h.ipFilter)
+	h.mux.HandleFunc("/admin/profile/heap", h.heapProfile)
+	h.mux.HandleFunc("/admin/profile/cpu", h.cpuProfile)
+	h.mux.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.opts.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.Token)) == 1
+}
+
+// Session 会话列表中的一项
+type Session struct {
+	ID          uint64    `json:"id"`
+	ClientID    string    `json:"client_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ProxyAddr   string    `json:"proxy_addr,omitempty"` // 经 PROXY protocol 转发时为负载均衡的地址
+	ConnectedAt time.Time `json:"connected_at"`
+	PacketsIn   uint64    `json:"packets_in"`
+	PacketsOut  uint64    `json:"packets_out"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+}
+
+// SessionList GET /admin/sessions 的响应
+type SessionList struct {
+	Count    int       `json:"count"`
+	Sessions []Session `json:"sessions"`
+}
+
+func (h *handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	registry := h.opts.Server.Sessions()
+	var sessions []*session.Session
+	if clientID := r.URL.Query().Get("client_id"); clientID != "" {
+		sessions = registry.Lookup(clientID)
+	} else {
+		sessions = registry.List()
+	}
+	list := SessionList{Count: len(sessions), Sessions: make([]Session, 0, len(sessions))}
+	for _, s := range sessions {
+		stats := s.Stats()
+		list.Sessions = append(list.Sessions, Session{
+			ID:          s.ID,
+			ClientID:    s.ClientID(),
+			RemoteAddr:  s.RemoteAddr.String(),
+			ProxyAddr:   addrString(s.ProxyAddr),
+			ConnectedAt: s.ConnectedAt,
+			PacketsIn:   stats.PacketsIn,
+			PacketsOut:  stats.PacketsOut,
+			BytesIn:     stats.BytesIn,
+			BytesOut:    stats.BytesOut,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// KickRequest POST /admin/sessions/kick 的请求，ID 和 ClientID 二选一
+type KickRequest struct {
+	ID       uint64 `json:"id"`
+	ClientID string `json:"client_id"`
+	Reason   string `json:"reason"`
+}
+
+// KickResponse POST /admin/sessions/kick 的响应
+type KickResponse struct {
+	Kicked int `json:"kicked"`
+}
+
+func (h *handler) kick(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req KickRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if (req.ID == 0) == (req.ClientID == "") {
+		writeError(w, http.StatusBadRequest, "exactly one of id and client_id must be set")
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = defaultKickReason
+	}
+	registry := h.opts.Server.Sessions()
+	var sessions []*session.Session
+	if req.ClientID != "" {
+		sessions = registry.Lookup(req.ClientID)
+	} else if s, ok := registry.Get(req.ID); ok {
+		sessions = []*session.Session{s}
+	}
+	if len(sessions) == 0 {
+		writeError(w, http.StatusNotFound, "no matching session")
+		return
+	}
+	for _, s := range sessions {
+		s.Kick(req.Reason)
+	}
+	slog.Info("admin: sessions kicked", "id", req.ID, "client_id", req.ClientID, "kicked", len(sessions), "from", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, KickResponse{Kicked: len(sessions)})
+}
+
+// DrainStatus /admin/drain 的响应
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	Sessions int  `json:"sessions"` // 仍然在线的会话数
+}
+
+func (h *handler) drain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	srv := h.opts.Server
+	switch r.Method {
+	case http.MethodPost:
+		srv.StartDrain()
+	case http.MethodDelete:
+		srv.AbortDrain()
+	}
+	writeJSON(w, http.StatusOK, DrainStatus{Draining: srv.Draining(), Sessions: srv.Sessions().Len()})
+}
+
+// Limits 运行时限制，GET /admin/limits 和 PATCH /admin/limits 的响应
+type Limits struct {
+	SubmitRate    float64 `json:"submit_rate"`
+	SubmitBurst   int     `json:"submit_burst"`
+	AcceptRate    float64 `json:"accept_rate"`
+	AcceptBurst   int     `json:"accept_burst"`
+	MaxConns      int     `json:"max_conns"`
+	MaxConnsPerIP int     `json:"max_conns_per_ip"`
+	LogLevel      string  `json:"log_level,omitempty"`
+}
+
+// LimitsPatch PATCH /admin/limits 的请求，为 nil 的字段保持不变
+type LimitsPatch struct {
+	SubmitRate    *float64 `json:"submit_rate"`
+	SubmitBurst   *int     `json:"submit_burst"`
+	AcceptRate    *float64 `json:"accept_rate"`
+	AcceptBurst   *int     `json:"accept_burst"`
+	MaxConns      *int     `json:"max_conns"`
+	MaxConnsPerIP *int     `json:"max_conns_per_ip"`
+	LogLevel      *string  `json:"log_level"`
+}
+
+func (h *handler) limits(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, h.currentLimits())
+		return
+	}
+	var patch LimitsPatch
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	if patch.LogLevel != nil && h.opts.LogLevel == nil {
+		writeError(w, http.StatusBadRequest, "log_level cannot be changed")
+		return
+	}
+	if (patch.SubmitRate != nil || patch.SubmitBurst != nil) && !h.opts.Server.SubmitRateLimitSupported() {
+		writeError(w, http.StatusBadRequest, "submit_rate and submit_burst are not supported with engine epoll")
+		return
+	}
+	l := h.currentLimits()
+	setIf(&l.SubmitRate, patch.SubmitRate)
+	setIf(&l.SubmitBurst, patch.SubmitBurst)
+	setIf(&l.AcceptRate, patch.AcceptRate)
+	setIf(&l.AcceptBurst, patch.AcceptBurst)
+	setIf(&l.MaxConns, patch.MaxConns)
+	setIf(&l.MaxConnsPerIP, patch.MaxConnsPerIP)
+	setIf(&l.LogLevel, patch.LogLevel)
+	level, err := l.validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	srv := h.opts.Server
+	srv.SetSubmitRateLimit(l.SubmitRate, l.SubmitBurst)
+	if (patch.SubmitRate != nil || patch.SubmitBurst != nil) && h.opts.Overrides != nil {
+		h.opts.Overrides.submitRate.Store(true)
+	}
+	srv.SetAcceptRate(l.AcceptRate, l.AcceptBurst)
+	srv.SetMaxConns(l.MaxConns)
+	srv.SetMaxConnsPerIP(l.MaxConnsPerIP)
+	if h.opts.LogLevel != nil {
+		h.opts.LogLevel.Set(level)
+	}
+	slog.Info("admin: limits changed", "limits", fmt.Sprintf("%+v", l), "from", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, h.currentLimits())
+}
+
+func (h *handler) currentLimits() Limits {
+	srv := h.opts.Server
+	var l Limits
+	l.SubmitRate, l.SubmitBurst = srv.SubmitRateLimit()
+	l.AcceptRate, l.AcceptBurst = srv.AcceptRate()
+	l.MaxConns, l.MaxConnsPerIP = srv.MaxConns()
+	if h.opts.LogLevel != nil {
+		l.LogLevel = strings.ToLower(h.opts.LogLevel.Level().String())
+	}
+	return l
+}
+
+// validate 校验修改后的限制，与配置文件中对应配置项的规则一致
+func (l Limits) validate() (slog.Level, error) {
+	var errs []string
+	if l.SubmitRate < 0 {
+		errs = append(errs, "submit_rate must not be negative")
+	}
+	if l.SubmitRate > 0 && l.SubmitBurst <= 0 {
+		errs = append(errs, "submit_burst must be positive when submit_rate is set")
+	}
+	if l.AcceptRate < 0 {
+		errs = append(errs, "accept_rate must not be negative")
+	}
+	if l.AcceptRate > 0 && l.AcceptBurst <= 0 {
+		errs = append(errs, "accept_burst must be positive when accept_rate is set")
+	}
+	if l.MaxConns < 0 {
+		errs = append(errs, "max_conns must not be negative")
+	}
+	if l.MaxConnsPerIP < 0 {
+		errs = append(errs, "max_conns_per_ip must not be negative")
+	}
+	level, err := logging.ParseLevel(l.LogLevel)
+	if err != nil {
+		errs = append(errs, "log_level must be one of debug, info, warn, error")
+	}
+	if len(errs) > 0 {
+		return 0, errors.New(strings.Join(errs, "; "))
+	}
+	return level, nil
+}
+
+func setIf[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// IPFilter 源 IP 过滤，是 /admin/ipfilter 的响应和 PUT 的请求。
+// 列表项为 CIDR 或单个 IP，allow 为空时接受所有地址，deny 优先于 allow
+type IPFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// IPFilterPatch PATCH /admin/ipfilter 的请求，删除不存在的项和添加已存在的项都会被忽略
+type IPFilterPatch struct {
+	AllowAdd    []string `json:"allow_add"`
+	AllowRemove []string `json:"allow_remove"`
+	DenyAdd     []string `json:"deny_add"`
+	DenyRemove  []string `json:"deny_remove"`
+}
+
+func (h *handler) ipFilter(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodPatch) {
+		return
+	}
+	srv := h.opts.Server
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, formatIPFilter(srv.IPFilter()))
+		return
+	}
+
+	h.ipFilterMu.Lock()
+	defer h.ipFilterMu.Unlock()
+	var f server.IPFilter
+	var err error
+	if r.Method == http.MethodPut {
+		var req IPFilter
+		if !readJSON(w, r, &req) {
+			return
+		}
+		f, err = parseIPFilter(req)
+	} else {
+		var patch IPFilterPatch
+		if !readJSON(w, r, &patch) {
+			return
+		}
+		f, err = patch.apply(srv.IPFilter())
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	srv.SetIPFilter(f)
+	if h.opts.Overrides != nil {
+		h.opts.Overrides.ipFilter.Store(true)
+	}
+	resp := formatIPFilter(f)
+	slog.Info("admin: ip filter changed", "allow", resp.Allow, "deny", resp.Deny, "from", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func parseIPFilter(req IPFilter) (server.IPFilter, error) {
+	allow, err := parsePrefixes("allow", req.Allow)
+	if err != nil {
+		return server.IPFilter{}, err
+	}
+	deny, err := parsePrefixes("deny", req.Deny)
+	if err != nil {
+		return server.IPFilter{}, err
+	}
+	return server.IPFilter{Allow: allow, Deny: deny}, nil
+}
+
+// apply 在 f 的基础上增删列表项，返回新的过滤规则
+func (p IPFilterPatch) apply(f server.IPFilter) (server.IPFilter, error) {
+	var err error
+	if f.Allow, err = editPrefixes("allow", f.Allow, p.AllowAdd, p.AllowRemove); err != nil {
+		return server.IPFilter{}, err
+	}
+	if f.Deny, err = editPrefixes("deny", f.Deny, p.DenyAdd, p.DenyRemove); err != nil {
+		return server.IPFilter{}, err
+	}
+	return f, nil
+}
+
+func editPrefixes(field string, list []netip.Prefix, add, remove []string) ([]netip.Prefix, error) {
+	added, err := parsePrefixes(field+"_add", add)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := parsePrefixes(field+"_remove", remove)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]netip.Prefix, 0, len(list)+len(added))
+	for _, p := range list {
+		if !slices.Contains(removed, p) {
+			result = append(result, p)
+		}
+	}
+	for _, p := range added {
+		if !slices.Contains(result, p) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func parsePrefixes(field string, list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		p, err := transport.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field, err.Error())
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func formatIPFilter(f server.IPFilter) IPFilter {
+	resp := IPFilter{Allow: make([]string, 0, len(f.Allow)), Deny: make([]string, 0, len(f.Deny))}
+	for _, p := range f.Allow {
+		resp.Allow = append(resp.Allow, p.String())
+	}
+	for _, p := range f.Deny {
+		resp.Deny = append(resp.Deny, p.String())
+	}
+	return resp
+}
+
+// Profile profile 采集接口的响应
+type Profile struct {
+	File  string `json:"file"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (h *handler) heapProfile(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	f, err := h.createProfile("heap")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	runtime.GC() // 让 profile 反映最近一次 GC 后的堆
+	err = pprof.Lookup("heap").WriteTo(f, 0)
+	h.finishProfile(w, r, f, err)
+}
+
+func (h *handler) cpuProfile(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	seconds := defaultCPUProfileSeconds
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxCPUProfileSeconds {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("seconds must be between 1 and %d", maxCPUProfileSeconds))
+			return
+		}
+		seconds = n
+	}
+	f, err := h.createProfile("cpu")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		// 同一时刻只能有一个 CPU profile，例如 pprof http server 正在采集
+		f.Close()
+		os.Remove(f.Name())
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	timer := time.NewTimer(time.Duration(seconds) * time.Second)
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		// 客户端放弃等待时提前结束，已采集的部分仍然保存
+		timer.Stop()
+	}
+	pprof.StopCPUProfile()
+	h.finishProfile(w, r, f, nil)
+}
+
+// createProfile 在 ProfileDir 中创建 profile 文件，文件名带有采集时间
+func (h *handler) createProfile(kind string) (*os.File, error) {
+	name := fmt.Sprintf("%s-%s.pprof", kind, time.Now().Format("20060102-150405.000"))
+	return os.Create(filepath.Join(h.opts.ProfileDir, name))
+}
+
+func (h *handler) finishProfile(w http.ResponseWriter, r *http.Request, f *os.File, err error) {
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("admin: profile captured", "file", f.Name(), "bytes", fi.Size(), "from", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, Profile{File: f.Name(), Bytes: fi.Size()})
+}
+
+// allowMethods 请求方法不在 methods 中时返回 405 和 false
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// addrString 返回地址的字符串形式，addr 为 nil 时返回空字符串
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,365 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+)
+
+const testToken = "test-token"
+
+type fixture struct {
+	srv       *server.Server
+	addr      string
+	logLevel  *slog.LevelVar
+	overrides *Overrides
+	handler   http.Handler
+}
+
+func newFixture(t *testing.T) *fixture {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := server.New(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		if s, ok := r.Packet.(*packet.Submit); ok {
+			w.Write(&packet.SubmitAck{ID: s.ID})
+		}
+	}), server.WithSubmitRateLimit(server.RateLimit{Rate: 100, Burst: 10}))
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	f := &fixture{srv: srv, addr: l.Addr().String(), logLevel: new(slog.LevelVar), overrides: new(Overrides)}
+	f.handler = NewHandler(Options{Token: testToken, Server: srv, LogLevel: f.logLevel, ProfileDir: t.TempDir(), Overrides: f.overrides})
+	return f
+}
+
+// do 发送带令牌的请求，把 JSON 响应解码到 v
+func (f *fixture) do(t *testing.T, method, target, body string, v interface{}) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want application/json,actual %s", ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+	}
+	return rec.Code
+}
+
+// dial 连接服务端并发送 Conn 包，收到 SubmitAck 后返回，此时会话已经带有客户端标识
+func (f *fixture) dial(t *testing.T, clientID string) net.Conn {
+	c, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	for _, p := range []packet.Packet{&packet.Conn{ClientID: clientID}, &packet.Submit{ID: "00000001"}} {
+		writePacket(t, c, p)
+	}
+	if _, ok := readPacket(t, c).(*packet.SubmitAck); !ok {
+		t.Fatalf("want *packet.SubmitAck")
+	}
+	return c
+}
+
+func writePacket(t *testing.T, c net.Conn, p packet.Packet) {
+	framePayload, err := packet.Encode(p)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if err = frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+}
+
+func readPacket(t *testing.T, c net.Conn) packet.Packet {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	framePayload, err := frame.NewMyFrameCodec().Decode(c)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	p, err := packet.Decode(framePayload)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return p
+}
+
+func TestHandler_Unauthorized(t *testing.T) {
+	f := newFixture(t)
+	tests := []struct {
+		name    string
+		handler http.Handler
+		auth    string
+	}{
+		{"NoToken", f.handler, ""},
+		{"WrongToken", f.handler, "Bearer wrong"},
+		{"NotBearer", f.handler, "Basic " + testToken},
+		{"EmptyConfiguredToken", NewHandler(Options{Server: f.srv}), "Bearer "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("want %d,actual %d", http.StatusUnauthorized, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandler_SessionsAndKick(t *testing.T) {
+	f := newFixture(t)
+	c1 := f.dial(t, "device-1")
+	f.dial(t, "device-2")
+
+	var list SessionList
+	if code := f.do(t, http.MethodGet, "/admin/sessions", "", &list); code != http.StatusOK || list.Count != 2 {
+		t.Fatalf("want 200 and 2 sessions,actual %d %+v", code, list)
+	}
+	if code := f.do(t, http.MethodGet, "/admin/sessions?client_id=device-1", "", &list); code != http.StatusOK || list.Count != 1 {
+		t.Fatalf("want 200 and 1 session,actual %d %+v", code, list)
+	}
+	s := list.Sessions[0]
+	if s.ClientID != "device-1" || s.RemoteAddr != c1.LocalAddr().String() || s.PacketsIn != 2 || s.PacketsOut != 1 {
+		t.Errorf("want device-1 with 2 packets in and 1 out,actual %+v", s)
+	}
+
+	var errResp map[string]string
+	if code := f.do(t, http.MethodPost, "/admin/sessions/kick", `{"client_id":"device-3"}`, &errResp); code != http.StatusNotFound {
+		t.Errorf("want %d,actual %d", http.StatusNotFound, code)
+	}
+	if code := f.do(t, http.MethodPost, "/admin/sessions/kick", `{"id":1,"client_id":"device-1"}`, &errResp); code != http.StatusBadRequest || errResp["error"] == "" {
+		t.Errorf("want %d with error,actual %d %v", http.StatusBadRequest, code, errResp)
+	}
+
+	var kick KickResponse
+	body := `{"id":` + jsonNumber(s.ID) + `,"reason":"maintenance"}`
+	if code := f.do(t, http.MethodPost, "/admin/sessions/kick", body, &kick); code != http.StatusOK || kick.Kicked != 1 {
+		t.Fatalf("want 200 and 1 kicked,actual %d %+v", code, kick)
+	}
+	if d, ok := readPacket(t, c1).(*packet.Disconnect); !ok || d.Code != packet.DisconnectKicked || d.Reason != "maintenance" {
+		t.Errorf("want kicked disconnect,actual %+v", d)
+	}
+
+	if code := f.do(t, http.MethodGet, "/admin/sessions/kick", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d,actual %d", http.StatusMethodNotAllowed, code)
+	}
+}
+
+func jsonNumber(v uint64) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestHandler_Drain(t *testing.T) {
+	f := newFixture(t)
+	f.dial(t, "device-1")
+
+	var status DrainStatus
+	if code := f.do(t, http.MethodPost, "/admin/drain", "", &status); code != http.StatusOK || !status.Draining || status.Sessions != 1 {
+		t.Fatalf("want draining with 1 session,actual %d %+v", code, status)
+	}
+	// 排空期间新连接被拒绝
+	c, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	if d, ok := readPacket(t, c).(*packet.Disconnect); !ok || d.Code != packet.DisconnectRejected {
+		t.Errorf("want rejected disconnect,actual %+v", d)
+	}
+
+	if code := f.do(t, http.MethodDelete, "/admin/drain", "", &status); code != http.StatusOK || status.Draining {
+		t.Fatalf("want not draining,actual %d %+v", code, status)
+	}
+	f.dial(t, "device-2")
+}
+
+func TestHandler_Limits(t *testing.T) {
+	f := newFixture(t)
+
+	var limits Limits
+	if code := f.do(t, http.MethodGet, "/admin/limits", "", &limits); code != http.StatusOK {
+		t.Fatalf("want 200,actual %d", code)
+	}
+	want := Limits{SubmitRate: 100, SubmitBurst: 10, AcceptBurst: 1, LogLevel: "info"}
+	if limits != want {
+		t.Errorf("want %+v,actual %+v", want, limits)
+	}
+
+	body := `{"submit_rate":5,"max_conns":3,"accept_rate":50,"accept_burst":20,"log_level":"debug"}`
+	if code := f.do(t, http.MethodPatch, "/admin/limits", body, &limits); code != http.StatusOK {
+		t.Fatalf("want 200,actual %d", code)
+	}
+	want = Limits{SubmitRate: 5, SubmitBurst: 10, AcceptRate: 50, AcceptBurst: 20, MaxConns: 3, LogLevel: "debug"}
+	if limits != want {
+		t.Errorf("want %+v,actual %+v", want, limits)
+	}
+	if rate, burst := f.srv.SubmitRateLimit(); rate != 5 || burst != 10 {
+		t.Errorf("want 5/10,actual %v/%d", rate, burst)
+	}
+	if maxConns, _ := f.srv.MaxConns(); maxConns != 3 {
+		t.Errorf("want 3,actual %d", maxConns)
+	}
+	if f.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("want DEBUG,actual %s", f.logLevel.Level())
+	}
+
+	// 任一字段无效时不修改任何限制
+	var errResp map[string]string
+	for _, body := range []string{`{"max_conns":-1,"submit_rate":1}`, `{"log_level":"trace"}`, `{"submit_rate":1,"submit_burst":0}`, `{"unknown":1}`} {
+		if code := f.do(t, http.MethodPatch, "/admin/limits", body, &errResp); code != http.StatusBadRequest || errResp["error"] == "" {
+			t.Errorf("%s: want %d with error,actual %d %v", body, http.StatusBadRequest, code, errResp)
+		}
+	}
+	if rate, _ := f.srv.SubmitRateLimit(); rate != 5 {
+		t.Errorf("want 5,actual %v", rate)
+	}
+}
+
+func TestHandler_LimitsEpoll(t *testing.T) {
+	srv := server.New(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {}), server.WithEngine(server.EngineEpoll))
+	f := &fixture{srv: srv}
+	f.handler = NewHandler(Options{Token: testToken, Server: srv})
+
+	// EngineEpoll 不支持 Submit 限流，修改时返回错误而不是静默忽略
+	var errResp map[string]string
+	for _, body := range []string{`{"submit_rate":5,"submit_burst":10}`, `{"submit_burst":10,"max_conns":3}`} {
+		if code := f.do(t, http.MethodPatch, "/admin/limits", body, &errResp); code != http.StatusBadRequest || errResp["error"] == "" {
+			t.Errorf("%s: want %d with error,actual %d %v", body, http.StatusBadRequest, code, errResp)
+		}
+	}
+	if maxConns, _ := srv.MaxConns(); maxConns != 0 {
+		t.Errorf("want 0,actual %d", maxConns)
+	}
+	var limits Limits
+	if code := f.do(t, http.MethodPatch, "/admin/limits", `{"max_conns":3}`, &limits); code != http.StatusOK || limits.MaxConns != 3 {
+		t.Errorf("want 200 with max_conns 3,actual %d %+v", code, limits)
+	}
+}
+
+func TestHandler_IPFilter(t *testing.T) {
+	f := newFixture(t)
+
+	var filter IPFilter
+	if code := f.do(t, http.MethodGet, "/admin/ipfilter", "", &filter); code != http.StatusOK || len(filter.Allow) != 0 || len(filter.Deny) != 0 {
+		t.Fatalf("want 200 with empty lists,actual %d %+v", code, filter)
+	}
+
+	body := `{"allow":["10.1.2.3/8","127.0.0.1"],"deny":["2001:db8::/32"]}`
+	if code := f.do(t, http.MethodPut, "/admin/ipfilter", body, &filter); code != http.StatusOK {
+		t.Fatalf("want 200,actual %d", code)
+	}
+	if want := "[10.0.0.0/8 127.0.0.1/32] [2001:db8::/32]"; fmt.Sprint(filter.Allow, " ", filter.Deny) != want {
+		t.Errorf("want %s,actual %v %v", want, filter.Allow, filter.Deny)
+	}
+	f.dial(t, "device-1")
+
+	// 先删除后添加，重复添加的项被忽略
+	body = `{"allow_add":["10.0.0.0/8","192.168.0.0/16"],"allow_remove":["127.0.0.1"],"deny_remove":["2001:db8::/32"]}`
+	if code := f.do(t, http.MethodPatch, "/admin/ipfilter", body, &filter); code != http.StatusOK {
+		t.Fatalf("want 200,actual %d", code)
+	}
+	if want := "[10.0.0.0/8 192.168.0.0/16] []"; fmt.Sprint(filter.Allow, " ", filter.Deny) != want {
+		t.Errorf("want %s,actual %v %v", want, filter.Allow, filter.Deny)
+	}
+	if got := f.srv.IPFilter(); len(got.Allow) != 2 || len(got.Deny) != 0 {
+		t.Errorf("want 2 allow 0 deny,actual %+v", got)
+	}
+	// 127.0.0.1 不再被允许
+	c, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	if d, ok := readPacket(t, c).(*packet.Disconnect); !ok || d.Code != packet.DisconnectRejected {
+		t.Errorf("want rejected disconnect,actual %+v", d)
+	}
+
+	// 任一项无效时不修改过滤规则
+	var errResp map[string]string
+	for _, tt := range []struct{ method, body string }{
+		{http.MethodPut, `{"allow":["10.0.0.0/33"]}`},
+		{http.MethodPatch, `{"deny_add":["example.com"]}`},
+		{http.MethodPatch, `{"allow":["10.0.0.0/8"]}`},
+	} {
+		if code := f.do(t, tt.method, "/admin/ipfilter", tt.body, &errResp); code != http.StatusBadRequest || errResp["error"] == "" {
+			t.Errorf("%s: want %d with error,actual %d %v", tt.body, http.StatusBadRequest, code, errResp)
+		}
+	}
+	if got := f.srv.IPFilter(); len(got.Allow) != 2 {
+		t.Errorf("want 2,actual %d", len(got.Allow))
+	}
+}
+
+func TestHandler_Overrides(t *testing.T) {
+	f := newFixture(t)
+
+	// 没有修改 Submit 限流和源 IP 过滤，或者修改失败时不记录
+	var errResp map[string]string
+	f.do(t, http.MethodPatch, "/admin/limits", `{"max_conns":3}`, nil)
+	f.do(t, http.MethodPatch, "/admin/limits", `{"submit_rate":-1}`, &errResp)
+	f.do(t, http.MethodPut, "/admin/ipfilter", `{"allow":["10.0.0.0/33"]}`, &errResp)
+	if f.overrides.SubmitRate() || f.overrides.IPFilter() {
+		t.Fatalf("want no overrides,actual submit_rate %v ip_filter %v", f.overrides.SubmitRate(), f.overrides.IPFilter())
+	}
+
+	f.do(t, http.MethodPatch, "/admin/limits", `{"submit_burst":20}`, nil)
+	if !f.overrides.SubmitRate() {
+		t.Errorf("want true,actual false")
+	}
+	f.do(t, http.MethodPatch, "/admin/ipfilter", `{"deny_add":["10.0.0.1"]}`, nil)
+	if !f.overrides.IPFilter() {
+		t.Errorf("want true,actual false")
+	}
+}
+
+func TestHandler_Profiles(t *testing.T) {
+	f := newFixture(t)
+
+	var profile Profile
+	for _, target := range []string{"/admin/profile/heap", "/admin/profile/cpu?seconds=1"} {
+		if code := f.do(t, http.MethodPost, target, "", &profile); code != http.StatusOK {
+			t.Fatalf("%s: want 200,actual %d", target, code)
+		}
+		fi, err := os.Stat(profile.File)
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		if fi.Size() == 0 || fi.Size() != profile.Bytes {
+			t.Errorf("%s: want %d bytes,actual %d", target, profile.Bytes, fi.Size())
+		}
+	}
+
+	if code := f.do(t, http.MethodPost, "/admin/profile/cpu?seconds=0", "", nil); code != http.StatusBadRequest {
+		t.Errorf("want %d,actual %d", http.StatusBadRequest, code)
+	}
+	if code := f.do(t, http.MethodGet, "/admin/profile/heap", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d,actual %d", http.StatusMethodNotAllowed, code)
+	}
+}
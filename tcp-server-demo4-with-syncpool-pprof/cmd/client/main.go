@@ -1,27 +1,73 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/lucasepe/codename"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/config"
 	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/logging"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
 	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/tlsutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
 )
 
-var num = 30
+// clientID 生成逻辑客户端的标识，服务端可以按它限流
+func clientID(i int) string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), i)
+}
 
-func startNewConn() {
-	conn, err := net.Dial("tcp", ":8888")
+func startNewConn(cfg *config.Client, tlsConfig *tls.Config, clientID string) {
+	logger := slog.With("client_id", clientID)
+	conn, err := transport.Dial(cfg.Addr, tlsConfig)
 	if err != nil {
-		log.Println("dial error:", err)
+		logger.Error("dial error", "err", err)
 		return
 	}
 	defer conn.Close()
-	log.Printf("%s : dial ok \n", time.Now().Format("2006-01-02 15:04:05"))
+	logger.Info("dial ok", "local", conn.LocalAddr().String())
+	runClient(conn, clientID, logger)
+}
+
+// startMuxConns 建立一条复用连接，并在其上为每个逻辑客户端打开一个 stream
+func startMuxConns(cfg *config.Client, tlsConfig *tls.Config, wg *sync.WaitGroup) {
+	conn, err := transport.Dial(cfg.Addr, tlsConfig)
+	if err != nil {
+		slog.Error("dial error", "err", err)
+		return
+	}
+	session := mux.Client(conn, nil)
+	defer session.Close()
+	slog.Info("dial ok", "local", conn.LocalAddr().String(), "mux", true)
+
+	wg.Add(cfg.Conns)
+	for i := 0; i < cfg.Conns; i++ {
+		stream, err := session.Open()
+		if err != nil {
+			slog.Error("open stream error", "err", err)
+			wg.Done()
+			continue
+		}
+		go func(i int) {
+			defer wg.Done()
+			defer stream.Close()
+			id := clientID(i)
+			runClient(stream, id, slog.With("client_id", id))
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runClient 在一个逻辑连接上持续发送 submit 并接收 submit ack
+func runClient(conn net.Conn, clientID string, logger *slog.Logger) {
 	// 生成 payload
 	rng, err := codename.DefaultRNG()
 	if err != nil {
@@ -30,6 +76,17 @@ func startNewConn() {
 
 	frameCodec := frame.NewMyFrameCodec()
 	var counter int
+	done := make(chan struct{}) // 收到服务端 Disconnect 后关闭
+
+	// 连接建立后先发送 Conn 包，告知服务端客户端标识
+	connPayload, err := packet.Encode(&packet.Conn{ClientID: clientID})
+	if err != nil {
+		panic(err)
+	}
+	if err = frameCodec.Encode(conn, connPayload); err != nil {
+		logger.Error("send conn error", "err", err)
+		return
+	}
 
 	go func() {
 		// handle ack
@@ -41,6 +98,15 @@ func startNewConn() {
 			}
 
 			p, err := packet.Decode(ackFramePayload)
+			if d, ok := p.(*packet.Disconnect); ok {
+				// 服务端要求断开，停止发送
+				logger.Info("disconnected by server", "code", d.Code, "reason", d.Reason)
+				close(done)
+				return
+			}
+			if _, ok := p.(*packet.ConnAck); ok {
+				continue
+			}
 			_, ok := p.(*packet.SubmitAck)
 			if !ok {
 				panic("not submitack")
@@ -51,6 +117,12 @@ func startNewConn() {
 	}()
 
 	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
 		// send submit
 		counter++
 		id := fmt.Sprintf("%08d", counter) // 8 byte string
@@ -71,21 +143,58 @@ func startNewConn() {
 		// 把数据内容通过 connection 发给 server
 		err = frameCodec.Encode(conn, framePayload)
 		if err != nil {
-			panic(err)
+			// 服务端关闭时写操作可能先于 Disconnect 的读取失败，稍等读 goroutine 确认
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+				panic(err)
+			}
 		}
 	}
 }
 
 func main() {
+	cfg, err := config.LoadClient(os.Args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			slog.Error("load config error", "err", err)
+			os.Exit(2)
+		}
+		return
+	}
+	logger, _ := logging.New(os.Stdout, logging.Options{Level: cfg.LogLevel, Format: cfg.LogFormat}) // 已由 Validate 校验
+	slog.SetDefault(logger)
+	logger.Info("effective config", "config", cfg)
+
+	var tlsConfig *tls.Config
+	if cfg.TLS {
+		tlsConfig, err = tlsutil.ClientConfig(tlsutil.ClientOptions{
+			CAFile:     cfg.TLSCA,
+			CertFile:   cfg.TLSCert,
+			KeyFile:    cfg.TLSKey,
+			ServerName: cfg.TLSServerName,
+			MinVersion: cfg.TLSMinVersion,
+		})
+		if err != nil {
+			logger.Error("load tls config error", "err", err)
+			os.Exit(2)
+		}
+	}
+
 	var wg sync.WaitGroup
-	//num := 1
-	wg.Add(num)
+	// -mux 时所有逻辑客户端共用一条 TCP 连接，每个客户端对应其上的一个 stream
+	if cfg.Mux {
+		startMuxConns(cfg, tlsConfig, &wg)
+		return
+	}
+	wg.Add(cfg.Conns)
 
-	for i := 0; i < num; i++ {
-		go func() {
+	for i := 0; i < cfg.Conns; i++ {
+		go func(i int) {
 			defer wg.Done()
-			startNewConn()
-		}()
+			startNewConn(cfg, tlsConfig, clientID(i))
+		}(i)
 	}
 	wg.Wait()
 }
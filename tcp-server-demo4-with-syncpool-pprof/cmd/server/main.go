@@ -1,120 +1,632 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/admin"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/config"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/dedup"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/interceptor"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/logging"
 	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
 	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/tlsutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/upgrade"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/wal"
 )
 
 /**
 version 4 with syncPool 在 version 3 with syncPool 基础上增加 SubmitAck结构体 池化技术
 */
-// 处理 packet 包数据,Packet 是业务真正需要的消息
-func handlePacket(framePayload []byte) (ackFramePayload []byte, err error) {
-	var p packet.Packet
-	p, err = packet.Decode(framePayload)
-	if err != nil {
-		fmt.Println("handleConn: packet decode error:", err)
+// handlePacket 处理 packet 包数据,Packet 是业务真正需要的消息；
+// 配置了预写日志时 Submit 先写入日志，fsync 之后才回复 SubmitAck；日志打开之前 Submit 在 walLoader.wait 中等待
+func handlePacket(loader *walLoader) server.HandlerFunc {
+	return func(w server.ResponseWriter, r *server.Request) {
+		switch p := r.Packet.(type) {
+		case *packet.Conn:
+			if err := w.Write(&packet.ConnAck{Result: packet.ResultOK}); err != nil {
+				r.Logger().Warn("write conn ack error", "err", err)
+			}
+		case *packet.Submit:
+			//fmt.Printf("recv submit: id = %s,payload=%s \n", p.ID, string(p.Payload))
+			wl := loader.wl
+			if wl == nil {
+				writeSubmitAck(w, r.Logger(), p.ID, packet.ResultOK)
+				return
+			}
+			// AppendAsync 返回前已复制 Payload，p 可以照常归还给对象池
+			id, logger := p.ID, r.Logger()
+			wl.AppendAsync(wal.Record{ClientID: r.ClientID, ID: p.ID, Payload: p.Payload}, func(err error) {
+				result := uint8(packet.ResultOK)
+				if err != nil {
+					logger.Error("wal append error", "err", err)
+					result = packet.ResultError
+				}
+				// 不读取响应的客户端出站队列满时 Write 会阻塞，不能阻塞所有记录共用的回调 goroutine；
+				// 阻塞的 Write 计入内存预算，在写超时或连接关闭后返回
+				go writeSubmitAck(w, logger, id, result)
+			})
+		default:
+			r.Logger().Warn("unknown packet type", "packet", packet.Name(r.Packet))
+		}
+	}
+}
+
+func writeSubmitAck(w server.ResponseWriter, logger *slog.Logger, id string, result uint8) {
+	submitAck := packet.SubmitAckPool.Get().(*packet.SubmitAck) // 从 SubmitAckPool 池中获取一个 SubmitAck 内存对象
+	submitAck.ID = id
+	submitAck.Result = result
+	submitAck.Flags = 0
+
+	err := w.Write(submitAck)
+	packet.SubmitAckPool.Put(submitAck) // 将 submitAck 对象归还给 Pool 池
+	switch {
+	case errors.Is(err, server.ErrConnClosed):
+		// 异步回复时连接可能已经关闭，客户端会重发没有收到响应的消息
+		logger.Debug("write submit ack error", "err", err)
+	case err != nil:
+		logger.Warn("write submit ack error", "err", err)
+	}
+}
+
+// 平滑升级时新进程等待旧进程关闭预写日志的时间，在 shutdown-timeout 之外额外等待
+const walLockGrace = 5 * time.Second
+
+// 按 wal-retention 检查并删除旧段的最长间隔
+const walPruneInterval = time.Minute
+
+// walLoader 打开预写日志并从中恢复去重窗口。平滑升级启动的新进程要等旧进程排空连接、关闭日志后才能打开，
+// 期间已经在继承的 listener 上接受连接，Submit 在 wait 中等待日志打开，其他请求照常处理
+type walLoader struct {
+	ready chan struct{} // load 完成后关闭
+	wl    *wal.Log      // 没有配置 wal-dir 时为 nil
+	err   error
+}
+
+func newWALLoader() *walLoader {
+	return &walLoader{ready: make(chan struct{})}
+}
+
+// load 打开预写日志，再从中恢复 cache，完成后关闭 ready
+func (l *walLoader) load(cfg *config.Server, logger *slog.Logger, cache *dedup.Cache, upgraded bool) {
+	defer close(l.ready)
+	start := time.Now()
+	if l.wl, l.err = openWAL(cfg, logger, upgraded); l.err != nil {
+		l.err = fmt.Errorf("open wal: %w", l.err)
 		return
 	}
-	switch p.(type) {
-	case *packet.Submit:
-		submit := p.(*packet.Submit)
-		//fmt.Printf("recv submit: id = %s,payload=%s \n", submit.ID, string(submit.Payload))
-		submitAck := &packet.SubmitAck{
-			ID:     submit.ID,
-			Result: 0,
-		}
+	if err := restoreDedup(cfg, logger, cache); err != nil {
+		l.wl.Close()
+		l.wl, l.err = nil, fmt.Errorf("restore dedup window: %w", err)
+		return
+	}
+	if upgraded && l.wl != nil {
+		logger.Info("upgrade: wal opened", "took", time.Since(start))
+	}
+	if l.wl != nil && cfg.WALRetention > 0 {
+		go pruneWAL(l.wl, cfg.WALRetention, logger)
+	}
+}
 
-		packet.SubmitPool.Put(submit) // 将 submit 对象归还给 Pool 池
-		ackFramePayload, err = packet.Encode(submitAck)
-		packet.SubmitAckPool.Put(submitAck) // 将 submitAck 对象归还给 Pool 池
+// pruneWAL 定期删除最后写入早于 retention 的段，日志关闭后退出
+func pruneWAL(wl *wal.Log, retention time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(min(retention, walPruneInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := wl.RemoveBefore(time.Now().Add(-retention))
+		if err == wal.ErrClosed {
+			return
+		}
 		if err != nil {
-			fmt.Println("handleConn: packet encode error:", err)
-			return nil, err
+			logger.Error("wal: remove segments error", "err", err)
+		} else if n > 0 {
+			logger.Info("wal: removed segments", "segments", n, "retention", retention)
 		}
-		return ackFramePayload, nil
-	default:
-		return nil, fmt.Errorf("unknown packet type")
 	}
 }
 
-// handle client connection
-func handleConn(c net.Conn) {
-	metrics.ClientConnected.Inc() //连接建立，ClientConnected + 1
-	defer func() {
-		metrics.ClientConnected.Dec() // 连接断开，ClientConnected - 1
-		c.Close()
-		if err := recover(); err != nil {
-			fmt.Printf("handleConn occurring error: recover panic[%s] and exit\n", err)
+// wait 在 load 完成之前暂停处理 Submit，放在 Dedup 之前，去重窗口恢复之后才开始去重。
+// 连接关闭或日志打开失败时回复 ResultError，客户端稍后重发
+func (l *walLoader) wait() server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		s, ok := r.Packet.(*packet.Submit)
+		if !ok {
+			next.ServePacket(w, r)
+			return
+		}
+		select {
+		case <-l.ready:
+		case <-r.Context().Done():
+			writeSubmitAck(w, r.Logger(), s.ID, packet.ResultError)
+			return
+		}
+		if l.err != nil {
+			writeSubmitAck(w, r.Logger(), s.ID, packet.ResultError)
+			return
 		}
-	}()
-	frameCodec := frame.NewMyFrameCodec()
+		next.ServePacket(w, r)
+	}
+}
 
-	// 读缓存变量，避免每次都从 net.Conn 读取，降低 Syscall 调用频率
-	rbuf := bufio.NewReader(c)
-	// 写缓存变量
-	wbuf := bufio.NewWriter(c)
-	defer wbuf.Flush()
-	for {
-		// read from the connection
+// openWAL 按配置打开预写日志，没有配置 wal-dir 时返回 nil。
+// 平滑升级启动的新进程等待旧进程排空连接、关闭日志后才能打开
+func openWAL(cfg *config.Server, logger *slog.Logger, upgraded bool) (*wal.Log, error) {
+	if cfg.WALDir == "" {
+		return nil, nil
+	}
+	policy, _ := wal.ParseSyncPolicy(cfg.WALSync) // 已由 Validate 校验
+	opts := wal.Options{
+		Sync:         policy,
+		SyncInterval: cfg.WALSyncInterval,
+		SegmentSize:  int64(cfg.WALSegmentSize),
+		Logger:       logger,
+	}
+	if upgraded {
+		opts.LockTimeout = cfg.ShutdownTimeout + walLockGrace
+	}
+	return wal.Open(cfg.WALDir, opts)
+}
 
-		// decode the frame to get the payload
-		// 从 connection 中读取  client 发送的数据内容
-		framePayload, err := frameCodec.Decode(rbuf)
-		if err != nil {
-			fmt.Println("handleConn: frame decode error:", err)
+// submitRateLimit 把配置转换为 server.RateLimit
+func submitRateLimit(cfg *config.Server) server.RateLimit {
+	rl := server.RateLimit{Rate: cfg.SubmitRate, Burst: cfg.SubmitBurst}
+	switch cfg.SubmitRateKey {
+	case "client":
+		rl.Key = server.RateLimitByClientID
+	case "ip":
+		rl.Key = server.RateLimitByIP
+	}
+	if cfg.SubmitRateAction == "pause" {
+		rl.Action = server.RateLimitPause
+	}
+	return rl
+}
+
+// workerPool 把配置转换为 server.WorkerPool
+func workerPool(cfg *config.Server) server.WorkerPool {
+	wp := server.WorkerPool{Size: cfg.WorkerPoolSize, QueueDepth: cfg.WorkerQueueDepth}
+	if cfg.WorkerOrderBy == "client" {
+		wp.OrderBy = server.OrderByClientID
+	}
+	return wp
+}
+
+// memoryBudget 根据配置创建内存预算
+func memoryBudget(cfg *config.Server) server.MemoryBudget {
+	b := server.MemoryBudget{
+		MaxBytes:     cfg.MemoryBudgetBytes,
+		MaxMessages:  cfg.MemoryBudgetMessages,
+		LowWatermark: cfg.MemoryBudgetLowWatermark,
+	}
+	if cfg.OverloadAction == "reject" {
+		b.Action = server.OverloadReject
+	}
+	return b
+}
+
+// ipFilter 根据配置创建源 IP 过滤
+func ipFilter(cfg *config.Server) server.IPFilter {
+	allow, deny, _ := cfg.IPFilter() // 已由 Validate 校验
+	return server.IPFilter{Allow: allow, Deny: deny}
+}
+
+// proxyProtocol 根据配置创建 PROXY protocol 配置，proxy-protocol-trusted 为空时不启用
+func proxyProtocol(cfg *config.Server) server.ProxyProtocol {
+	trusted, _ := cfg.ProxyTrustedCIDRs() // 已由 Validate 校验
+	return server.ProxyProtocol{TrustedCIDRs: trusted, HeaderTimeout: cfg.ProxyProtocolTimeout}
+}
+
+// interceptors 根据配置组装 Interceptor 链，cache 不为 nil 时对 Submit 去重
+func interceptors(cfg *config.Server, cache *dedup.Cache, loader *walLoader) []server.Interceptor {
+	chain := []server.Interceptor{interceptor.Recovery(), interceptor.Logging(), interceptor.Metrics()}
+	if cfg.RequireClientID {
+		chain = append(chain, interceptor.Auth(interceptor.RequireClientID))
+	}
+	if cfg.WALDir != "" {
+		chain = append(chain, loader.wait())
+	}
+	if cache != nil {
+		chain = append(chain, interceptor.Dedup(cache))
+	}
+	if cfg.HandlerTimeout > 0 {
+		chain = append(chain, interceptor.Timeout(cfg.HandlerTimeout))
+	}
+	return chain
+}
+
+// newDedupCache 按配置创建去重缓存，dedup-size 为 0 时返回 nil
+func newDedupCache(cfg *config.Server) *dedup.Cache {
+	if cfg.DedupSize == 0 {
+		return nil
+	}
+	return dedup.New(dedup.Options{Size: cfg.DedupSize, TTL: cfg.DedupTTL})
+}
+
+// restoreDedup 启用预写日志时从日志中恢复 dedup-ttl 内已确认的消息，重启前确认过的消息重发时不会被再次处理。
+// 必须在打开日志之后调用，平滑升级时才能读到旧进程最后写入的记录
+func restoreDedup(cfg *config.Server, logger *slog.Logger, cache *dedup.Cache) error {
+	if cache == nil || cfg.WALDir == "" || !cfg.DedupRestore {
+		return nil
+	}
+	start := time.Now()
+	err := wal.ReplaySince(cfg.WALDir, start.Add(-cfg.DedupTTL), func(rec wal.Record) error {
+		if rec.ClientID != "" {
+			cache.Add(rec.ClientID, rec.ID, rec.Time, packet.ResultOK)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("dedup window restored from wal", "message_ids", cache.Len(), "took", time.Since(start))
+	return nil
+}
+
+// reload 重新加载配置，目前只有 submit-rate、submit-burst、ip-allow 和 ip-deny 在运行时生效，
+// 已通过管理接口修改过的配置项保持不变；启用 TLS 时同时重新读取证书文件，之后的新连接使用新的证书
+func reload(srv *server.Server, certs *tlsutil.ServerReloader, overrides *admin.Overrides) {
+	cfg, err := config.LoadServer(os.Args[1:])
+	if err != nil {
+		slog.Error("reload config error", "err", err)
+		return
+	}
+	if overrides.SubmitRate() {
+		slog.Warn("reload: submit rate was changed through the admin API, keeping it",
+			"submit_rate", cfg.SubmitRate, "submit_burst", cfg.SubmitBurst)
+	} else {
+		srv.SetSubmitRateLimit(cfg.SubmitRate, cfg.SubmitBurst)
+	}
+	if overrides.IPFilter() {
+		slog.Warn("reload: ip filter was changed through the admin API, keeping it",
+			"ip_allow", cfg.IPAllow, "ip_deny", cfg.IPDeny)
+	} else {
+		srv.SetIPFilter(ipFilter(cfg))
+	}
+	slog.Info("config reloaded", "submit_rate", cfg.SubmitRate, "submit_burst", cfg.SubmitBurst,
+		"ip_allow", cfg.IPAllow, "ip_deny", cfg.IPDeny)
+	if certs != nil {
+		if err := certs.Reload(); err != nil {
+			slog.Error("reload tls certificates error", "err", err)
 			return
 		}
+		slog.Info("tls certificates reloaded")
+	}
+}
 
-		metrics.ReqRecvTotal.Add(1) // 收到并解码一个消息请求，ReqRecvTotal 消息计数器 +1
+// listenerSet 进程打开的所有 listener，按名称索引，平滑升级时全部交给新进程。
+// 服务地址以配置中的地址命名，分片 listener 加上 #分片编号，metrics 和 pprof 的 listener 分别命名为 metrics 和 pprof
+type listenerSet struct {
+	inherited map[string]net.Listener // 从旧进程继承、尚未使用的 listener
+	named     map[string]net.Listener
+}
 
-		//do something with the packet
-		ackFramePayload, err := handlePacket(framePayload)
-		if err != nil {
-			fmt.Println("handleConn:handle packet error:", err)
-			return
+func newListenerSet(inherited map[string]net.Listener) *listenerSet {
+	return &listenerSet{inherited: inherited, named: make(map[string]net.Listener)}
+}
+
+// listen 返回名为 name 的 listener，优先使用从旧进程继承的，否则调用 open 创建
+func (ls *listenerSet) listen(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	l, ok := ls.inherited[name]
+	if ok {
+		delete(ls.inherited, name)
+	} else {
+		var err error
+		if l, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	ls.named[name] = l
+	return l, nil
+}
+
+// listenShards 返回 addr 上的 n 个分片 listener，从旧进程继承了全部分片时直接使用，
+// 否则新建；旧进程的分片同样设置了 SO_REUSEPORT，新旧 listener 可以同时绑定
+func (ls *listenerSet) listenShards(addr string, n int) ([]net.Listener, error) {
+	names := make([]string, n)
+	shards := make([]net.Listener, n)
+	for i := range shards {
+		names[i] = fmt.Sprintf("%s#%d", addr, i)
+		l, ok := ls.inherited[names[i]]
+		if !ok {
+			shards = nil
+			break
 		}
+		shards[i] = transport.NewShard(l, i)
+	}
+	if shards != nil {
+		for _, name := range names {
+			delete(ls.inherited, name)
+		}
+	} else {
+		var err error
+		if shards, err = transport.ListenShards(addr, n); err != nil {
+			return nil, err
+		}
+	}
+	for i, l := range shards {
+		ls.named[names[i]] = l
+	}
+	return shards, nil
+}
+
+// closeUnused 关闭从旧进程继承、但当前配置不再使用的 listener
+func (ls *listenerSet) closeUnused() {
+	for name, l := range ls.inherited {
+		slog.Info("close unused inherited listener", "name", name, "addr", transport.Format(l.Addr()))
+		l.Close()
+		delete(ls.inherited, name)
+	}
+}
 
-		//write ack frame to the connection
-		err = frameCodec.Encode(wbuf, ackFramePayload)
+// close 关闭所有 listener
+func (ls *listenerSet) close() {
+	ls.closeUnused()
+	for _, l := range ls.named {
+		l.Close()
+	}
+}
+
+// listen 监听配置中的所有地址，启用 reuseport-shards 时每个 TCP 地址打开多个 listener
+func listen(cfg *config.Server, ls *listenerSet) ([]net.Listener, error) {
+	socketMode, _ := cfg.SocketMode() // 已由 Validate 校验
+	var listeners []net.Listener
+	for _, addr := range cfg.ListenAddrs() {
+		l, err := listenAddr(addr, cfg.ReusePortShards, socketMode, ls)
 		if err != nil {
-			fmt.Println("handleConn: frame encode error:", err)
-			return
+			return nil, err
 		}
-		metrics.RspSendTotal.Add(1) //返回响应后，RspSendTotal 消息计数器 -1
+		listeners = append(listeners, l...)
+	}
+	return listeners, nil
+}
+
+func listenAddr(addr string, shards int, socketMode os.FileMode, ls *listenerSet) ([]net.Listener, error) {
+	if network, _, err := transport.ParseAddr(addr); err == nil && network == "tcp" && shards > 1 {
+		return ls.listenShards(addr, shards)
+	}
+	l, err := ls.listen(addr, func() (net.Listener, error) {
+		return transport.Listen(addr, transport.ListenOptions{SocketMode: socketMode})
+	})
+	if err != nil {
+		return nil, err
 	}
+	return []net.Listener{l}, nil
+}
+
+// startUpgrade 启动新版本的可执行文件并交出所有 listener，新进程就绪后返回 true，
+// 当前进程随后停止接受新连接并排空已有连接；失败时当前进程继续服务
+func startUpgrade(ls *listenerSet, timeout time.Duration) bool {
+	slog.Info("upgrade: starting new process", "listeners", len(ls.named))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	proc, err := upgrade.Start(ctx, ls.named)
+	if err != nil {
+		slog.Error("upgrade error, keep serving", "err", err)
+		return false
+	}
+	slog.Info("upgrade: new process ready, draining", "pid", proc.Pid)
+	return true
 }
 
 func main() {
-	go func() {
-		http.ListenAndServe(":6060", nil)
-	}()
+	cfg, err := config.LoadServer(os.Args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			slog.Error("load config error", "err", err)
+			os.Exit(2)
+		}
+		return
+	}
+	// 日志级别可以通过管理接口在运行时调整
+	logLevel := new(slog.LevelVar)
+	logger, _ := logging.New(os.Stdout, logging.Options{ // 已由 Validate 校验
+		Level:            cfg.LogLevel,
+		Format:           cfg.LogFormat,
+		SampleFirst:      cfg.LogSampleFirst,
+		SampleThereafter: cfg.LogSampleThereafter,
+		LevelVar:         logLevel,
+	})
+	slog.SetDefault(logger)
+	logger.Info("effective config", "config", cfg)
+
+	// 收到 SIGINT/SIGTERM 时 ctx 被取消
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	l, err := net.Listen("tcp", ":8888")
+	// 由平滑升级启动时从旧进程继承 listener
+	upgraded := upgrade.Upgraded()
+	inherited, err := upgrade.Inherited()
 	if err != nil {
-		fmt.Println("listen error:", err)
+		logger.Error("inherit listeners error", "err", err)
 		return
 	}
+	numInherited := len(inherited)
+	ls := newListenerSet(inherited)
+	defer ls.close()
 
-	fmt.Println("server start ok(on *:8888)")
-	// DeadLoop 不断监控是否有新的连接
-	for {
-		//在没有新连接的时候，这个服务会阻塞在 Accept 调用上，直到有客户端连接上来，Accept 方法将返回一个 net.Conn 实例
-		c, err := l.Accept()
+	var httpServers []*http.Server
+	if cfg.PprofEnabled {
+		pprofServer := &http.Server{Addr: cfg.PprofAddr, Handler: http.DefaultServeMux}
+		if l, err := ls.listen("pprof", func() (net.Listener, error) { return net.Listen("tcp", cfg.PprofAddr) }); err != nil {
+			logger.Error("pprof http server start failed", "err", err)
+		} else {
+			go pprofServer.Serve(l)
+			httpServers = append(httpServers, pprofServer)
+		}
+	}
+
+	var certs *tlsutil.ServerReloader
+	if cfg.TLSCert != "" {
+		certs, err = tlsutil.NewServerReloader(tlsutil.ServerOptions{
+			CertFile:     cfg.TLSCert,
+			KeyFile:      cfg.TLSKey,
+			ClientCAFile: cfg.TLSClientCA,
+			MinVersion:   cfg.TLSMinVersion,
+		})
 		if err != nil {
-			fmt.Println("accept error:", err)
-			break
+			logger.Error("load tls certificates error", "err", err)
+			return
 		}
+	}
+
+	listeners, err := listen(cfg, ls)
+	if err != nil {
+		logger.Error("listen error", "err", err)
+		return
+	}
+	var metricsListener net.Listener
+	if cfg.MetricsEnabled {
+		if metricsListener, err = ls.listen("metrics", func() (net.Listener, error) { return net.Listen("tcp", cfg.MetricsAddr) }); err != nil {
+			logger.Error("prometheus-exporter http server start failed", "err", err)
+		}
+	}
+	ls.closeUnused()
+	// listener 都已就绪，通知旧进程停止接受新连接；之后到达的连接在 accept 队列中等待
+	if err := upgrade.Ready(); err != nil {
+		logger.Error("notify old process error", "err", err)
+		return
+	}
+	if upgraded {
+		logger.Info("upgrade: listeners inherited from old process", "listeners", numInherited)
+	}
+
+	cache := newDedupCache(cfg)
+	loader := newWALLoader()
+	if upgraded {
+		// 旧进程关闭预写日志之前就开始接受连接，升级期间不中断服务；Submit 等到日志打开后再处理
+		go loader.load(cfg, logger, cache, upgraded)
+	} else {
+		loader.load(cfg, logger, cache, upgraded)
+		if loader.err != nil {
+			logger.Error("load wal error", "err", loader.err)
+			return
+		}
+	}
 
-		// start a new goroutine to handle the new connection.
-		// the new connection
-		go handleConn(c)
+	logger.Info("server start ok", "listen", cfg.Listen)
+	opts := []server.Option{
+		server.WithReadBufferSize(cfg.ReadBufferSize),
+		server.WithWriteBufferSize(cfg.WriteBufferSize),
+		server.WithMaxFrameSize(cfg.MaxFrameSize),
+		server.WithFlushPolicy(server.FlushPolicy{
+			OnIdle:   cfg.FlushOnIdle,
+			Interval: cfg.FlushInterval,
+			Bytes:    cfg.FlushBytes,
+		}),
+		server.WithOutboundQueueSize(cfg.OutboundQueue),
+		server.WithMuxMaxStreams(cfg.MuxMaxStreams),
+		server.WithHandshakeTimeout(cfg.HandshakeTimeout),
+		server.WithIdleTimeout(cfg.IdleTimeout),
+		server.WithFrameTimeout(cfg.FrameTimeout),
+		server.WithWriteTimeout(cfg.WriteTimeout),
+		server.WithMaxConns(cfg.MaxConns),
+		server.WithMaxConnsPerIP(cfg.MaxConnsPerIP),
+		server.WithAcceptRate(cfg.AcceptRate, cfg.AcceptBurst),
+		server.WithIPFilter(ipFilter(cfg)),
+		server.WithSubmitRateLimit(submitRateLimit(cfg)),
+		server.WithWorkerPool(workerPool(cfg)),
+		server.WithMemoryBudget(memoryBudget(cfg)),
+		server.WithProxyProtocol(proxyProtocol(cfg)),
+		server.WithEventLoops(cfg.EventLoops),
+		server.WithInterceptors(interceptors(cfg, cache, loader)...),
+		server.WithLogger(logger),
+	}
+	if cfg.Engine == "epoll" {
+		opts = append(opts, server.WithEngine(server.EngineEpoll))
+	}
+	if certs != nil {
+		opts = append(opts, server.WithTLSConfig(certs.Config()))
+	}
+	srv := server.New(handlePacket(loader), opts...)
+
+	// 管理接口修改过的配置项，SIGHUP 时不被配置文件覆盖
+	overrides := new(admin.Overrides)
+	if metricsListener != nil {
+		var adminHandler http.Handler
+		if cfg.AdminToken != "" {
+			adminHandler = admin.NewHandler(admin.Options{
+				Token:      cfg.AdminToken,
+				Server:     srv,
+				LogLevel:   logLevel,
+				ProfileDir: cfg.AdminProfileDir,
+				Overrides:  overrides,
+			})
+		}
+		metricsServer := metrics.NewServer(cfg.MetricsAddr, adminHandler)
+		go metricsServer.Serve(metricsListener)
+		httpServers = append(httpServers, metricsServer)
+		logger.Info("metrics server start ok", "addr", cfg.MetricsAddr, "admin", adminHandler != nil)
+	}
+
+	// 所有 listener 共用同一个 Server，任何一个 Serve 出错时退出
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			serveErr <- srv.Serve(l)
+		}(l)
+	}
+
+	// 收到 SIGHUP 时重新加载配置，调整可以在运行时修改的配置项
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	// 收到 SIGUSR2 时平滑升级：启动新版本的可执行文件并交出 listener，之后排空连接并退出
+	usr2 := make(chan os.Signal, 1)
+	if len(upgrade.Signals) > 0 {
+		signal.Notify(usr2, upgrade.Signals...)
+		defer signal.Stop(usr2)
+	}
+
+	walReady := loader.ready
+	for running := true; running; {
+		select {
+		case <-walReady:
+			walReady = nil
+			if loader.err != nil {
+				logger.Error("load wal error", "err", loader.err)
+				running = false
+			}
+		case err := <-serveErr:
+			logger.Error("serve error", "err", err)
+			return
+		case <-hup:
+			reload(srv, certs, overrides)
+		case <-usr2:
+			running = !startUpgrade(ls, cfg.UpgradeTimeout)
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	stop() // 再次收到信号时直接退出
+
+	logger.Info("server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("server shutdown error", "err", err)
+	}
+	for _, hs := range httpServers {
+		hs.Shutdown(shutdownCtx)
+	}
+	// 连接关闭后再关闭预写日志，等待中的记录在 Close 中 fsync
+	<-loader.ready
+	if wl := loader.wl; wl != nil {
+		if err := wl.Close(); err != nil {
+			logger.Error("close wal error", "err", err)
+		}
 	}
+	logger.Info("server exit")
 }
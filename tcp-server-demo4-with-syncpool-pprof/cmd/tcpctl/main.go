@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/admin"
+)
+
+// tcpctl 通过 metrics http server 上的管理接口操作运行中的服务端
+/*
+用法
+	tcpctl [-addr host:port] [-token token] [-o text|json] <command> [arguments]
+命令
+	sessions [-client-id id]                    列出会话
+	kick (-id n | -client-id id) [-reason r]    强制断开会话
+	stats [-interval 1s] [-count n]             每隔 interval 输出一次吞吐量和连接数，count 为 0 时一直输出
+	log-level [level]                           查看或修改日志级别
+	drain [status|start|abort]                  查看、开始或撤销排空
+	ipfilter [allow|deny add|remove cidr...]    查看源 IP 过滤，或在 allow、deny 列表中增删地址段
+环境变量
+	TCPCTL_ADDR 和 TCPCTL_TOKEN 作为 -addr 和 -token 的默认值
+*/
+
+const usage = `usage: tcpctl [-addr host:port] [-token token] [-o text|json] <command> [arguments]
+
+commands:
+  sessions [-client-id id]                  list sessions
+  kick (-id n | -client-id id) [-reason r]  disconnect sessions
+  stats [-interval 1s] [-count n]           show throughput and connection counts, count 0 runs until interrupted
+  log-level [level]                         show or change the log level
+  drain [status|start|abort]                show, start or abort a drain
+  ipfilter [allow|deny add|remove cidr...]  show the source IP filter, or edit its allow or deny list
+`
+
+// metrics 中 stats 命令使用的指标
+const (
+	metricConnected = "tcp_server_demo2_client_connected"
+	metricRecv      = "tcp_server_demo2_req_recv_total"
+	metricSend      = "tcp_server_demo2_rsp_send_total"
+	metricRejected  = "tcp_server_demo2_conn_rejected_total"
+)
+
+// ctl 一次命令执行的上下文
+type ctl struct {
+	base   string // 管理接口的地址，如 http://127.0.0.1:8889
+	token  string
+	json   bool // 以 JSON 格式输出
+	client *http.Client
+	out    io.Writer
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "tcpctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("tcpctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage, "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", envOr("TCPCTL_ADDR", "127.0.0.1:8889"), "metrics http server address of the tcp server (env TCPCTL_ADDR)")
+	token := fs.String("token", os.Getenv("TCPCTL_TOKEN"), "admin API token (env TCPCTL_TOKEN)")
+	output := fs.String("o", "text", "output format: text or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "http request timeout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, want text or json", *output)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	base := *addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	c := &ctl{
+		base:   strings.TrimSuffix(base, "/"),
+		token:  *token,
+		json:   *output == "json",
+		client: &http.Client{Timeout: *timeout},
+		out:    out,
+	}
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "sessions":
+		return c.sessions(cmdArgs)
+	case "kick":
+		return c.kick(cmdArgs)
+	case "stats":
+		return c.stats(cmdArgs)
+	case "log-level":
+		return c.logLevel(cmdArgs)
+	case "drain":
+		return c.drain(cmdArgs)
+	case "ipfilter":
+		return c.ipFilter(cmdArgs)
+	default:
+		return fmt.Errorf("unknown command %q, run tcpctl -h for usage", cmd)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (c *ctl) sessions(args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	clientID := fs.String("client-id", "", "only list sessions of this client id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := "/admin/sessions"
+	if *clientID != "" {
+		path += "?client_id=" + url.QueryEscape(*clientID)
+	}
+	var list admin.SessionList
+	raw, err := c.call(http.MethodGet, path, nil, &list)
+	if err != nil || c.json {
+		return c.printJSON(raw, err)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCLIENT ID\tREMOTE\tCONNECTED\tPKTS IN\tPKTS OUT\tBYTES IN\tBYTES OUT")
+	now := time.Now()
+	for _, s := range list.Sessions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			s.ID, orDash(s.ClientID), s.RemoteAddr, now.Sub(s.ConnectedAt).Truncate(time.Second),
+			s.PacketsIn, s.PacketsOut, s.BytesIn, s.BytesOut)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%d sessions\n", list.Count)
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (c *ctl) kick(args []string) error {
+	fs := flag.NewFlagSet("kick", flag.ContinueOnError)
+	var req admin.KickRequest
+	fs.Uint64Var(&req.ID, "id", 0, "session id")
+	fs.StringVar(&req.ClientID, "client-id", "", "disconnect all sessions of this client id")
+	fs.StringVar(&req.Reason, "reason", "", "reason sent to the client")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (req.ID == 0) == (req.ClientID == "") {
+		return errors.New("kick: exactly one of -id and -client-id must be set")
+	}
+	var resp admin.KickResponse
+	raw, err := c.call(http.MethodPost, "/admin/sessions/kick", req, &resp)
+	if err != nil || c.json {
+		return c.printJSON(raw, err)
+	}
+	_, err = fmt.Fprintf(c.out, "%d sessions kicked\n", resp.Kicked)
+	return err
+}
+
+func (c *ctl) logLevel(args []string) error {
+	var limits admin.Limits
+	var raw []byte
+	var err error
+	switch len(args) {
+	case 0:
+		raw, err = c.call(http.MethodGet, "/admin/limits", nil, &limits)
+	case 1:
+		raw, err = c.call(http.MethodPatch, "/admin/limits", admin.LimitsPatch{LogLevel: &args[0]}, &limits)
+	default:
+		return errors.New("log-level: want at most one argument")
+	}
+	if err != nil || c.json {
+		return c.printJSON(raw, err)
+	}
+	_, err = fmt.Fprintln(c.out, limits.LogLevel)
+	return err
+}
+
+func (c *ctl) drain(args []string) error {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("drain: want at most one argument")
+	}
+	method, ok := map[string]string{
+		"status": http.MethodGet,
+		"start":  http.MethodPost,
+		"abort":  http.MethodDelete,
+	}[action]
+	if !ok {
+		return fmt.Errorf("drain: unknown action %q, want status, start or abort", action)
+	}
+	var status admin.DrainStatus
+	raw, err := c.call(method, "/admin/drain", nil, &status)
+	if err != nil || c.json {
+		return c.printJSON(raw, err)
+	}
+	state := "not draining"
+	if status.Draining {
+		state = "draining"
+	}
+	_, err = fmt.Fprintf(c.out, "%s, %d sessions\n", state, status.Sessions)
+	return err
+}
+
+func (c *ctl) ipFilter(args []string) error {
+	var filter admin.IPFilter
+	var raw []byte
+	var err error
+	if len(args) == 0 {
+		raw, err = c.call(http.MethodGet, "/admin/ipfilter", nil, &filter)
+	} else {
+		if len(args) < 3 {
+			return errors.New("ipfilter: want allow|deny add|remove cidr...")
+		}
+		var patch admin.IPFilterPatch
+		lists := map[string]*[]string{
+			"allow add":    &patch.AllowAdd,
+			"allow remove": &patch.AllowRemove,
+			"deny add":     &patch.DenyAdd,
+			"deny remove":  &patch.DenyRemove,
+		}
+		list, ok := lists[args[0]+" "+args[1]]
+		if !ok {
+			return fmt.Errorf("ipfilter: unknown action %q, want allow|deny add|remove", args[0]+" "+args[1])
+		}
+		*list = args[2:]
+		raw, err = c.call(http.MethodPatch, "/admin/ipfilter", patch, &filter)
+	}
+	if err != nil || c.json {
+		return c.printJSON(raw, err)
+	}
+	allow := "any"
+	if len(filter.Allow) > 0 {
+		allow = strings.Join(filter.Allow, " ")
+	}
+	_, err = fmt.Fprintf(c.out, "allow: %s\ndeny:  %s\n", allow, orDash(strings.Join(filter.Deny, " ")))
+	return err
+}
+
+// sample stats 命令的一行输出
+type sample struct {
+	Time           time.Time `json:"time"`
+	Connected      float64   `json:"connected"`
+	RecvPerSec     float64   `json:"recv_per_sec"`
+	SendPerSec     float64   `json:"send_per_sec"`
+	RejectedPerSec float64   `json:"rejected_per_sec"`
+}
+
+func (c *ctl) stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Second, "sampling interval")
+	count := fs.Int("count", 0, "number of samples, 0 runs until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("stats: interval must be positive")
+	}
+
+	prev, err := c.scrape()
+	if err != nil {
+		return err
+	}
+	prevTime := time.Now()
+	var tw *tabwriter.Writer
+	if !c.json {
+		tw = tabwriter.NewWriter(c.out, 10, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "TIME\tCONNECTED\tRECV/S\tSEND/S\tREJECTED/S\t")
+		tw.Flush()
+	}
+	for i := 0; *count == 0 || i < *count; i++ {
+		time.Sleep(*interval)
+		cur, err := c.scrape()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		elapsed := now.Sub(prevTime).Seconds()
+		s := sample{
+			Time:           now,
+			Connected:      cur[metricConnected],
+			RecvPerSec:     (cur[metricRecv] - prev[metricRecv]) / elapsed,
+			SendPerSec:     (cur[metricSend] - prev[metricSend]) / elapsed,
+			RejectedPerSec: (cur[metricRejected] - prev[metricRejected]) / elapsed,
+		}
+		prev, prevTime = cur, now
+
+		if c.json {
+			if err := json.NewEncoder(c.out).Encode(s); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%.1f\t%.1f\t%.1f\t\n", s.Time.Format("15:04:05"), s.Connected, s.RecvPerSec, s.SendPerSec, s.RejectedPerSec)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrape 读取 /metrics，返回 stats 使用的指标，带标签的指标按名字求和
+func (c *ctl) scrape() (map[string]float64, error) {
+	resp, err := c.client.Get(c.base + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /metrics: %s", resp.Status)
+	}
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		switch name {
+		case metricConnected, metricRecv, metricSend, metricRejected:
+		default:
+			continue
+		}
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("GET /metrics: invalid line %q", line)
+		}
+		values[name] += v
+	}
+	return values, scanner.Err()
+}
+
+// call 调用管理接口，把响应解码到 v 并返回原始响应；接口返回错误时 err 为接口给出的原因
+func (c *ctl) call(method, path string, body, v interface{}) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		if json.Unmarshal(raw, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, e.Error)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return raw, json.Unmarshal(raw, v)
+}
+
+// printJSON err 为 nil 时以缩进格式输出 raw
+func (c *ctl) printJSON(raw []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, bytes.TrimSpace(raw), "", "  "); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err = c.out.Write(b.Bytes())
+	return err
+}
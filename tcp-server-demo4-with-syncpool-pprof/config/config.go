@@ -0,0 +1,769 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/logging"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+// config 包负责加载 server 和 client 命令的配置
+/*
+配置来源及优先级(由低到高)
+	默认值 < 配置文件 < 环境变量 < 命令行参数
+配置项
+	每个配置项都对应一个命令行参数，如 -listen；
+	环境变量名为前缀加上大写的参数名，- 替换为 _，如 TCP_SERVER_LISTEN；
+	配置文件中的 key 与参数名相同，- 也可以写成 _
+配置文件
+	由 -config 参数或 <前缀>CONFIG 环境变量指定，支持两种格式：
+	JSON 对象，如 {"listen": ":9999", "pprof": false}
+	每行一个 key: value 的 YAML 风格文本，# 开头的行为注释
+*/
+
+const (
+	ServerEnvPrefix = "TCP_SERVER_"
+	ClientEnvPrefix = "TCP_CLIENT_"
+)
+
+// Server server 命令的配置
+type Server struct {
+	Listen          string        // 监听地址，多个地址用逗号分隔，支持 tcp:// 和 unix:// 前缀
+	UnixSocketMode  string        // unix socket 文件的权限(八进制)
+	ReusePortShards int           // 大于 1 时用 SO_REUSEPORT 在每个 TCP 地址上打开多个 listener，各自 Accept
+	MetricsEnabled  bool          // 是否启动 metrics http server
+	MetricsAddr     string        // metrics http server 监听地址
+	AdminToken      string        // metrics http server 上管理接口的访问令牌，为空时不启用管理接口
+	AdminProfileDir string        // 管理接口采集的 profile 文件的保存目录，为空时使用系统临时目录
+	PprofEnabled    bool          // 是否启动 pprof http server
+	PprofAddr       string        // pprof http server 监听地址
+	ReadBufferSize  int           // 每个连接的读缓存大小
+	WriteBufferSize int           // 每个连接的写缓存大小
+	MaxFrameSize    int           // 单个 frame 的最大长度，0 表示不限制(epoll 引擎下为 16MiB)
+	FlushOnIdle     bool          // 读缓存中没有待处理的请求且出站队列为空时刷新写缓存
+	FlushInterval   time.Duration // 响应在写缓存中停留的最长时间，0 表示不启用
+	FlushBytes      int           // 写缓存中的数据达到该字节数时刷新，0 表示不启用
+	OutboundQueue   int           // 每个连接出站队列的长度，队列满时暂停读取该连接
+	MuxMaxStreams   int           // 每条复用连接上同时打开的 stream 数量上限，0 表示不限制
+	ShutdownTimeout time.Duration // 收到退出信号后等待连接排空的最长时间
+	UpgradeTimeout  time.Duration // 收到 SIGUSR2 平滑升级时等待新进程就绪的最长时间
+
+	LogLevel            string // 日志级别：debug、info、warn 或 error
+	LogFormat           string // 日志格式：text 或 json
+	LogSampleFirst      int    // 每个 debug 消息每秒先输出的条数，0 表示不采样
+	LogSampleThereafter int    // 超过 log-sample-first 后每多少条 debug 消息输出一条
+
+	HandshakeTimeout time.Duration // 建立连接后收到第一个完整 frame 的最长时间，0 表示不限制
+	IdleTimeout      time.Duration // 两个 frame 之间允许的最长空闲时间，0 表示不限制
+	FrameTimeout     time.Duration // 读取一个 frame 的剩余部分的最长时间，0 表示不限制
+	WriteTimeout     time.Duration // 一次写出的最长时间，0 表示不限制
+
+	MaxConns      int     // 同时保持的最大连接数，0 表示不限制
+	MaxConnsPerIP int     // 同一个源 IP 同时保持的最大连接数，0 表示不限制
+	AcceptRate    float64 // 每秒接受的新连接数，0 表示不限制
+	AcceptBurst   int     // 新连接允许的突发数量
+	IPAllow       string  // 只接受这些地址段(CIDR 或单个 IP，逗号分隔)内的连接，为空时不限制，收到 SIGHUP 时重新加载，通过管理接口修改后不再重新加载
+	IPDeny        string  // 拒绝这些地址段内的连接，优先于 ip-allow，收到 SIGHUP 时重新加载，通过管理接口修改后不再重新加载
+
+	SubmitRate       float64 // 每个限流 key 每秒允许的 Submit 数，0 表示不限制，收到 SIGHUP 时重新加载，通过管理接口修改后不再重新加载
+	SubmitBurst      int     // Submit 允许的突发数量，收到 SIGHUP 时重新加载，通过管理接口修改后不再重新加载
+	SubmitRateKey    string  // Submit 限流的维度：conn、client 或 ip
+	SubmitRateAction string  // 超过限流速率时的处理方式：throttle 回复限流，pause 暂停读取
+
+	WorkerPoolSize   int    // 执行 Handler 的 worker 数量，0 表示在连接的读 goroutine 中执行
+	WorkerQueueDepth int    // 每个 worker 任务队列的长度
+	WorkerOrderBy    string // worker pool 中保证处理顺序的维度：conn 或 client
+
+	RequireClientID bool          // 拒绝没有客户端标识(Conn 包或客户端证书)的请求
+	HandlerTimeout  time.Duration // 请求上下文的截止时间，0 表示不限制
+
+	Engine     string // 连接处理模型：goroutine 或 epoll(仅 Linux)
+	EventLoops int    // epoll 模型的事件循环数量，0 表示等于 CPU 核数
+
+	TLSCert       string // 服务端证书文件(PEM)，设置后启用 TLS，收到 SIGHUP 时重新加载
+	TLSKey        string // 服务端私钥文件(PEM)，收到 SIGHUP 时重新加载
+	TLSClientCA   string // 校验客户端证书的 CA 文件(PEM)，设置后启用双向 TLS，收到 SIGHUP 时重新加载
+	TLSMinVersion string // 最低 TLS 版本：1.2 或 1.3
+
+	ProxyProtocolTrusted string        // 可信负载均衡的地址段(CIDR 或单个 IP)，逗号分隔，来自这些地址的连接必须以 PROXY protocol 头开始，为空时不启用
+	ProxyProtocolTimeout time.Duration // 读取 PROXY protocol 头的最长时间
+
+	WALDir          string        // 预写日志目录，设置后 Submit 写入日志并 fsync 之后才回复 SubmitAck，为空时不启用
+	WALSync         string        // 预写日志的 fsync 策略：always、batch 或 interval
+	WALSyncInterval time.Duration // interval 策略的 fsync 间隔
+	WALSegmentSize  int           // 预写日志段文件的最大字节数
+	WALRetention    time.Duration // 预写日志的保留时间，最后写入早于该时间的段被删除，0 表示不删除，由运维自行清理
+
+	DedupSize    int           // 每个客户端记录的最近消息 ID 数，用于识别重发的 Submit，0 表示不去重
+	DedupTTL     time.Duration // 消息 ID 记录的有效期
+	DedupRestore bool          // 启用预写日志时，启动时从日志中恢复 dedup-ttl 内的消息 ID
+
+	MemoryBudgetBytes        int64   // 在途字节数(未处理完的请求、未写出的响应和连接的读写缓存)上限，同时限制 max-frame-size，0 表示不限制
+	MemoryBudgetMessages     int64   // 在途消息数上限，0 表示不限制
+	MemoryBudgetLowWatermark float64 // 过载后用量回落到上限的该比例以下才恢复
+	OverloadAction           string  // 过载时对已有连接上请求的处理方式：pause 暂停读取，reject 回复过载
+}
+
+// DefaultServer 返回 server 命令的默认配置。frame 长度、连接超时和连接数默认不限制，与未引入这些配置之前的行为一致
+func DefaultServer() *Server {
+	return &Server{
+		Listen:          ":8888",
+		UnixSocketMode:  "0660",
+		MetricsEnabled:  true,
+		MetricsAddr:     ":8889",
+		PprofEnabled:    true,
+		PprofAddr:       ":6060",
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		FlushOnIdle:     true,
+		OutboundQueue:   64,
+		MuxMaxStreams:   mux.DefaultMaxStreams,
+		ShutdownTimeout: 10 * time.Second,
+		UpgradeTimeout:  30 * time.Second,
+
+		LogLevel:            "info",
+		LogFormat:           "text",
+		LogSampleFirst:      10,
+		LogSampleThereafter: 100,
+
+		AcceptBurst: 100,
+
+		SubmitBurst:      100,
+		SubmitRateKey:    "conn",
+		SubmitRateAction: "throttle",
+
+		WorkerQueueDepth: 128,
+		WorkerOrderBy:    "conn",
+
+		Engine: "goroutine",
+
+		TLSMinVersion: "1.2",
+
+		ProxyProtocolTimeout: 5 * time.Second,
+
+		WALSync:         "batch",
+		WALSyncInterval: 10 * time.Millisecond,
+		WALSegmentSize:  64 << 20,
+
+		DedupTTL:     10 * time.Minute,
+		DedupRestore: true,
+
+		MemoryBudgetLowWatermark: 0.8,
+		OverloadAction:           "pause",
+	}
+}
+
+func (c *Server) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "comma-separated listen addresses: host:port, tcp://host:port or unix:///path/to.sock")
+	fs.StringVar(&c.UnixSocketMode, "unix-socket-mode", c.UnixSocketMode, "file mode (octal) of unix socket listeners")
+	fs.IntVar(&c.ReusePortShards, "reuseport-shards", c.ReusePortShards, "open this many SO_REUSEPORT listeners with separate accept loops on each tcp address, 0 or 1 disables")
+	fs.BoolVar(&c.MetricsEnabled, "metrics", c.MetricsEnabled, "enable the metrics http server")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "metrics http server listen address")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token of the admin API on the metrics http server, empty disables the admin API")
+	fs.StringVar(&c.AdminProfileDir, "admin-profile-dir", c.AdminProfileDir, "directory for profiles captured through the admin API, empty uses the system temp directory")
+	fs.BoolVar(&c.PprofEnabled, "pprof", c.PprofEnabled, "enable the pprof http server")
+	fs.StringVar(&c.PprofAddr, "pprof-addr", c.PprofAddr, "pprof http server listen address")
+	fs.IntVar(&c.ReadBufferSize, "read-buffer-size", c.ReadBufferSize, "per-connection read buffer size in bytes")
+	fs.IntVar(&c.WriteBufferSize, "write-buffer-size", c.WriteBufferSize, "per-connection write buffer size in bytes")
+	fs.IntVar(&c.MaxFrameSize, "max-frame-size", c.MaxFrameSize, "maximum frame size in bytes, 0 means unlimited (16MiB with the epoll engine)")
+	fs.BoolVar(&c.FlushOnIdle, "flush-on-idle", c.FlushOnIdle, "flush the write buffer when no more requests are buffered and the outbound queue is empty")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", c.FlushInterval, "maximum time a response stays in the write buffer, 0 disables")
+	fs.IntVar(&c.FlushBytes, "flush-bytes", c.FlushBytes, "flush the write buffer once it holds this many bytes, 0 disables")
+	fs.IntVar(&c.OutboundQueue, "outbound-queue", c.OutboundQueue, "per-connection outbound queue length, reading pauses while it is full")
+	fs.IntVar(&c.MuxMaxStreams, "mux-max-streams", c.MuxMaxStreams, "maximum number of concurrent streams on a multiplexed connection, further streams are reset; 0 means unlimited")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for connections to drain on shutdown")
+	fs.DurationVar(&c.UpgradeTimeout, "upgrade-timeout", c.UpgradeTimeout, "on SIGUSR2, how long to wait for the new binary to take over the listeners before giving up")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.IntVar(&c.LogSampleFirst, "log-sample-first", c.LogSampleFirst, "debug logs: first N lines per message per second are written, 0 disables sampling")
+	fs.IntVar(&c.LogSampleThereafter, "log-sample-thereafter", c.LogSampleThereafter, "debug logs: after log-sample-first, every Nth line per message per second is written")
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "maximum time from accept to the first complete frame, 0 disables")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "maximum idle time between frames, 0 disables")
+	fs.DurationVar(&c.FrameTimeout, "frame-timeout", c.FrameTimeout, "maximum time to read the rest of a started frame, 0 disables")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum time for a single write to the connection, 0 disables")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "maximum number of concurrent connections, 0 means unlimited")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", c.MaxConnsPerIP, "maximum number of concurrent connections per source IP, 0 means unlimited")
+	fs.Float64Var(&c.AcceptRate, "accept-rate", c.AcceptRate, "new connections accepted per second, 0 means unlimited")
+	fs.IntVar(&c.AcceptBurst, "accept-burst", c.AcceptBurst, "burst of new connections allowed above accept-rate")
+	fs.StringVar(&c.IPAllow, "ip-allow", c.IPAllow, "comma-separated CIDRs or IPs allowed to connect, empty allows all; reloaded on SIGHUP unless changed through the admin API")
+	fs.StringVar(&c.IPDeny, "ip-deny", c.IPDeny, "comma-separated CIDRs or IPs denied from connecting, takes precedence over ip-allow; reloaded on SIGHUP unless changed through the admin API")
+	fs.Float64Var(&c.SubmitRate, "submit-rate", c.SubmitRate, "submits per second allowed per rate limit key, 0 means unlimited")
+	fs.IntVar(&c.SubmitBurst, "submit-burst", c.SubmitBurst, "burst of submits allowed above submit-rate")
+	fs.StringVar(&c.SubmitRateKey, "submit-rate-key", c.SubmitRateKey, "submit rate limit key: conn, client or ip")
+	fs.StringVar(&c.SubmitRateAction, "submit-rate-action", c.SubmitRateAction, "action when submit-rate is exceeded: throttle or pause")
+	fs.IntVar(&c.WorkerPoolSize, "worker-pool-size", c.WorkerPoolSize, "number of workers running handlers, 0 runs handlers on the connection goroutine")
+	fs.IntVar(&c.WorkerQueueDepth, "worker-queue-depth", c.WorkerQueueDepth, "per-worker queue length")
+	fs.StringVar(&c.WorkerOrderBy, "worker-order-by", c.WorkerOrderBy, "packets with the same key are handled in order: conn or client")
+	fs.BoolVar(&c.RequireClientID, "require-client-id", c.RequireClientID, "reject requests without a client id from a Conn packet or client certificate")
+	fs.DurationVar(&c.HandlerTimeout, "handler-timeout", c.HandlerTimeout, "deadline of the request context passed to the handler, 0 disables")
+	fs.StringVar(&c.Engine, "engine", c.Engine, "connection engine: goroutine, or epoll (linux only; no mux, TLS, flush policy, submit rate limit, worker pool, memory budget, PROXY protocol or dedup)")
+	fs.IntVar(&c.EventLoops, "event-loops", c.EventLoops, "number of epoll event loops, 0 means the number of CPUs")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file (PEM), enables TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file (PEM)")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "CA file (PEM) for verifying client certificates, enables mutual TLS")
+	fs.StringVar(&c.TLSMinVersion, "tls-min-version", c.TLSMinVersion, "minimum TLS version: 1.2 or 1.3")
+	fs.StringVar(&c.ProxyProtocolTrusted, "proxy-protocol-trusted", c.ProxyProtocolTrusted, "comma-separated CIDRs or IPs of load balancers that must send a PROXY protocol v1/v2 header; empty disables")
+	fs.DurationVar(&c.ProxyProtocolTimeout, "proxy-protocol-timeout", c.ProxyProtocolTimeout, "how long to wait for the PROXY protocol header from a trusted load balancer")
+	fs.StringVar(&c.WALDir, "wal-dir", c.WALDir, "write-ahead log directory, submits are acked only after they are stored there; empty disables")
+	fs.StringVar(&c.WALSync, "wal-sync", c.WALSync, "write-ahead log fsync policy: always, batch (group commit) or interval")
+	fs.DurationVar(&c.WALSyncInterval, "wal-sync-interval", c.WALSyncInterval, "fsync interval of the interval wal-sync policy")
+	fs.IntVar(&c.WALSegmentSize, "wal-segment-size", c.WALSegmentSize, "maximum size in bytes of a write-ahead log segment file")
+	fs.DurationVar(&c.WALRetention, "wal-retention", c.WALRetention, "delete write-ahead log segments last written longer ago than this, 0 keeps them until removed by the operator")
+	fs.IntVar(&c.DedupSize, "dedup-size", c.DedupSize, "number of recent message ids remembered per client to detect resent submits, 0 disables deduplication")
+	fs.DurationVar(&c.DedupTTL, "dedup-ttl", c.DedupTTL, "how long a message id is remembered, keep it shorter than the time clients take to reuse ids")
+	fs.BoolVar(&c.DedupRestore, "dedup-restore", c.DedupRestore, "rebuild the dedup window from the write-ahead log on startup when wal-dir is set")
+	fs.Int64Var(&c.MemoryBudgetBytes, "memory-budget-bytes", c.MemoryBudgetBytes, "server-wide limit on in-flight request, response and connection buffer bytes, also caps max-frame-size; 0 means unlimited")
+	fs.Int64Var(&c.MemoryBudgetMessages, "memory-budget-messages", c.MemoryBudgetMessages, "server-wide limit on in-flight requests and responses, 0 means unlimited")
+	fs.Float64Var(&c.MemoryBudgetLowWatermark, "memory-budget-low-watermark", c.MemoryBudgetLowWatermark, "once overloaded, the server recovers when usage drops below this fraction of the limits")
+	fs.StringVar(&c.OverloadAction, "overload-action", c.OverloadAction, "action on existing connections while overloaded: pause reading or reject submits; new connections are always rejected")
+}
+
+// Validate 校验配置
+func (c *Server) Validate() error {
+	var errs []string
+	if len(c.ListenAddrs()) == 0 {
+		errs = append(errs, "listen must not be empty")
+	}
+	for _, addr := range c.ListenAddrs() {
+		if _, _, err := transport.ParseAddr(addr); err != nil {
+			errs = append(errs, "listen: "+err.Error())
+		}
+	}
+	if c.ReusePortShards < 0 {
+		errs = append(errs, "reuseport-shards must not be negative")
+	}
+	if _, err := c.SocketMode(); err != nil {
+		errs = append(errs, "unix-socket-mode must be an octal file mode such as 0660")
+	}
+	if c.MetricsEnabled && c.MetricsAddr == "" {
+		errs = append(errs, "metrics-addr must not be empty when metrics is enabled")
+	}
+	if c.AdminToken != "" && !c.MetricsEnabled {
+		errs = append(errs, "admin-token requires metrics to be enabled")
+	}
+	if c.PprofEnabled && c.PprofAddr == "" {
+		errs = append(errs, "pprof-addr must not be empty when pprof is enabled")
+	}
+	if c.ReadBufferSize < 16 {
+		errs = append(errs, "read-buffer-size must be at least 16")
+	}
+	if c.WriteBufferSize < 16 {
+		errs = append(errs, "write-buffer-size must be at least 16")
+	}
+	if c.MaxFrameSize < 0 || (c.MaxFrameSize > 0 && c.MaxFrameSize < 5) {
+		errs = append(errs, "max-frame-size must be 0 or at least 5")
+	}
+	if c.FlushInterval < 0 {
+		errs = append(errs, "flush-interval must not be negative")
+	}
+	if c.FlushBytes < 0 {
+		errs = append(errs, "flush-bytes must not be negative")
+	}
+	if c.OutboundQueue < 1 {
+		errs = append(errs, "outbound-queue must be positive")
+	}
+	if c.MuxMaxStreams < 0 {
+		errs = append(errs, "mux-max-streams must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown-timeout must be positive")
+	}
+	if c.UpgradeTimeout <= 0 {
+		errs = append(errs, "upgrade-timeout must be positive")
+	}
+	errs = appendLogErrors(errs, c.LogLevel, c.LogFormat)
+	if c.LogSampleFirst < 0 {
+		errs = append(errs, "log-sample-first must not be negative")
+	}
+	if c.LogSampleThereafter < 0 {
+		errs = append(errs, "log-sample-thereafter must not be negative")
+	}
+	if c.HandshakeTimeout < 0 {
+		errs = append(errs, "handshake-timeout must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, "idle-timeout must not be negative")
+	}
+	if c.FrameTimeout < 0 {
+		errs = append(errs, "frame-timeout must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		errs = append(errs, "write-timeout must not be negative")
+	}
+	if c.MaxConns < 0 {
+		errs = append(errs, "max-conns must not be negative")
+	}
+	if c.MaxConnsPerIP < 0 {
+		errs = append(errs, "max-conns-per-ip must not be negative")
+	}
+	if c.AcceptRate < 0 {
+		errs = append(errs, "accept-rate must not be negative")
+	}
+	if c.AcceptRate > 0 && c.AcceptBurst < 1 {
+		errs = append(errs, "accept-burst must be positive when accept-rate is set")
+	}
+	if _, err := transport.ParsePrefixes(c.IPAllow); err != nil {
+		errs = append(errs, "ip-allow: "+err.Error())
+	}
+	if _, err := transport.ParsePrefixes(c.IPDeny); err != nil {
+		errs = append(errs, "ip-deny: "+err.Error())
+	}
+	if c.SubmitRate < 0 {
+		errs = append(errs, "submit-rate must not be negative")
+	}
+	if c.SubmitRate > 0 && c.SubmitBurst < 1 {
+		errs = append(errs, "submit-burst must be positive when submit-rate is set")
+	}
+	switch c.SubmitRateKey {
+	case "conn", "client", "ip":
+	default:
+		errs = append(errs, "submit-rate-key must be one of conn, client, ip")
+	}
+	switch c.SubmitRateAction {
+	case "throttle", "pause":
+	default:
+		errs = append(errs, "submit-rate-action must be one of throttle, pause")
+	}
+	if c.WorkerPoolSize < 0 {
+		errs = append(errs, "worker-pool-size must not be negative")
+	}
+	if c.WorkerQueueDepth < 1 {
+		errs = append(errs, "worker-queue-depth must be positive")
+	}
+	switch c.WorkerOrderBy {
+	case "conn", "client":
+	default:
+		errs = append(errs, "worker-order-by must be one of conn, client")
+	}
+	if c.HandlerTimeout < 0 {
+		errs = append(errs, "handler-timeout must not be negative")
+	}
+	switch c.Engine {
+	case "goroutine":
+	case "epoll":
+		if c.WorkerPoolSize > 0 {
+			errs = append(errs, "worker-pool-size is not supported with engine epoll")
+		}
+		if c.SubmitRate > 0 {
+			errs = append(errs, "submit-rate is not supported with engine epoll")
+		}
+		if c.TLSCert != "" {
+			errs = append(errs, "tls-cert is not supported with engine epoll")
+		}
+		if c.MemoryBudgetBytes > 0 || c.MemoryBudgetMessages > 0 {
+			errs = append(errs, "memory-budget-bytes and memory-budget-messages are not supported with engine epoll")
+		}
+		if c.ProxyProtocolTrusted != "" {
+			errs = append(errs, "proxy-protocol-trusted is not supported with engine epoll")
+		}
+		if c.DedupSize > 0 {
+			errs = append(errs, "dedup-size is not supported with engine epoll")
+		}
+		if c.MuxMaxStreams != mux.DefaultMaxStreams {
+			errs = append(errs, "mux-max-streams is not supported with engine epoll")
+		}
+	default:
+		errs = append(errs, "engine must be one of goroutine, epoll")
+	}
+	if c.EventLoops < 0 {
+		errs = append(errs, "event-loops must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls-cert and tls-key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, "tls-client-ca requires tls-cert")
+	}
+	errs = appendTLSVersionError(errs, c.TLSMinVersion)
+	if _, err := c.ProxyTrustedCIDRs(); err != nil {
+		errs = append(errs, "proxy-protocol-trusted: "+err.Error())
+	}
+	if c.ProxyProtocolTimeout <= 0 {
+		errs = append(errs, "proxy-protocol-timeout must be positive")
+	}
+	switch c.WALSync {
+	case "always", "batch":
+	case "interval":
+		if c.WALSyncInterval <= 0 {
+			errs = append(errs, "wal-sync-interval must be positive with wal-sync interval")
+		}
+	default:
+		errs = append(errs, "wal-sync must be one of always, batch, interval")
+	}
+	if c.WALSegmentSize < 1024 {
+		errs = append(errs, "wal-segment-size must be at least 1024")
+	}
+	if c.WALRetention < 0 {
+		errs = append(errs, "wal-retention must not be negative")
+	}
+	// 恢复去重窗口需要 dedup-ttl 内的记录
+	if c.WALRetention > 0 && c.DedupSize > 0 && c.DedupRestore && c.WALRetention < c.DedupTTL {
+		errs = append(errs, "wal-retention must not be shorter than dedup-ttl with dedup-restore")
+	}
+	if c.DedupSize < 0 {
+		errs = append(errs, "dedup-size must not be negative")
+	}
+	if c.DedupSize > 0 && c.DedupTTL <= 0 {
+		errs = append(errs, "dedup-ttl must be positive when dedup-size is set")
+	}
+	if c.MemoryBudgetBytes < 0 {
+		errs = append(errs, "memory-budget-bytes must not be negative")
+	}
+	if c.MemoryBudgetMessages < 0 {
+		errs = append(errs, "memory-budget-messages must not be negative")
+	}
+	// 连接数达到上限时读写缓存就超过预算，会一直处于过载状态
+	if bufs := int64(c.MaxConns) * int64(c.ReadBufferSize+c.WriteBufferSize); c.MemoryBudgetBytes > 0 && c.MaxConns > 0 && c.MemoryBudgetBytes <= bufs {
+		errs = append(errs, fmt.Sprintf("memory-budget-bytes must be larger than max-conns * (read-buffer-size + write-buffer-size) = %d", bufs))
+	}
+	if c.MemoryBudgetLowWatermark <= 0 || c.MemoryBudgetLowWatermark >= 1 {
+		errs = append(errs, "memory-budget-low-watermark must be between 0 and 1")
+	}
+	switch c.OverloadAction {
+	case "pause", "reject":
+	default:
+		errs = append(errs, "overload-action must be one of pause, reject")
+	}
+	return joinErrors(errs)
+}
+
+// ListenAddrs 返回 listen 中的各个监听地址
+func (c *Server) ListenAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.Listen, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// IPFilter 返回 ip-allow 和 ip-deny 中的地址段，单个 IP 转换为只包含该地址的地址段
+func (c *Server) IPFilter() (allow, deny []netip.Prefix, err error) {
+	if allow, err = transport.ParsePrefixes(c.IPAllow); err != nil {
+		return nil, nil, err
+	}
+	if deny, err = transport.ParsePrefixes(c.IPDeny); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+// ProxyTrustedCIDRs 返回 proxy-protocol-trusted 中的地址段，单个 IP 转换为只包含该地址的地址段
+func (c *Server) ProxyTrustedCIDRs() ([]netip.Prefix, error) {
+	return transport.ParsePrefixes(c.ProxyProtocolTrusted)
+}
+
+// SocketMode 返回 unix-socket-mode 对应的文件权限
+func (c *Server) SocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid unix socket mode %q", c.UnixSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// String 返回生效的配置，每行一个 name=value
+func (c *Server) String() string {
+	cp := *c
+	return format(cp.register)
+}
+
+// LogValue 实现 slog.LogValuer，把生效的配置记录为一组属性
+func (c *Server) LogValue() slog.Value {
+	cp := *c
+	return logValue(cp.register)
+}
+
+// Client client 命令的配置
+type Client struct {
+	Addr  string // 服务端地址，支持 tcp:// 和 unix:// 前缀
+	Conns int    // 逻辑客户端数量
+	Mux   bool   // 是否让所有逻辑客户端共用一条复用连接
+
+	LogLevel  string // 日志级别：debug、info、warn 或 error
+	LogFormat string // 日志格式：text 或 json
+
+	TLS           bool   // 是否使用 TLS 连接服务端
+	TLSCA         string // 校验服务端证书的 CA 文件(PEM)，为空时使用系统 CA
+	TLSCert       string // 客户端证书文件(PEM)，服务端要求双向 TLS 时使用
+	TLSKey        string // 客户端私钥文件(PEM)
+	TLSServerName string // 校验服务端证书时使用的主机名，为空时使用 addr 中的主机名
+	TLSMinVersion string // 最低 TLS 版本：1.2 或 1.3
+}
+
+// DefaultClient 返回 client 命令的默认配置
+func DefaultClient() *Client {
+	return &Client{
+		Addr:  ":8888",
+		Conns: 30,
+
+		LogLevel:  "info",
+		LogFormat: "text",
+
+		TLSMinVersion: "1.2",
+	}
+}
+
+func (c *Client) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "server address: host:port, tcp://host:port or unix:///path/to.sock")
+	fs.IntVar(&c.Conns, "conns", c.Conns, "number of logical clients")
+	fs.BoolVar(&c.Mux, "mux", c.Mux, "multiplex all logical clients over one connection")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "connect to the server over TLS")
+	fs.StringVar(&c.TLSCA, "tls-ca", c.TLSCA, "CA file (PEM) for verifying the server certificate, empty uses the system roots")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "client certificate file (PEM) for mutual TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "client private key file (PEM) for mutual TLS")
+	fs.StringVar(&c.TLSServerName, "tls-server-name", c.TLSServerName, "server name used to verify the server certificate, empty uses the host in addr")
+	fs.StringVar(&c.TLSMinVersion, "tls-min-version", c.TLSMinVersion, "minimum TLS version: 1.2 or 1.3")
+}
+
+// Validate 校验配置
+func (c *Client) Validate() error {
+	var errs []string
+	if c.Addr == "" {
+		errs = append(errs, "addr must not be empty")
+	} else if _, _, err := transport.ParseAddr(c.Addr); err != nil {
+		errs = append(errs, "addr: "+err.Error())
+	}
+	if c.Conns <= 0 {
+		errs = append(errs, "conns must be positive")
+	}
+	errs = appendLogErrors(errs, c.LogLevel, c.LogFormat)
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls-cert and tls-key must be set together")
+	}
+	errs = appendTLSVersionError(errs, c.TLSMinVersion)
+	return joinErrors(errs)
+}
+
+func appendLogErrors(errs []string, level, format string) []string {
+	if _, err := logging.ParseLevel(level); err != nil {
+		errs = append(errs, "log-level must be one of debug, info, warn, error")
+	}
+	switch format {
+	case "text", "json":
+	default:
+		errs = append(errs, "log-format must be one of text, json")
+	}
+	return errs
+}
+
+func appendTLSVersionError(errs []string, version string) []string {
+	switch version {
+	case "1.2", "1.3":
+		return errs
+	default:
+		return append(errs, "tls-min-version must be one of 1.2, 1.3")
+	}
+}
+
+// String 返回生效的配置，每行一个 name=value
+func (c *Client) String() string {
+	cp := *c
+	return format(cp.register)
+}
+
+// LogValue 实现 slog.LogValuer，把生效的配置记录为一组属性
+func (c *Client) LogValue() slog.Value {
+	cp := *c
+	return logValue(cp.register)
+}
+
+// LoadServer 从命令行参数、环境变量和配置文件加载 server 命令的配置
+func LoadServer(args []string) (*Server, error) {
+	c := DefaultServer()
+	if err := load("server", c.register, args, ServerEnvPrefix, os.Getenv); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// LoadClient 从命令行参数、环境变量和配置文件加载 client 命令的配置
+func LoadClient(args []string) (*Client, error) {
+	c := DefaultClient()
+	if err := load("client", c.register, args, ClientEnvPrefix, os.Getenv); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// load 按 默认值 < 配置文件 < 环境变量 < 命令行参数 的优先级填充 register 绑定的配置项
+func load(name string, register func(*flag.FlagSet), args []string, envPrefix string, getenv func(string) string) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	register(fs)
+	var configFile string
+	fs.StringVar(&configFile, "config", "", "config file (JSON or key: value lines)")
+
+	// 先解析命令行参数，记下显式设置的参数，最后再覆盖回去
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+
+	if configFile == "" {
+		configFile = explicit["config"]
+	}
+	if configFile == "" {
+		configFile = getenv(envPrefix + "CONFIG")
+	}
+	if configFile != "" {
+		values, err := readFile(configFile)
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			if key == "config" || fs.Lookup(key) == nil {
+				return fmt.Errorf("config file %s: unknown key %q", configFile, key)
+			}
+			if err := fs.Set(key, value); err != nil {
+				return fmt.Errorf("config file %s: invalid value %q for %s: %v", configFile, value, key, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value := getenv(env); value != "" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, env, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range explicit {
+		fs.Set(key, value)
+	}
+	return nil
+}
+
+// readFile 读取配置文件，返回 key -> value
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseJSON(data)
+	}
+	return parseKeyValue(data)
+}
+
+func parseJSON(data []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[normalizeKey(key)] = v
+		case bool:
+			values[normalizeKey(key)] = strconv.FormatBool(v)
+		case float64:
+			values[normalizeKey(key)] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("unsupported value for %s: %v", key, v)
+		}
+	}
+	return values, nil
+}
+
+func parseKeyValue(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key: value, actual %q", line, text)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		values[normalizeKey(key)] = value
+	}
+	return values, scanner.Err()
+}
+
+func normalizeKey(key string) string {
+	return strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+}
+
+// secrets 输出配置时隐藏值的配置项
+var secrets = map[string]bool{
+	"admin-token": true,
+}
+
+// displayValue 返回输出用的配置值，隐藏 secrets 中非空的值
+func displayValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if secrets[f.Name] && value != "" {
+		return "******"
+	}
+	return value
+}
+
+// format 按参数名排序输出配置项
+func format(register func(*flag.FlagSet)) string {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	register(fs)
+	var b strings.Builder
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&b, "%s=%s\n", f.Name, displayValue(f))
+	})
+	return b.String()
+}
+
+// logValue 按参数名排序把配置项转换为一组属性
+func logValue(register func(*flag.FlagSet)) slog.Value {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	register(fs)
+	var attrs []slog.Attr
+	fs.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, displayValue(f)))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New("invalid config: " + strings.Join(errs, "; "))
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return path
+}
+
+func envOf(m map[string]string) func(string) string {
+	return func(key string) string {
+		return m[key]
+	}
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	c := DefaultServer()
+	if err := load("server", c.register, nil, ServerEnvPrefix, envOf(nil)); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if *c != *DefaultServer() {
+		t.Errorf("want %+v,actual %+v", DefaultServer(), c)
+	}
+	// 默认不限制，升级后已有的慢客户端和长连接不受影响
+	if c.MaxFrameSize != 0 || c.HandshakeTimeout != 0 || c.IdleTimeout != 0 || c.FrameTimeout != 0 || c.WriteTimeout != 0 || c.MaxConns != 0 {
+		t.Errorf("want all limits disabled,actual %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	file := writeFile(t, "server.yaml", `
+# 配置文件
+listen: ":7000"
+metrics_addr: ':7001'
+pprof: false
+flush-interval: 5ms
+read-buffer-size: 1024
+`)
+	env := envOf(map[string]string{
+		"TCP_SERVER_CONFIG":       file,
+		"TCP_SERVER_METRICS_ADDR": ":7101",
+		"TCP_SERVER_LISTEN":       ":7100",
+	})
+	args := []string{"-listen", ":7200"}
+
+	c := DefaultServer()
+	if err := load("server", c.register, args, ServerEnvPrefix, env); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	// 命令行参数 > 环境变量 > 配置文件 > 默认值
+	if c.Listen != ":7200" {
+		t.Errorf("want :7200,actual %s", c.Listen)
+	}
+	if c.MetricsAddr != ":7101" {
+		t.Errorf("want :7101,actual %s", c.MetricsAddr)
+	}
+	if c.PprofEnabled {
+		t.Errorf("want false,actual true")
+	}
+	if c.FlushInterval != 5*time.Millisecond {
+		t.Errorf("want 5ms,actual %s", c.FlushInterval)
+	}
+	if c.ReadBufferSize != 1024 {
+		t.Errorf("want 1024,actual %d", c.ReadBufferSize)
+	}
+	if c.WriteBufferSize != 4096 {
+		t.Errorf("want 4096,actual %d", c.WriteBufferSize)
+	}
+}
+
+func TestLoad_JSONFile(t *testing.T) {
+	file := writeFile(t, "client.json", `{"addr": "10.0.0.1:8888", "conns": 5, "mux": true}`)
+
+	c := DefaultClient()
+	if err := load("client", c.register, []string{"-config", file}, ClientEnvPrefix, envOf(nil)); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if c.Addr != "10.0.0.1:8888" || c.Conns != 5 || !c.Mux {
+		t.Errorf("want {10.0.0.1:8888 5 true},actual %+v", c)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	unknown := writeFile(t, "bad.yaml", "no-such-key: 1\n")
+	badValue := writeFile(t, "bad.json", `{"conns": "many"}`)
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown flag", []string{"-no-such-flag"}, nil},
+		{"unknown file key", []string{"-config", unknown}, nil},
+		{"invalid file value", []string{"-config", badValue}, nil},
+		{"invalid env value", nil, map[string]string{"TCP_CLIENT_CONNS": "x"}},
+		{"missing file", []string{"-config", "/no/such/file"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultClient()
+			if err := load("client", c.register, tt.args, ClientEnvPrefix, envOf(tt.env)); err == nil {
+				t.Errorf("want non-nil,actual nil")
+			}
+		})
+	}
+}
+
+func TestServer_Validate(t *testing.T) {
+	c := DefaultServer()
+	c.Listen = ""
+	c.ReadBufferSize = 1
+	c.ShutdownTimeout = 0
+	c.UpgradeTimeout = -time.Second
+	c.IdleTimeout = -time.Second
+	c.SubmitRateKey = "user"
+	c.TLSKey = "server-key.pem"
+	c.UnixSocketMode = "rw"
+	c.ReusePortShards = -1
+	c.MuxMaxStreams = -1
+	c.WALSync = "never"
+	c.WALRetention = -time.Second
+	c.DedupSize = -1
+	c.MaxConns = 10
+	c.MemoryBudgetBytes = 1
+	c.MemoryBudgetLowWatermark = 1.5
+	c.OverloadAction = "drop"
+	c.ProxyProtocolTrusted = "10.0.0.0/8,lb"
+	c.IPAllow = "10.0.0.0/8"
+	c.IPDeny = "10.0.0.0/40"
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("want non-nil,actual nil")
+	}
+	for _, want := range []string{"listen", "read-buffer-size", "shutdown-timeout", "upgrade-timeout", "idle-timeout", "submit-rate-key", "tls-cert and tls-key", "unix-socket-mode", "reuseport-shards", "mux-max-streams", "wal-sync", "wal-retention", "dedup-size", "memory-budget-bytes", "memory-budget-low-watermark", "overload-action", "proxy-protocol-trusted", "ip-deny"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want %s in %s", want, err.Error())
+		}
+	}
+}
+
+func TestServer_ValidateEpoll(t *testing.T) {
+	c := DefaultServer()
+	c.Engine = "epoll"
+	c.WorkerPoolSize = 4
+	c.DedupSize = 1024
+	c.MuxMaxStreams = 16
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("want non-nil,actual nil")
+	}
+	for _, want := range []string{"worker-pool-size", "dedup-size", "mux-max-streams"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want %s in %s", want, err.Error())
+		}
+	}
+}
+
+func TestServer_ListenAddrs(t *testing.T) {
+	c := DefaultServer()
+	c.Listen = "tcp://:7000, unix:///tmp/server.sock,"
+	addrs := c.ListenAddrs()
+	if len(addrs) != 2 || addrs[0] != "tcp://:7000" || addrs[1] != "unix:///tmp/server.sock" {
+		t.Errorf("want [tcp://:7000 unix:///tmp/server.sock],actual %v", addrs)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+
+	c.Listen = ":7000,udp://:7001"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "udp://") {
+		t.Errorf("want udp:// in error,actual %v", err)
+	}
+}
+
+func TestServer_ProxyTrustedCIDRs(t *testing.T) {
+	c := DefaultServer()
+	c.ProxyProtocolTrusted = "10.1.2.3/8, 192.168.0.10,2001:db8::/32"
+	prefixes, err := c.ProxyTrustedCIDRs()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if want := "[10.0.0.0/8 192.168.0.10/32 2001:db8::/32]"; fmt.Sprint(prefixes) != want {
+		t.Errorf("want %s,actual %v", want, prefixes)
+	}
+}
+
+func TestServer_String(t *testing.T) {
+	c := DefaultServer()
+	c.Listen = ":9999"
+	s := c.String()
+	if !strings.Contains(s, "listen=:9999\n") {
+		t.Errorf("want listen=:9999,actual %s", s)
+	}
+	// String 不能修改配置
+	if c.Listen != ":9999" {
+		t.Errorf("want :9999,actual %s", c.Listen)
+	}
+}
+
+func TestServer_StringHidesSecrets(t *testing.T) {
+	c := DefaultServer()
+	c.AdminToken = "s3cret"
+	if s := c.String(); strings.Contains(s, "s3cret") || !strings.Contains(s, "admin-token=******\n") {
+		t.Errorf("want admin-token hidden,actual %s", s)
+	}
+	if v := c.LogValue().String(); strings.Contains(v, "s3cret") {
+		t.Errorf("want admin-token hidden,actual %s", v)
+	}
+}
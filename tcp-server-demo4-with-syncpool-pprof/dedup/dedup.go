@@ -0,0 +1,187 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedup 包按客户端记录最近处理过的消息 ID，用于识别客户端重连后重发的消息
+/*
+窗口
+	每个客户端最多记录 Size 个消息 ID，超过后淘汰最早的一个；记录在 TTL 之后过期，
+	过期或被淘汰的消息 ID 再次出现时当作新消息处理
+处理中的消息
+	Begin 返回的 Entry 在 Complete 之前处于处理中，这期间收到的重复消息
+	在原消息处理完成后以原消息的结果回调，不会被再次处理
+*/
+
+// 清理过期记录的间隔
+const sweepInterval = time.Minute
+
+// Options Cache 的配置
+type Options struct {
+	Size int           // 每个客户端记录的消息 ID 数
+	TTL  time.Duration // 记录的有效期
+}
+
+// Entry 一条消息的去重记录，由 Begin 返回，处理完成后交给 Complete 或 Abort
+type Entry struct {
+	clientID string
+	id       string
+	at       time.Time
+	done     bool
+	result   uint8
+	waiters  []func(result uint8) // 处理中收到的重复消息的回调
+	elem     *list.Element
+}
+
+// window 一个客户端的记录，order 按记录时间从早到晚排列
+type window struct {
+	entries map[string]*Entry
+	order   *list.List
+}
+
+func (w *window) remove(e *Entry) {
+	if w.entries[e.id] == e {
+		delete(w.entries, e.id)
+		w.order.Remove(e.elem)
+	}
+}
+
+// Cache 所有客户端的去重窗口，可以在多个 goroutine 中并发使用
+type Cache struct {
+	mu        sync.Mutex
+	opts      Options
+	clients   map[string]*window
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New 创建去重缓存
+func New(opts Options) *Cache {
+	return &Cache{
+		opts:      opts,
+		clients:   make(map[string]*window),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Begin 开始处理 clientID 的消息 id。新消息返回 Entry，调用方处理完后必须调用 Complete 或 Abort；
+// 重复的消息返回 nil，原消息已完成时立即、处理中时在完成后以原消息的结果调用 dup
+func (c *Cache) Begin(clientID, id string, dup func(result uint8)) *Entry {
+	now := c.now()
+	c.mu.Lock()
+	c.sweepLocked(now)
+	w := c.windowLocked(clientID)
+	if e, ok := w.entries[id]; ok {
+		if now.Sub(e.at) < c.opts.TTL {
+			if !e.done {
+				e.waiters = append(e.waiters, dup)
+				c.mu.Unlock()
+				return nil
+			}
+			result := e.result
+			c.mu.Unlock()
+			dup(result)
+			return nil
+		}
+		w.remove(e)
+	}
+	e := &Entry{clientID: clientID, id: id, at: now}
+	c.insertLocked(w, e)
+	c.mu.Unlock()
+	return e
+}
+
+// Complete 记录消息的处理结果，并以该结果回调处理期间收到的重复消息
+func (c *Cache) Complete(e *Entry, result uint8) {
+	c.mu.Lock()
+	e.done = true
+	e.result = result
+	waiters := e.waiters
+	e.waiters = nil
+	c.mu.Unlock()
+	for _, dup := range waiters {
+		dup(result)
+	}
+}
+
+// Abort 删除消息的记录，之后重发的消息会被再次处理；处理期间收到的重复消息以 result 回调
+func (c *Cache) Abort(e *Entry, result uint8) {
+	c.mu.Lock()
+	if w, ok := c.clients[e.clientID]; ok {
+		w.remove(e)
+	}
+	waiters := e.waiters
+	e.waiters = nil
+	c.mu.Unlock()
+	for _, dup := range waiters {
+		dup(result)
+	}
+}
+
+// Add 添加一条已完成的记录，用于启动时从持久化存储恢复窗口；at 之后已经超过 TTL 的记录被忽略。
+// 应按记录时间从早到晚调用
+func (c *Cache) Add(clientID, id string, at time.Time, result uint8) {
+	if c.now().Sub(at) >= c.opts.TTL {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.windowLocked(clientID)
+	if e, ok := w.entries[id]; ok {
+		w.remove(e)
+	}
+	c.insertLocked(w, &Entry{clientID: clientID, id: id, at: at, done: true, result: result})
+}
+
+// Len 返回所有客户端记录的消息 ID 数
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, w := range c.clients {
+		n += len(w.entries)
+	}
+	return n
+}
+
+func (c *Cache) windowLocked(clientID string) *window {
+	w, ok := c.clients[clientID]
+	if !ok {
+		w = &window{entries: make(map[string]*Entry), order: list.New()}
+		c.clients[clientID] = w
+	}
+	return w
+}
+
+// insertLocked 添加记录，超过 Size 时淘汰最早的记录
+func (c *Cache) insertLocked(w *window, e *Entry) {
+	e.elem = w.order.PushBack(e)
+	w.entries[e.id] = e
+	for w.order.Len() > c.opts.Size {
+		w.remove(w.order.Front().Value.(*Entry))
+	}
+}
+
+// sweepLocked 每隔 sweepInterval 删除过期的记录和没有记录的客户端
+func (c *Cache) sweepLocked(now time.Time) {
+	if now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for clientID, w := range c.clients {
+		for w.order.Len() > 0 {
+			e := w.order.Front().Value.(*Entry)
+			if now.Sub(e.at) < c.opts.TTL {
+				break
+			}
+			w.remove(e)
+		}
+		if w.order.Len() == 0 {
+			delete(c.clients, clientID)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestCache 返回使用 clock 作为当前时间的 Cache
+func newTestCache(opts Options, clock *time.Time) *Cache {
+	c := New(opts)
+	c.now = func() time.Time { return *clock }
+	c.lastSweep = *clock
+	return c
+}
+
+// dupRecorder 记录 dup 回调收到的结果
+type dupRecorder []uint8
+
+func (r *dupRecorder) dup(result uint8) {
+	*r = append(*r, result)
+}
+
+func TestCache_Duplicate(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	c := newTestCache(Options{Size: 10, TTL: time.Minute}, &clock)
+
+	var dups dupRecorder
+	e := c.Begin("device-1", "00000001", dups.dup)
+	if e == nil {
+		t.Fatalf("want new entry,actual duplicate")
+	}
+	// 处理中收到的重复消息等原消息完成后回调
+	if c.Begin("device-1", "00000001", dups.dup) != nil {
+		t.Fatalf("want duplicate,actual new entry")
+	}
+	if len(dups) != 0 {
+		t.Fatalf("want no callback before completion,actual %v", dups)
+	}
+	c.Complete(e, 2)
+	if len(dups) != 1 || dups[0] != 2 {
+		t.Fatalf("want [2],actual %v", dups)
+	}
+	// 完成后收到的重复消息立即回调
+	if c.Begin("device-1", "00000001", dups.dup) != nil || len(dups) != 2 || dups[1] != 2 {
+		t.Errorf("want [2 2],actual %v", dups)
+	}
+	// 不同客户端的相同消息 ID 互不影响
+	if c.Begin("device-2", "00000001", dups.dup) == nil {
+		t.Errorf("want new entry,actual duplicate")
+	}
+
+	// 过期后当作新消息
+	clock = clock.Add(time.Minute)
+	if c.Begin("device-1", "00000001", dups.dup) == nil {
+		t.Errorf("want new entry after ttl,actual duplicate")
+	}
+}
+
+func TestCache_Abort(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	c := newTestCache(Options{Size: 10, TTL: time.Minute}, &clock)
+
+	var dups dupRecorder
+	e := c.Begin("device-1", "00000001", dups.dup)
+	c.Begin("device-1", "00000001", dups.dup)
+	c.Abort(e, 1)
+	if len(dups) != 1 || dups[0] != 1 {
+		t.Errorf("want [1],actual %v", dups)
+	}
+	// 失败的消息重发后再次处理
+	if c.Begin("device-1", "00000001", dups.dup) == nil {
+		t.Errorf("want new entry after abort,actual duplicate")
+	}
+}
+
+func TestCache_Size(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	c := newTestCache(Options{Size: 2, TTL: time.Minute}, &clock)
+	var dups dupRecorder
+	for _, id := range []string{"00000001", "00000002", "00000003"} {
+		c.Complete(c.Begin("device-1", id, dups.dup), 0)
+	}
+	if c.Len() != 2 {
+		t.Errorf("want 2,actual %d", c.Len())
+	}
+	// 最早的记录被淘汰
+	if c.Begin("device-1", "00000001", dups.dup) == nil {
+		t.Errorf("want new entry after eviction,actual duplicate")
+	}
+	if c.Begin("device-1", "00000003", dups.dup) != nil {
+		t.Errorf("want duplicate,actual new entry")
+	}
+}
+
+func TestCache_AddAndSweep(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	c := newTestCache(Options{Size: 10, TTL: 5 * time.Minute}, &clock)
+	c.Add("device-1", "00000001", clock.Add(-10*time.Minute), 0) // 已过期，忽略
+	c.Add("device-1", "00000002", clock.Add(-4*time.Minute), 0)
+	c.Add("device-2", "00000001", clock.Add(-time.Minute), 0)
+	if c.Len() != 2 {
+		t.Fatalf("want 2,actual %d", c.Len())
+	}
+	var dups dupRecorder
+	if c.Begin("device-1", "00000002", dups.dup) != nil || len(dups) != 1 || dups[0] != 0 {
+		t.Errorf("want duplicate with result 0,actual %v", dups)
+	}
+
+	// 清理时删除过期的记录和没有记录的客户端
+	clock = clock.Add(2 * time.Minute)
+	c.Begin("device-3", "00000001", dups.dup)
+	if c.Len() != 2 {
+		t.Errorf("want 2,actual %d", c.Len())
+	}
+	if _, ok := c.clients["device-1"]; ok {
+		t.Errorf("want device-1 removed,actual found")
+	}
+}
@@ -25,13 +25,23 @@ type StreamFrameCodec interface {
 
 var ErrShortWrite = errors.New("short write")
 var ErrShortRead = errors.New("short read")
+var ErrInvalidLength = errors.New("invalid frame length")
+var ErrFrameTooLarge = errors.New("frame too large")
 
-type myFrameCodec struct{}
+type myFrameCodec struct {
+	maxFrameSize int32 // frame 总长度上限(含头)，0 表示不限制
+}
 
 func NewMyFrameCodec() StreamFrameCodec {
 	return &myFrameCodec{}
 }
 
+// NewMyFrameCodecWithLimit 创建限制 frame 总长度的编解码器，Decode 遇到超长的 frame 返回 ErrFrameTooLarge，
+// 避免恶意的 totalLen 导致服务端分配过大的内存
+func NewMyFrameCodecWithLimit(maxFrameSize int) StreamFrameCodec {
+	return &myFrameCodec{maxFrameSize: int32(maxFrameSize)}
+}
+
 // Encode 将输入的 Frame payload 编码为一个 Frame，并写入 io.Writer 所代表的输出 TCP 流中
 func (m *myFrameCodec) Encode(w io.Writer, framePayload FramePayload) error {
 
@@ -64,6 +74,12 @@ func (m *myFrameCodec) Decode(r io.Reader) (FramePayload, error) {
 	if err != nil {
 		return nil, err
 	}
+	if totalLen < 4 {
+		return nil, ErrInvalidLength
+	}
+	if m.maxFrameSize > 0 && totalLen > m.maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
 
 	buf := make([]byte, totalLen-4)
 	// io.ReadFull 一般会读满所需要的字节数,除非遇到 EOF 或 ErrUnexpectedEOF
@@ -78,3 +94,29 @@ func (m *myFrameCodec) Decode(r io.Reader) (FramePayload, error) {
 
 	return buf, nil
 }
+
+// Split 从 data 开头切出一个完整的 frame，返回 frame payload 和该 frame 的总长度(含头)；
+// data 中还不足一个完整的 frame 时返回 n == 0。payload 引用 data 的底层数组，不做拷贝，
+// 用于自行管理读缓存的场景(如 epoll)，maxFrameSize 为 0 表示不限制
+func Split(data []byte, maxFrameSize int) (payload FramePayload, n int, err error) {
+	if len(data) < 4 {
+		return nil, 0, nil
+	}
+	totalLen := int32(binary.BigEndian.Uint32(data))
+	if totalLen < 4 {
+		return nil, 0, ErrInvalidLength
+	}
+	if maxFrameSize > 0 && int(totalLen) > maxFrameSize {
+		return nil, 0, ErrFrameTooLarge
+	}
+	if len(data) < int(totalLen) {
+		return nil, 0, nil
+	}
+	return data[4:totalLen], int(totalLen), nil
+}
+
+// AppendFrame 将 frame payload 编码为一个 Frame 并追加到 dst，返回追加后的切片
+func AppendFrame(dst []byte, framePayload FramePayload) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(framePayload)+4))
+	return append(dst, framePayload...)
+}
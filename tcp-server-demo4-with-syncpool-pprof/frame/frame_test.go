@@ -120,3 +120,56 @@ func TestDecodeWithReadFail(t *testing.T) {
 		t.Errorf("want non-nil,actual nil")
 	}
 }
+
+func TestDecodeWithInvalidLength(t *testing.T) {
+	codec := NewMyFrameCodec()
+	// totalLen 小于帧头长度
+	data := []byte{0x0, 0x0, 0x0, 0x3}
+	_, err := codec.Decode(bytes.NewReader(data))
+	if err != ErrInvalidLength {
+		t.Errorf("want ErrInvalidLength,actual %v", err)
+	}
+
+	codec = NewMyFrameCodecWithLimit(8)
+	data = []byte{0x0, 0x0, 0x0, 0x9, 'h', 'e', 'l', 'l', 'o'}
+	_, err = codec.Decode(bytes.NewReader(data))
+	if err != ErrFrameTooLarge {
+		t.Errorf("want ErrFrameTooLarge,actual %v", err)
+	}
+
+	data = []byte{0x0, 0x0, 0x0, 0x8, 'h', 'e', 'l', 'l'}
+	payload, err := codec.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if string(payload) != "hell" {
+		t.Errorf("want hell,actual %s", string(payload))
+	}
+}
+
+func TestSplit(t *testing.T) {
+	data := AppendFrame(nil, []byte("hello"))
+	data = AppendFrame(data, []byte("world"))
+
+	payload, n, err := Split(data, 0)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if string(payload) != "hello" || n != 9 {
+		t.Errorf("want hello 9,actual %s %d", payload, n)
+	}
+
+	// 不足一个完整的 frame
+	for _, partial := range [][]byte{data[9:11], data[9:15]} {
+		if _, n, err := Split(partial, 0); n != 0 || err != nil {
+			t.Errorf("want 0 nil,actual %d %v", n, err)
+		}
+	}
+
+	if _, _, err := Split([]byte{0x0, 0x0, 0x0, 0x3}, 0); err != ErrInvalidLength {
+		t.Errorf("want ErrInvalidLength,actual %v", err)
+	}
+	if _, _, err := Split(data, 8); err != ErrFrameTooLarge {
+		t.Errorf("want ErrFrameTooLarge,actual %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/dedup"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+)
+
+// interceptor 包提供常用的 server.Interceptor，通过 server.WithInterceptors 注册
+/*
+推荐顺序(由外到内)
+	Recovery  Handler panic 时回复错误响应，连接继续处理后续请求
+	Logging   以 debug 级别记录每个请求的类型和耗时
+	Metrics   按 packet 类型统计处理耗时
+	Auth      拒绝未通过认证的请求
+	Dedup     识别客户端重发的 Submit，以第一次处理的结果回复
+	Timeout   为请求的上下文设置截止时间
+*/
+
+// ErrNoClientID 请求没有客户端标识
+var ErrNoClientID = errors.New("interceptor: client id required")
+
+// Recovery 捕获 Handler 的 panic，记录日志并向客户端回复 Result 为 ResultError 的响应
+func Recovery() server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		defer func() {
+			if err := recover(); err != nil {
+				metrics.HandlerPanicTotal.Inc()
+				r.Logger().Error("handler panic", "panic", err, "packet", packet.Name(r.Packet), "stack", string(debug.Stack()))
+				if ack := errorAck(r.Packet, packet.ResultError); ack != nil {
+					w.Write(ack)
+				}
+			}
+		}()
+		next.ServePacket(w, r)
+	}
+}
+
+// Logging 在请求处理完后以 debug 级别记录一行日志，日志带有连接的 conn_id、remote 和 client_id。
+// 每个请求都会经过这里，应配合采样使用，见 logging 包
+func Logging() server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		log := r.Logger()
+		if !log.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServePacket(w, r)
+			return
+		}
+		name, id := packet.Name(r.Packet), ""
+		if s, ok := r.Packet.(*packet.Submit); ok {
+			id = s.ID
+		}
+		start := time.Now()
+		next.ServePacket(w, r)
+		log.Debug("request handled", "packet", name, "id", id, "took", time.Since(start))
+	}
+}
+
+// Metrics 按 packet 类型统计 Handler 的处理耗时
+func Metrics() server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		start := time.Now()
+		next.ServePacket(w, r)
+		metrics.HandlerDurationSeconds.WithLabelValues(packet.Name(r.Packet)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Auth 用 check 检查每个请求，未通过时回复 Result 为 ResultUnauthorized 的响应，不再调用后续 Handler
+func Auth(check func(r *server.Request) error) server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		if err := check(r); err != nil {
+			metrics.AuthRejectedTotal.Inc()
+			if ack := errorAck(r.Packet, packet.ResultUnauthorized); ack != nil {
+				w.Write(ack)
+			}
+			return
+		}
+		next.ServePacket(w, r)
+	}
+}
+
+// RequireClientID 用于 Auth，要求请求带有客户端标识(来自 Conn 包或客户端证书)
+func RequireClientID(r *server.Request) error {
+	if r.ClientID == "" {
+		return ErrNoClientID
+	}
+	return nil
+}
+
+// Timeout 为请求的上下文设置截止时间，Handler 应在 r.Context() 结束后尽快返回。
+// Handler 超时返回时计入 metrics
+func Timeout(d time.Duration) server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServePacket(w, r.WithContext(ctx))
+		if ctx.Err() == context.DeadlineExceeded {
+			metrics.HandlerTimeoutTotal.Inc()
+		}
+	}
+}
+
+// Dedup 按客户端标识和消息 ID 识别重复的 Submit。重复的消息不再交给后续 Handler，
+// 而是在第一次收到的消息回复 SubmitAck 后，以相同的 Result 回复 Flags 带 SubmitAckDuplicate 的 SubmitAck。
+// 第一次处理的 Result 为 ResultError 时不记录，客户端重发的消息会被再次处理。
+// 没有客户端标识的请求不去重；Handler 必须为每个 Submit 回复 SubmitAck，否则重复的消息在记录过期前得不到回复
+func Dedup(cache *dedup.Cache) server.Interceptor {
+	return func(w server.ResponseWriter, r *server.Request, next server.Handler) {
+		s, ok := r.Packet.(*packet.Submit)
+		if !ok || r.ClientID == "" {
+			next.ServePacket(w, r)
+			return
+		}
+		id, log := s.ID, r.Logger()
+		entry := cache.Begin(r.ClientID, id, func(result uint8) {
+			metrics.SubmitDuplicateTotal.Inc()
+			if err := w.Write(&packet.SubmitAck{ID: id, Result: result, Flags: packet.SubmitAckDuplicate}); err != nil {
+				log.Warn("write duplicate submit ack error", "err", err)
+			}
+		})
+		if entry == nil {
+			return
+		}
+		dw := &dedupWriter{ResponseWriter: w, cache: cache, entry: entry, id: id}
+		defer func() {
+			if err := recover(); err != nil {
+				dw.finish(packet.ResultError)
+				panic(err)
+			}
+		}()
+		next.ServePacket(dw, r)
+	}
+}
+
+// dedupWriter 在 Handler 回复 SubmitAck 时记录处理结果，Handler 可以在返回后异步回复
+type dedupWriter struct {
+	server.ResponseWriter
+	cache *dedup.Cache
+	entry *dedup.Entry
+	id    string
+	once  sync.Once
+}
+
+func (w *dedupWriter) Write(p packet.Packet) error {
+	err := w.ResponseWriter.Write(p)
+	// 先写出原消息的响应，再回复处理期间收到的重复消息
+	if ack, ok := p.(*packet.SubmitAck); ok && ack.ID == w.id {
+		w.finish(ack.Result)
+	}
+	return err
+}
+
+func (w *dedupWriter) finish(result uint8) {
+	w.once.Do(func() {
+		if result == packet.ResultError {
+			w.cache.Abort(w.entry, result)
+			return
+		}
+		w.cache.Complete(w.entry, result)
+	})
+}
+
+// errorAck 返回请求对应的错误响应，请求不需要响应时返回 nil
+func errorAck(p packet.Packet, result uint8) packet.Packet {
+	switch p := p.(type) {
+	case *packet.Submit:
+		return &packet.SubmitAck{ID: p.ID, Result: result}
+	case *packet.Conn:
+		return &packet.ConnAck{Result: result}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package interceptor
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/dedup"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+)
+
+// recorder 记录写入的 packet
+type recorder struct {
+	written []packet.Packet
+}
+
+func (w *recorder) Write(p packet.Packet) error {
+	w.written = append(w.written, p)
+	return nil
+}
+
+func submitRequest(clientID string) *server.Request {
+	return &server.Request{Packet: &packet.Submit{ID: "00000001", Payload: []byte("hello")}, ClientID: clientID}
+}
+
+// result 返回唯一写入的 SubmitAck 的 Result
+func result(t *testing.T, w *recorder) uint8 {
+	if len(w.written) != 1 {
+		t.Fatalf("want 1 packet,actual %d", len(w.written))
+	}
+	ack, ok := w.written[0].(*packet.SubmitAck)
+	if !ok {
+		t.Fatalf("want *packet.SubmitAck,actual %T", w.written[0])
+	}
+	return ack.Result
+}
+
+var okHandler = server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+	if s, ok := r.Packet.(*packet.Submit); ok {
+		w.Write(&packet.SubmitAck{ID: s.ID, Result: packet.ResultOK})
+	}
+})
+
+// captureLogs 把默认 Logger 替换为写入 buf 的 debug 级别 Logger，测试结束后恢复
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestRecovery(t *testing.T) {
+	logs := captureLogs(t)
+	before := testutil.ToFloat64(metrics.HandlerPanicTotal)
+	h := server.Chain(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		panic("boom")
+	}), Recovery())
+
+	w := &recorder{}
+	h.ServePacket(w, submitRequest(""))
+	if r := result(t, w); r != packet.ResultError {
+		t.Errorf("want %d,actual %d", packet.ResultError, r)
+	}
+	if !strings.Contains(logs.String(), "panic=boom") {
+		t.Errorf("want panic log,actual %s", logs)
+	}
+	if v := testutil.ToFloat64(metrics.HandlerPanicTotal); v != before+1 {
+		t.Errorf("want %v,actual %v", before+1, v)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	h := server.Chain(okHandler, Auth(RequireClientID))
+	tests := []struct {
+		clientID string
+		want     uint8
+	}{
+		{"", packet.ResultUnauthorized},
+		{"client-1", packet.ResultOK},
+	}
+	for _, tt := range tests {
+		w := &recorder{}
+		h.ServePacket(w, submitRequest(tt.clientID))
+		if r := result(t, w); r != tt.want {
+			t.Errorf("client %q: want %d,actual %d", tt.clientID, tt.want, r)
+		}
+	}
+
+	// 没有客户端标识的 Conn 包收到未认证的 ConnAck
+	w := &recorder{}
+	h.ServePacket(w, &server.Request{Packet: &packet.Conn{}})
+	if len(w.written) != 1 {
+		t.Fatalf("want 1 packet,actual %d", len(w.written))
+	}
+	if ack, ok := w.written[0].(*packet.ConnAck); !ok || ack.Result != packet.ResultUnauthorized {
+		t.Errorf("want unauthorized conn ack,actual %v", w.written[0])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	before := testutil.ToFloat64(metrics.HandlerTimeoutTotal)
+	h := server.Chain(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Errorf("want deadline,actual none")
+		}
+		<-r.Context().Done()
+	}), Timeout(10*time.Millisecond))
+	h.ServePacket(&recorder{}, submitRequest(""))
+	if v := testutil.ToFloat64(metrics.HandlerTimeoutTotal); v != before+1 {
+		t.Errorf("want %v,actual %v", before+1, v)
+	}
+}
+
+func TestLoggingAndMetrics(t *testing.T) {
+	logs := captureLogs(t)
+	h := server.Chain(okHandler, Logging(), Metrics())
+	h.ServePacket(&recorder{}, submitRequest("client-1"))
+
+	if !strings.Contains(logs.String(), "packet=submit id=00000001") {
+		t.Errorf("want submit log,actual %s", logs)
+	}
+	if n := testutil.CollectAndCount(metrics.HandlerDurationSeconds); n < 1 {
+		t.Errorf("want at least 1,actual %d", n)
+	}
+}
+
+// acks 返回写入的所有 SubmitAck
+func acks(t *testing.T, w *recorder) []*packet.SubmitAck {
+	var acks []*packet.SubmitAck
+	for _, p := range w.written {
+		ack, ok := p.(*packet.SubmitAck)
+		if !ok {
+			t.Fatalf("want *packet.SubmitAck,actual %T", p)
+		}
+		acks = append(acks, ack)
+	}
+	return acks
+}
+
+func TestDedup(t *testing.T) {
+	before := testutil.ToFloat64(metrics.SubmitDuplicateTotal)
+	handled := 0
+	results := []uint8{packet.ResultError, packet.ResultOK}
+	h := server.Chain(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		s := r.Packet.(*packet.Submit)
+		w.Write(&packet.SubmitAck{ID: s.ID, Result: results[handled]})
+		handled++
+	}), Dedup(dedup.New(dedup.Options{Size: 10, TTL: time.Minute})))
+
+	// 第一次处理失败，重发的消息被再次处理；成功后重发的消息不再处理
+	w := &recorder{}
+	for i := 0; i < 3; i++ {
+		h.ServePacket(w, submitRequest("client-1"))
+	}
+	if handled != 2 {
+		t.Errorf("want 2,actual %d", handled)
+	}
+	got := acks(t, w)
+	if len(got) != 3 || got[0].Result != packet.ResultError || got[1].Flags != 0 {
+		t.Fatalf("want error ack then ok ack,actual %+v", got)
+	}
+	if got[2].Result != packet.ResultOK || got[2].Flags != packet.SubmitAckDuplicate {
+		t.Errorf("want duplicate ok ack,actual %+v", got[2])
+	}
+	if v := testutil.ToFloat64(metrics.SubmitDuplicateTotal); v != before+1 {
+		t.Errorf("want %v,actual %v", before+1, v)
+	}
+}
+
+func TestDedup_Pending(t *testing.T) {
+	// Handler 返回后才回复，期间收到的重复消息在原消息回复后回复
+	var pending func()
+	h := server.Chain(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		id := r.Packet.(*packet.Submit).ID
+		pending = func() { w.Write(&packet.SubmitAck{ID: id, Result: packet.ResultOK}) }
+	}), Dedup(dedup.New(dedup.Options{Size: 10, TTL: time.Minute})))
+
+	w := &recorder{}
+	h.ServePacket(w, submitRequest("client-1"))
+	first := pending
+	h.ServePacket(w, submitRequest("client-1"))
+	if len(w.written) != 0 {
+		t.Fatalf("want no ack before the first completes,actual %d", len(w.written))
+	}
+	first()
+	got := acks(t, w)
+	if len(got) != 2 || got[0].Flags != 0 || got[1].Flags != packet.SubmitAckDuplicate {
+		t.Errorf("want original ack then duplicate ack,actual %+v", got)
+	}
+
+	// 没有客户端标识的请求不去重
+	w = &recorder{}
+	h.ServePacket(w, submitRequest(""))
+	pending()
+	h.ServePacket(w, submitRequest(""))
+	pending()
+	if got := acks(t, w); len(got) != 2 || got[1].Flags != 0 {
+		t.Errorf("want 2 original acks,actual %+v", got)
+	}
+}
+
+func TestDedup_Panic(t *testing.T) {
+	captureLogs(t)
+	panics := true
+	h := server.Chain(server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		if panics {
+			panics = false
+			panic("boom")
+		}
+		okHandler(w, r)
+	}), Recovery(), Dedup(dedup.New(dedup.Options{Size: 10, TTL: time.Minute})))
+
+	// panic 的消息不记录，重发后再次处理
+	w := &recorder{}
+	h.ServePacket(w, submitRequest("client-1"))
+	h.ServePacket(w, submitRequest("client-1"))
+	got := acks(t, w)
+	if len(got) != 2 || got[0].Result != packet.ResultError || got[1].Result != packet.ResultOK || got[1].Flags != 0 {
+		t.Errorf("want error ack then ok ack,actual %+v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logging 包根据配置创建 server 和 client 命令使用的 slog.Logger
+/*
+级别
+	debug、info、warn、error
+格式
+	text：key=value 形式；json：每行一个 JSON 对象
+采样
+	Debug 级别的日志按消息采样：每个消息在每秒内先输出 SampleFirst 条，
+	之后每 SampleThereafter 条输出一条，热点路径上的 debug 日志因此可以在生产环境中保持开启。
+	Info 及以上级别的日志不采样
+*/
+
+// Options 日志配置
+type Options struct {
+	Level            string // debug、info、warn 或 error，为空时为 info
+	Format           string // text 或 json，为空时为 text
+	SampleFirst      int    // 每个 debug 消息每秒先输出的条数，0 表示不采样
+	SampleThereafter int    // 超过 SampleFirst 后每多少条输出一条，0 表示超过后不再输出
+
+	// LevelVar 不为 nil 时由它控制日志级别，New 把它设置为 Level，之后可以在运行时调整
+	LevelVar *slog.LevelVar
+}
+
+// ParseLevel 解析日志级别
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+	}
+}
+
+// New 创建写入 w 的 Logger
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	ho := &slog.HandlerOptions{Level: level}
+	if opts.LevelVar != nil {
+		opts.LevelVar.Set(level)
+		ho.Level = opts.LevelVar
+	}
+	var h slog.Handler
+	switch opts.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, ho)
+	case "json":
+		h = slog.NewJSONHandler(w, ho)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", opts.Format)
+	}
+	// 有 LevelVar 时级别可能在运行时调到 debug，同样需要采样
+	if opts.SampleFirst > 0 && (level <= slog.LevelDebug || opts.LevelVar != nil) {
+		h = NewSamplingHandler(h, opts.SampleFirst, opts.SampleThereafter)
+	}
+	return slog.New(h), nil
+}
+
+// samplingHandler 对 Debug 级别的日志按消息采样，WithAttrs/WithGroup 派生的 Handler 共用计数
+type samplingHandler struct {
+	slog.Handler
+	sampler *sampler
+}
+
+// NewSamplingHandler 包装 h，每个 debug 消息每秒先输出 first 条，之后每 thereafter 条输出一条
+func NewSamplingHandler(h slog.Handler, first, thereafter int) slog.Handler {
+	return &samplingHandler{
+		Handler: h,
+		sampler: &sampler{first: uint64(first), thereafter: uint64(thereafter), counts: make(map[string]*count)},
+	}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelInfo && !h.sampler.allow(r.Message, r.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+type sampler struct {
+	first      uint64
+	thereafter uint64
+
+	mu     sync.Mutex
+	counts map[string]*count
+}
+
+// count 一个消息在当前一秒内的条数
+type count struct {
+	second int64
+	n      uint64
+}
+
+func (s *sampler) allow(msg string, t time.Time) bool {
+	second := t.Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counts[msg]
+	if !ok {
+		c = &count{}
+		s.counts[msg] = c
+	}
+	if c.second != second {
+		c.second, c.n = second, 0
+	}
+	c.n++
+	if c.n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (c.n-s.first)%s.thereafter == 0
+}
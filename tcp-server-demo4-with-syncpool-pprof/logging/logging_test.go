@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want slog.Level
+		ok   bool
+	}{
+		{"", slog.LevelInfo, true},
+		{"debug", slog.LevelDebug, true},
+		{"WARN", slog.LevelWarn, true},
+		{"error", slog.LevelError, true},
+		{"trace", 0, false},
+	}
+	for _, tt := range tests {
+		l, err := ParseLevel(tt.in)
+		if (err == nil) != tt.ok || l != tt.want {
+			t.Errorf("want %s(ok=%v),actual %s(%v)", tt.want, tt.ok, l, err)
+		}
+	}
+}
+
+func TestNew_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "info", Format: "json"})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	logger.With("conn_id", 7).Info("conn closed", "remote", "127.0.0.1:1234")
+	logger.Debug("dropped") // 低于 info，不输出
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if line["msg"] != "conn closed" || line["conn_id"] != float64(7) || line["remote"] != "127.0.0.1:1234" {
+		t.Errorf("want conn closed with conn_id and remote,actual %s", buf.String())
+	}
+}
+
+func TestNew_UnknownFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, Options{Format: "xml"}); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSamplingHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), 2, 3)
+	// 派生的 Handler 与原 Handler 共用计数
+	handlers := []slog.Handler{h, h.WithAttrs([]slog.Attr{slog.Int("conn_id", 1)})}
+
+	now := time.Now()
+	record := func(level slog.Level, msg string, at time.Time) {
+		for _, h := range handlers {
+			if err := h.Handle(context.Background(), slog.NewRecord(at, level, msg, 0)); err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+		}
+	}
+	// 同一秒内 10 条：前 2 条输出，之后第 5、8 条输出
+	for i := 0; i < 5; i++ {
+		record(slog.LevelDebug, "packet received", now)
+	}
+	// 另一个消息单独计数
+	record(slog.LevelDebug, "other", now)
+	// info 不采样
+	for i := 0; i < 5; i++ {
+		record(slog.LevelInfo, "conn closed", now)
+	}
+	// 下一秒重新计数
+	record(slog.LevelDebug, "packet received", now.Add(time.Second))
+
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r struct{ Msg string }
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		counts[r.Msg]++
+	}
+	want := map[string]int{"packet received": 4 + 2, "other": 2, "conn closed": 10}
+	for msg, n := range want {
+		if counts[msg] != n {
+			t.Errorf("want %d lines of %q,actual %d", n, msg, counts[msg])
+		}
+	}
+}
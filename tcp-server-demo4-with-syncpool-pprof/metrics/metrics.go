@@ -1,18 +1,53 @@
 package metrics
 
 import (
-	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 )
 
-const metricsHTTPPort = 8889 //for prometheus to connect
+const DefaultAddr = ":8889" //for prometheus to connect
 
 var (
 	ClientConnected prometheus.Gauge   // 当前已连接的客户端数量，对一个数值的即时测量值，反映一个值的瞬时快照
 	ReqRecvTotal    prometheus.Counter // 每秒接收消息请求的数量
 	RspSendTotal    prometheus.Counter // 每秒发送消息响应的数量
+
+	HandshakeTimeoutTotal prometheus.Counter // 建立连接后未按时收到第一个 frame 而关闭的连接数
+	IdleTimeoutTotal      prometheus.Counter // 空闲超时关闭的连接数
+	FrameTimeoutTotal     prometheus.Counter // 未按时读完一个 frame 而关闭的连接数
+	WriteTimeoutTotal     prometheus.Counter // 写超时(客户端不读取响应)关闭的连接数
+
+	ConnRejectedTotal *prometheus.CounterVec // 被准入控制拒绝的连接数，reason 为拒绝原因
+	AcceptErrorTotal  prometheus.Counter     // Accept 返回临时错误的次数
+
+	SubmitThrottledTotal *prometheus.CounterVec // 超过限流速率的 Submit 数，action 为 throttle(回复限流)或 pause(暂停读取)
+
+	WorkerQueueWaitSeconds prometheus.Histogram // 请求在 worker 队列中等待的时间
+	WorkerQueueLength      prometheus.Gauge     // 所有 worker 队列中等待处理的请求数
+	WorkerBusy             prometheus.Gauge     // 正在执行 Handler 的 worker 数
+	WorkerSaturatedTotal   prometheus.Counter   // 因 worker 队列已满而阻塞读取的次数
+
+	TLSHandshakeErrorTotal prometheus.Counter // TLS 握手失败(含超时、客户端证书校验失败)的连接数
+	ProxyHeaderErrorTotal  prometheus.Counter // 可信上游的连接读取 PROXY protocol 头失败(含超时、缺少头、格式错误)的次数
+
+	ListenerAcceptedTotal *prometheus.CounterVec // 每个 listener 通过准入控制的连接数，listener 为带协议前缀的监听地址，shard 为 SO_REUSEPORT 分片编号
+	ListenerConnections   *prometheus.GaugeVec   // 每个 listener 当前保持的连接数(不含 stream)，标签同上
+
+	HandlerDurationSeconds *prometheus.HistogramVec // Handler 的处理耗时，packet 为 packet 类型
+	HandlerPanicTotal      prometheus.Counter       // Handler panic 的次数
+	HandlerTimeoutTotal    prometheus.Counter       // Handler 超过截止时间才返回的次数
+	AuthRejectedTotal      prometheus.Counter       // 未通过认证的请求数
+	SubmitDuplicateTotal   prometheus.Counter       // 去重窗口内重复收到、没有再次处理的 Submit 数
+
+	WALSyncSeconds prometheus.Histogram // 预写日志一次 fsync 的耗时
+	WALSyncRecords prometheus.Histogram // 预写日志一次 fsync 提交的记录数(group commit 的批大小)
+
+	InflightBytes     prometheus.Gauge       // 内存预算统计的在途字节数：未处理完的请求、出站队列中的响应和连接的读写缓存
+	InflightMessages  prometheus.Gauge       // 内存预算统计的在途消息数：未处理完的请求和出站队列中的响应
+	Overloaded        prometheus.Gauge       // 是否处于过载状态，1 为过载
+	OverloadTotal     prometheus.Counter     // 进入过载状态的次数
+	OverloadShedTotal *prometheus.CounterVec // 过载时被削减的负载，action 为 pause(暂停读取)或 reject(回复过载)
 )
 
 func init() {
@@ -28,21 +63,139 @@ func init() {
 		Name: "tcp_server_demo2_client_connected",
 	})
 
-	prometheus.MustRegister(ReqRecvTotal, RspSendTotal, ClientConnected)
+	HandshakeTimeoutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_handshake_timeout_total",
+	})
 
-	// start the metrics server
-	metricsServer := &http.Server{
-		Addr: fmt.Sprintf(":%d", metricsHTTPPort),
-	}
+	IdleTimeoutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_idle_timeout_total",
+	})
+
+	FrameTimeoutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_frame_timeout_total",
+	})
 
+	WriteTimeoutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_write_timeout_total",
+	})
+
+	ConnRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_conn_rejected_total",
+	}, []string{"reason"})
+
+	AcceptErrorTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_accept_error_total",
+	})
+
+	SubmitThrottledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_submit_throttled_total",
+	}, []string{"action"})
+
+	WorkerQueueWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_server_demo2_worker_queue_wait_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8), // 100us ~ 1.6s
+	})
+
+	WorkerQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_worker_queue_length",
+	})
+
+	WorkerBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_worker_busy",
+	})
+
+	WorkerSaturatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_worker_saturated_total",
+	})
+
+	TLSHandshakeErrorTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_tls_handshake_error_total",
+	})
+	ProxyHeaderErrorTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_proxy_header_error_total",
+	})
+
+	ListenerAcceptedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_listener_accepted_total",
+	}, []string{"listener", "shard"})
+
+	ListenerConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_listener_connections",
+	}, []string{"listener", "shard"})
+
+	HandlerDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tcp_server_demo2_handler_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 9), // 10us ~ 0.65s
+	}, []string{"packet"})
+
+	HandlerPanicTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_handler_panic_total",
+	})
+
+	HandlerTimeoutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_handler_timeout_total",
+	})
+
+	AuthRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_auth_rejected_total",
+	})
+
+	SubmitDuplicateTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_submit_duplicate_total",
+	})
+
+	WALSyncSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_server_demo2_wal_sync_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 4, 8), // 50us ~ 0.8s
+	})
+
+	WALSyncRecords = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_server_demo2_wal_sync_records",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8), // 1 ~ 16384
+	})
+
+	InflightBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_inflight_bytes",
+	})
+
+	InflightMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_inflight_messages",
+	})
+
+	Overloaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_server_demo2_overloaded",
+	})
+
+	OverloadTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_overload_total",
+	})
+
+	OverloadShedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_server_demo2_overload_shed_total",
+	}, []string{"action"})
+
+	prometheus.MustRegister(ReqRecvTotal, RspSendTotal, ClientConnected)
+	prometheus.MustRegister(HandshakeTimeoutTotal, IdleTimeoutTotal, FrameTimeoutTotal, WriteTimeoutTotal)
+	prometheus.MustRegister(ConnRejectedTotal, AcceptErrorTotal)
+	prometheus.MustRegister(SubmitThrottledTotal)
+	prometheus.MustRegister(WorkerQueueWaitSeconds, WorkerQueueLength, WorkerBusy, WorkerSaturatedTotal)
+	prometheus.MustRegister(TLSHandshakeErrorTotal, ProxyHeaderErrorTotal)
+	prometheus.MustRegister(ListenerAcceptedTotal, ListenerConnections)
+	prometheus.MustRegister(HandlerDurationSeconds, HandlerPanicTotal, HandlerTimeoutTotal, AuthRejectedTotal, SubmitDuplicateTotal)
+	prometheus.MustRegister(WALSyncSeconds, WALSyncRecords)
+	prometheus.MustRegister(InflightBytes, InflightMessages, Overloaded, OverloadTotal, OverloadShedTotal)
+}
+
+// NewServer 创建 metrics http server，由调用方负责启动(ListenAndServe)和关闭(Shutdown)。
+// admin 不为 nil 时挂载在 /admin/ 下
+func NewServer(addr string, admin http.Handler) *http.Server {
 	mu := http.NewServeMux()
 	mu.Handle("/metrics", promhttp.Handler())
-	metricsServer.Handler = mu
-	go func() {
-		err := metricsServer.ListenAndServe()
-		if err != nil {
-			fmt.Println("prometheus-exporter http server start failed", err)
-		}
-	}()
-	fmt.Printf("metrics server start ok(*:%d) \n", metricsHTTPPort)
+	if admin != nil {
+		mu.Handle("/admin/", admin)
+	}
+	return &http.Server{
+		Addr:    addr,
+		Handler: mu,
+	}
 }
@@ -0,0 +1,339 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (client *Session, server *Session) {
+	c1, c2 := net.Pipe()
+	client = Client(c1, nil)
+	server = Server(c2, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStream_Echo(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.Open()
+			if err != nil {
+				t.Errorf("want nil,actual %s", err.Error())
+				return
+			}
+			msg := []byte(fmt.Sprintf("hello stream %d", i))
+			if _, err := s.Write(msg); err != nil {
+				t.Errorf("want nil,actual %s", err.Error())
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, buf); err != nil {
+				t.Errorf("want nil,actual %s", err.Error())
+				return
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Errorf("want %s,actual %s", msg, buf)
+			}
+			s.Close()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStream_HalfClose(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	s, err := client.Open()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	s.Write([]byte("hello"))
+	s.Close()
+
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	data, err := io.ReadAll(ss)
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if string(data) != "hello" {
+		t.Errorf("want hello,actual %s", data)
+	}
+
+	// 对端半关闭后本端仍然可以发送数据
+	if _, err := ss.Write([]byte("bye")); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	ss.Close()
+
+	if _, err := s.Read(buf); err != io.EOF {
+		t.Errorf("want EOF,actual %v", err)
+	}
+	if _, err := s.Write(buf); err != ErrStreamClosed {
+		t.Errorf("want ErrStreamClosed,actual %v", err)
+	}
+}
+
+func TestStream_FlowControl(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	slow, _ := client.Open()
+	fast, _ := client.Open()
+	slowPeer, _ := server.AcceptStream()
+	fastPeer, _ := server.AcceptStream()
+
+	// slow 流写满对端接收窗口后阻塞，对端不读取
+	done := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(make([]byte, initialStreamWindow+1024))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("want blocked write,actual %v", err)
+	default:
+	}
+
+	// slow 流被阻塞时 fast 流不受影响
+	go fast.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	fastPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(fastPeer, buf); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+
+	// 对端读取后归还窗口，slow 流的写操作完成
+	go io.Copy(io.Discard, slowPeer)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("want nil,actual %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("want write done,actual blocked")
+	}
+}
+
+func TestStream_ReadDeadline(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	s, _ := client.Open()
+	s.Write([]byte("x"))
+	ss, _ := server.AcceptStream()
+	io.ReadFull(ss, make([]byte, 1))
+
+	ss.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := ss.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("want ErrDeadlineExceeded,actual %v", err)
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("want timeout net.Error,actual %v", err)
+	}
+}
+
+func TestSession_Close(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	s, _ := client.Open()
+	ss, _ := server.AcceptStream()
+
+	client.Close()
+	<-server.CloseChan()
+
+	if _, err := ss.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want EOF,actual %v", err)
+	}
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+	if _, err := client.Open(); err != ErrSessionShutdown {
+		t.Errorf("want ErrSessionShutdown,actual %v", err)
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestSession_MaxStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.MaxStreams = 2
+	client := Client(c1, nil)
+	server := Server(c2, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	var streams, accepted []*Stream
+	for i := 0; i < 3; i++ {
+		s, err := client.Open()
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		streams = append(streams, s)
+	}
+	for i := 0; i < 2; i++ {
+		ss, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		accepted = append(accepted, ss)
+	}
+
+	// 超过上限的流被 RST
+	streams[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := streams[2].Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("want ErrStreamReset,actual %v", err)
+	}
+	if n := server.NumStreams(); n != 2 {
+		t.Errorf("want 2,actual %d", n)
+	}
+
+	// 双方都关闭一个流后可以打开新的流
+	streams[0].Close()
+	accepted[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for server.NumStreams() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s, err := client.Open()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	s.Write([]byte("x"))
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if _, err := io.ReadFull(ss, make([]byte, 1)); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+}
+
+func TestStream_CloseTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.StreamCloseTimeout = 50 * time.Millisecond
+	client := Client(c1, nil)
+	server := Server(c2, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	s, err := client.Open()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	s.Write([]byte("x"))
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+
+	// 服务端关闭后客户端一直不关闭，超时后服务端重置流并释放名额
+	ss.Close()
+	deadline := time.Now().Add(time.Second)
+	for server.NumStreams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Errorf("want 0,actual %d", n)
+	}
+	// 客户端收到 RST 后同样释放流
+	for client.NumStreams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("want 0,actual %d", n)
+	}
+}
+
+func TestSession_InvalidStreamID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := Server(c2, nil)
+	t.Cleanup(func() {
+		c1.Close()
+		server.Close()
+	})
+
+	hdr := make([]byte, headerSize)
+	send := func(flags uint16, id uint32) {
+		hdr[0], hdr[1] = Magic, typeWindowUpdate
+		binary.BigEndian.PutUint16(hdr[2:4], flags)
+		binary.BigEndian.PutUint32(hdr[4:8], id)
+		binary.BigEndian.PutUint32(hdr[8:12], 0)
+		if _, err := c1.Write(hdr); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+	}
+	expect := func(flags uint16, id uint32) {
+		c1.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c1, hdr); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		if f, i := binary.BigEndian.Uint16(hdr[2:4]), binary.BigEndian.Uint32(hdr[4:8]); f != flags || i != id {
+			t.Errorf("want flags %d id %d,actual flags %d id %d", flags, id, f, i)
+		}
+	}
+
+	// 客户端只能打开奇数 ID 的流
+	send(flagSYN, 2)
+	expect(flagRST, 2)
+	send(flagSYN, 3)
+	expect(flagACK, 3)
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	// ID 必须递增，重复打开正在使用的流时该流被重置
+	send(flagSYN, 1)
+	expect(flagRST, 1)
+	send(flagSYN, 3)
+	expect(flagRST, 3)
+	if _, err := ss.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("want ErrStreamReset,actual %v", err)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Errorf("want 0,actual %d", n)
+	}
+}
@@ -0,0 +1,399 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mux 包的职责是在一条 TCP 连接上复用多个相互独立的逻辑流(stream)，设计思路参考 yamux
+/*
+Mux frame 定义
+muxHeader + body
+muxHeader(12 bytes)
+	1 byte: magic，固定为 Magic(0x4d)，服务端据此识别复用连接
+	1 byte: type，帧类型(Data/WindowUpdate/GoAway)
+	2 bytes: flags(SYN/ACK/FIN/RST)
+	4 bytes: streamID，客户端发起的流为奇数，服务端发起的流为偶数，各自严格递增，不符合的新流会被 RST
+	4 bytes: length，Data 帧为 body 长度；WindowUpdate 帧为窗口增量；GoAway 帧为原因码
+body
+	Data 帧的数据，即 stream 上承载的字节流(frame 包)
+*/
+
+// Magic 复用连接的首字节。普通 frame 的首字节是 totalLen 的最高字节，
+// 只有 frame 长度超过 1GB 时才会与之冲突，因此可以安全地用它区分两种连接
+const Magic byte = 0x4d
+
+const headerSize = 12
+
+// 帧类型
+const (
+	typeData         uint8 = iota // 0x00，数据帧
+	typeWindowUpdate              // 0x01，窗口更新帧，同时用于打开流
+	typeGoAway                    // 0x02，会话关闭通知
+)
+
+// 帧标志位
+const (
+	flagSYN uint16 = 1 << iota // 打开新流
+	flagACK                    // 确认新流
+	flagFIN                    // 半关闭，本端不再发送数据
+	flagRST                    // 重置流
+)
+
+// 每个流初始的收发窗口大小
+const initialStreamWindow uint32 = 256 * 1024
+
+// DefaultMaxStreams 每个会话默认同时打开的流数量上限
+const DefaultMaxStreams = 1024
+
+// Close 时发送 GoAway 的最长等待时间
+const closeTimeout = time.Second
+
+var (
+	ErrSessionShutdown    = errors.New("mux: session shutdown")
+	ErrRemoteGoAway       = errors.New("mux: remote end is not accepting streams")
+	ErrStreamsExhausted   = errors.New("mux: streams exhausted")
+	ErrStreamClosed       = errors.New("mux: stream closed")
+	ErrStreamReset        = errors.New("mux: stream reset")
+	ErrInvalidMagic       = errors.New("mux: invalid magic")
+	ErrRecvWindowExceeded = errors.New("mux: recv window exceeded")
+)
+
+// Config 会话参数
+type Config struct {
+	AcceptBacklog   int    // 等待 Accept 的新流数量上限，超过后新流会被 RST
+	MaxStreams      int    // 会话上同时打开的流数量上限，达到后对端新打开的流会被 RST，0 表示不限制
+	MaxStreamWindow uint32 // 每个流的接收窗口大小，即对端在未收到窗口更新前最多可发送的字节数，不小于 256KB
+	// 本端关闭流后等待对端也关闭的最长时间，超时后发送 RST 并释放流，避免对端不关闭时流一直占用 MaxStreams 的名额；
+	// 0 表示一直等待
+	StreamCloseTimeout time.Duration
+}
+
+// DefaultConfig 返回默认的会话参数
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:      256,
+		MaxStreams:         DefaultMaxStreams,
+		MaxStreamWindow:    initialStreamWindow,
+		StreamCloseTimeout: 30 * time.Second,
+	}
+}
+
+// Session 一条底层连接上的复用会话，实现了 net.Listener 接口，Accept 返回的每个 stream 都是一个逻辑连接
+type Session struct {
+	conn    net.Conn
+	bufRead *bufio.Reader
+	config  *Config
+
+	openLock     sync.Mutex // 保证 SYN 按流 ID 递增的顺序发出
+	nextStreamID uint32     // 下一个由本端发起的流 ID
+
+	streamLock   sync.Mutex
+	streams      map[uint32]*Stream
+	lastRemoteID uint32 // 对端打开的最大流 ID，新流的 ID 必须比它大
+
+	acceptCh chan *Stream
+
+	writeLock sync.Mutex // 保证每个 mux frame 整体写入底层连接
+	hdrBuf    [headerSize]byte
+
+	remoteGoAway int32 // 对端已发送 GoAway，不能再打开新流
+
+	shutdown     bool
+	shutdownErr  error
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+}
+
+// Client 在客户端连接上创建会话，由客户端调用 Open 打开流
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, true)
+}
+
+// Server 在服务端连接上创建会话，由服务端调用 Accept 接收流
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, false)
+}
+
+func newSession(conn net.Conn, config *Config, client bool) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if config.MaxStreamWindow < initialStreamWindow {
+		config.MaxStreamWindow = initialStreamWindow
+	}
+	s := &Session{
+		conn:       conn,
+		bufRead:    bufio.NewReader(conn),
+		config:     config,
+		streams:    make(map[uint32]*Stream),
+		acceptCh:   make(chan *Stream, config.AcceptBacklog),
+		shutdownCh: make(chan struct{}),
+	}
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open 打开一个新的流
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionShutdown
+	}
+	if atomic.LoadInt32(&s.remoteGoAway) == 1 {
+		return nil, ErrRemoteGoAway
+	}
+
+	// 对端要求流 ID 严格递增，分配 ID 和发送 SYN 之间不能被其他 Open 插入
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	s.streamLock.Lock()
+	id := s.nextStreamID
+	if id >= id+2 {
+		s.streamLock.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextStreamID += 2
+	stream := newStream(s, id, streamSYNSent)
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	// 通过带 SYN 标志的窗口更新帧通知对端打开流，同时把接收窗口从初始值扩大到 MaxStreamWindow
+	if err := s.writeFrame(typeWindowUpdate, flagSYN, id, s.config.MaxStreamWindow-initialStreamWindow, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream 阻塞等待对端打开的新流
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.shutdownCh:
+		return nil, s.shutdownErr
+	}
+}
+
+// Accept 实现 net.Listener 接口
+func (s *Session) Accept() (net.Conn, error) {
+	stream, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Addr 实现 net.Listener 接口
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// LocalAddr 底层连接的本地地址
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr 底层连接的对端地址
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// NumStreams 当前打开的流数量
+func (s *Session) NumStreams() int {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed 会话是否已关闭
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan 会话关闭时该 channel 被关闭
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// Close 通知对端后关闭会话及其上所有的流
+func (s *Session) Close() error {
+	// 对端不再读取时 GoAway 可能写不出去，设置写超时避免 Close 永久阻塞
+	s.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	s.writeFrame(typeGoAway, 0, 0, 0, nil)
+	return s.exitErr(ErrSessionShutdown)
+}
+
+func (s *Session) exitErr(err error) error {
+	s.shutdownLock.Lock()
+	if s.shutdown {
+		s.shutdownLock.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	s.shutdownErr = err
+	close(s.shutdownCh)
+	s.shutdownLock.Unlock()
+
+	closeErr := s.conn.Close()
+
+	s.streamLock.Lock()
+	for id, stream := range s.streams {
+		stream.forceClose()
+		delete(s.streams, id)
+	}
+	s.streamLock.Unlock()
+	return closeErr
+}
+
+// writeFrame 编码 mux header 并与 body 一起写入底层连接
+func (s *Session) writeFrame(t uint8, flags uint16, id uint32, length uint32, body []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return ErrSessionShutdown
+	}
+
+	hdr := s.hdrBuf[:]
+	hdr[0] = Magic
+	hdr[1] = t
+	binary.BigEndian.PutUint16(hdr[2:4], flags)
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	binary.BigEndian.PutUint32(hdr[8:12], length)
+
+	// 使用 net.Buffers 合并 header 与 body，TCP 连接上只需一次 writev 系统调用
+	bufs := net.Buffers{hdr, body}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		go s.exitErr(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop 持续从底层连接读取 mux frame，并分发给对应的流
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.bufRead, hdr[:]); err != nil {
+			s.exitErr(err)
+			return
+		}
+		if hdr[0] != Magic {
+			s.exitErr(ErrInvalidMagic)
+			return
+		}
+
+		t := hdr[1]
+		flags := binary.BigEndian.Uint16(hdr[2:4])
+		id := binary.BigEndian.Uint32(hdr[4:8])
+		length := binary.BigEndian.Uint32(hdr[8:12])
+
+		var err error
+		switch t {
+		case typeData, typeWindowUpdate:
+			err = s.handleStreamMessage(t, flags, id, length)
+		case typeGoAway:
+			atomic.StoreInt32(&s.remoteGoAway, 1)
+		default:
+			err = fmt.Errorf("mux: unknown frame type [%d]", t)
+		}
+		if err != nil {
+			s.exitErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleStreamMessage(t uint8, flags uint16, id uint32, length uint32) error {
+	if flags&flagSYN == flagSYN {
+		s.incomingStream(id)
+	}
+
+	s.streamLock.Lock()
+	stream := s.streams[id]
+	s.streamLock.Unlock()
+
+	if stream == nil {
+		// 流已关闭或被拒绝，丢弃数据帧携带的 body
+		if t == typeData && length > 0 {
+			if _, err := s.bufRead.Discard(int(length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if t == typeWindowUpdate {
+		stream.incrSendWindow(flags, length)
+		return nil
+	}
+	return stream.readData(flags, length, s.bufRead)
+}
+
+// incomingStream 处理对端打开的新流
+func (s *Session) incomingStream(id uint32) {
+	s.streamLock.Lock()
+	if !s.validRemoteID(id) {
+		// ID 的奇偶性不对或已经用过，按协议错误重置，ID 上仍在使用的流一起关闭
+		stream := s.streams[id]
+		delete(s.streams, id)
+		s.streamLock.Unlock()
+		if stream != nil {
+			stream.reset()
+		}
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return
+	}
+	s.lastRemoteID = id
+	if n := s.config.MaxStreams; n > 0 && len(s.streams) >= n {
+		// 流数量已达上限，拒绝该流，之后到达的数据帧因找不到流而被丢弃
+		s.streamLock.Unlock()
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return
+	}
+	stream := newStream(s, id, streamEstablished)
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+		// 控制帧异步发送，避免 recvLoop 阻塞在写操作上与对端互相等待
+		go s.writeFrame(typeWindowUpdate, flagACK, id, s.config.MaxStreamWindow-initialStreamWindow, nil)
+	default:
+		// Accept 积压已满，拒绝该流
+		s.removeStream(id)
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+	}
+}
+
+// validRemoteID 对端打开的流 ID 是否有效：客户端打开奇数 ID，服务端打开偶数 ID，且严格递增。调用时持有 streamLock
+func (s *Session) validRemoteID(id uint32) bool {
+	// 本端发起的流与对端的奇偶性相反
+	if id == 0 || id%2 == s.nextStreamID%2 {
+		return false
+	}
+	return id > s.lastRemoteID
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.streamLock.Lock()
+	delete(s.streams, id)
+	s.streamLock.Unlock()
+}
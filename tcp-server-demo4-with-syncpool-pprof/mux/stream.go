@@ -0,0 +1,353 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type streamState int
+
+const (
+	streamSYNSent     streamState = iota // 本端已发送 SYN，等待对端 ACK
+	streamEstablished                    // 流已建立
+	streamLocalClose                     // 本端已发送 FIN
+	streamRemoteClose                    // 对端已发送 FIN
+	streamClosed                         // 双方均已发送 FIN
+	streamReset                          // 流被重置
+)
+
+// Stream 复用会话上的一个逻辑流，实现了 net.Conn 接口
+type Stream struct {
+	id      uint32
+	session *Session
+
+	sendWindow uint32 // 对端剩余的接收窗口，为 0 时写操作阻塞
+
+	stateLock sync.Mutex
+	state     streamState
+	recvBuf   bytes.Buffer
+	consumed  uint32 // 应用层已读出、尚未通过窗口更新归还给对端的字节数
+
+	writeLock sync.Mutex // 保证同一个流上的写操作串行，窗口计算不会交错
+
+	recvNotifyCh chan struct{}
+	sendNotifyCh chan struct{}
+
+	closeTimer *time.Timer // 本端关闭后等待对端关闭的定时器，由 stateLock 保护
+
+	readDeadline  atomic.Value // time.Time
+	writeDeadline atomic.Value // time.Time
+}
+
+func newStream(session *Session, id uint32, state streamState) *Stream {
+	s := &Stream{
+		id:           id,
+		session:      session,
+		state:        state,
+		sendWindow:   initialStreamWindow,
+		recvNotifyCh: make(chan struct{}, 1),
+		sendNotifyCh: make(chan struct{}, 1),
+	}
+	s.readDeadline.Store(time.Time{})
+	s.writeDeadline.Store(time.Time{})
+	return s
+}
+
+// StreamID 流 ID
+func (s *Stream) StreamID() uint32 {
+	return s.id
+}
+
+// Session 流所属的会话
+func (s *Stream) Session() *Session {
+	return s.session
+}
+
+// Read 实现 net.Conn 接口，从流的接收缓存中读取数据
+func (s *Stream) Read(b []byte) (n int, err error) {
+	for {
+		s.stateLock.Lock()
+		if s.recvBuf.Len() > 0 {
+			n, _ = s.recvBuf.Read(b)
+			s.consumed += uint32(n)
+			// 已读出的数据超过半个窗口时才归还，减少窗口更新帧的数量
+			update := s.consumed >= s.session.config.MaxStreamWindow/2
+			s.stateLock.Unlock()
+			if update {
+				err = s.sendWindowUpdate()
+			}
+			return n, err
+		}
+		switch s.state {
+		case streamRemoteClose, streamClosed:
+			s.stateLock.Unlock()
+			return 0, io.EOF
+		case streamReset:
+			s.stateLock.Unlock()
+			return 0, ErrStreamReset
+		}
+		s.stateLock.Unlock()
+
+		if err = s.wait(s.recvNotifyCh, s.readDeadline.Load().(time.Time)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 实现 net.Conn 接口，按照对端的接收窗口分段发送数据
+func (s *Stream) Write(b []byte) (n int, err error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	for n < len(b) {
+		s.stateLock.Lock()
+		switch s.state {
+		case streamLocalClose, streamClosed:
+			s.stateLock.Unlock()
+			return n, ErrStreamClosed
+		case streamReset:
+			s.stateLock.Unlock()
+			return n, ErrStreamReset
+		}
+		s.stateLock.Unlock()
+
+		window := atomic.LoadUint32(&s.sendWindow)
+		if window == 0 {
+			// 对端接收窗口耗尽，等待窗口更新
+			if err = s.wait(s.sendNotifyCh, s.writeDeadline.Load().(time.Time)); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		chunk := b[n:]
+		if uint32(len(chunk)) > window {
+			chunk = chunk[:window]
+		}
+		if err = s.session.writeFrame(typeData, 0, s.id, uint32(len(chunk)), chunk); err != nil {
+			return n, err
+		}
+		atomic.AddUint32(&s.sendWindow, ^uint32(len(chunk)-1))
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Close 实现 net.Conn 接口，发送 FIN 半关闭流，对端仍可继续发送数据直到它也关闭
+func (s *Stream) Close() error {
+	s.stateLock.Lock()
+	closed := false
+	switch s.state {
+	case streamSYNSent, streamEstablished:
+		s.state = streamLocalClose
+		if d := s.session.config.StreamCloseTimeout; d > 0 {
+			s.closeTimer = time.AfterFunc(d, s.closeTimeout)
+		}
+	case streamRemoteClose:
+		s.state = streamClosed
+		closed = true
+	default:
+		s.stateLock.Unlock()
+		return nil
+	}
+	s.stateLock.Unlock()
+
+	err := s.session.writeFrame(typeData, flagFIN, s.id, 0, nil)
+	if closed {
+		s.session.removeStream(s.id)
+	}
+	s.notify()
+	return err
+}
+
+// closeTimeout 本端关闭后对端迟迟不关闭，重置流并释放它占用的名额
+func (s *Stream) closeTimeout() {
+	s.stateLock.Lock()
+	if s.state != streamLocalClose {
+		s.stateLock.Unlock()
+		return
+	}
+	s.state = streamReset
+	s.stateLock.Unlock()
+
+	s.session.removeStream(s.id)
+	s.session.writeFrame(typeWindowUpdate, flagRST, s.id, 0, nil)
+	s.notify()
+}
+
+// reset 对端违反协议时重置流，不通知对端
+func (s *Stream) reset() {
+	s.stateLock.Lock()
+	s.state = streamReset
+	s.stopCloseTimerLocked()
+	s.stateLock.Unlock()
+	s.notify()
+}
+
+// stopCloseTimerLocked 流已经关闭，停止等待对端关闭的定时器
+func (s *Stream) stopCloseTimerLocked() {
+	if s.closeTimer != nil {
+		s.closeTimer.Stop()
+		s.closeTimer = nil
+	}
+}
+
+// LocalAddr 实现 net.Conn 接口
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+// RemoteAddr 实现 net.Conn 接口
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+// SetDeadline 实现 net.Conn 接口
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline 实现 net.Conn 接口
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(t)
+	asyncNotify(s.recvNotifyCh)
+	return nil
+}
+
+// SetWriteDeadline 实现 net.Conn 接口
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(t)
+	asyncNotify(s.sendNotifyCh)
+	return nil
+}
+
+// wait 等待通知、超时或会话关闭
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.session.shutdownCh:
+		return ErrSessionShutdown
+	}
+}
+
+// sendWindowUpdate 把应用层已读出的字节数归还给对端
+func (s *Stream) sendWindowUpdate() error {
+	s.stateLock.Lock()
+	delta := s.consumed
+	s.consumed = 0
+	s.stateLock.Unlock()
+	if delta == 0 {
+		return nil
+	}
+	return s.session.writeFrame(typeWindowUpdate, 0, s.id, delta, nil)
+}
+
+// readData 由 recvLoop 调用，把数据帧的 body 读入接收缓存
+func (s *Stream) readData(flags uint16, length uint32, r *bufio.Reader) error {
+	if length > 0 {
+		s.stateLock.Lock()
+		// 缓存中未读的数据加上尚未归还的窗口，不能超过接收窗口
+		if uint32(s.recvBuf.Len())+s.consumed+length > s.session.config.MaxStreamWindow {
+			s.stateLock.Unlock()
+			return ErrRecvWindowExceeded
+		}
+		s.stateLock.Unlock()
+
+		// 在锁外读取网络数据，避免阻塞应用层的 Read
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		s.stateLock.Lock()
+		s.recvBuf.Write(buf)
+		s.stateLock.Unlock()
+	}
+	s.processFlags(flags)
+	s.notify()
+	return nil
+}
+
+// incrSendWindow 由 recvLoop 调用，处理窗口更新帧
+func (s *Stream) incrSendWindow(flags uint16, delta uint32) {
+	s.processFlags(flags)
+	atomic.AddUint32(&s.sendWindow, delta)
+	asyncNotify(s.sendNotifyCh)
+}
+
+// processFlags 根据帧标志位迁移流的状态
+func (s *Stream) processFlags(flags uint16) {
+	closed := false
+	s.stateLock.Lock()
+	if flags&flagACK == flagACK && s.state == streamSYNSent {
+		s.state = streamEstablished
+	}
+	if flags&flagFIN == flagFIN {
+		switch s.state {
+		case streamSYNSent, streamEstablished:
+			s.state = streamRemoteClose
+		case streamLocalClose:
+			s.state = streamClosed
+			closed = true
+		}
+	}
+	if flags&flagRST == flagRST {
+		s.state = streamReset
+		closed = true
+	}
+	if closed {
+		s.stopCloseTimerLocked()
+	}
+	s.stateLock.Unlock()
+
+	if closed {
+		s.session.removeStream(s.id)
+	}
+	if flags&(flagFIN|flagRST) != 0 {
+		s.notify()
+	}
+}
+
+// forceClose 会话关闭时强制关闭流
+func (s *Stream) forceClose() {
+	s.stateLock.Lock()
+	if s.state != streamReset {
+		s.state = streamClosed
+	}
+	s.stopCloseTimerLocked()
+	s.stateLock.Unlock()
+	s.notify()
+}
+
+func (s *Stream) notify() {
+	asyncNotify(s.recvNotifyCh)
+	asyncNotify(s.sendNotifyCh)
+}
+
+// asyncNotify 非阻塞地发送通知，channel 中已有通知时直接丢弃
+func asyncNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
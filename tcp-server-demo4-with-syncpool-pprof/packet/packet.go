@@ -16,12 +16,16 @@ import (
 ### packet body(Submit ack packet)
 8字节 ID 字符串
 1字节 result
+### packet body(Disconnect packet)
+1字节 code
+任意字节 reason
 */
 
 // Packet header，用于表示这个消息的类型
 const (
-	CommandConn   = iota + 0x01 // 0x01，连接请求包
-	CommandSubmit               // 0x02，消息请求包
+	CommandConn       = iota + 0x01 // 0x01，连接请求包
+	CommandSubmit                   // 0x02，消息请求包
+	CommandDisconnect               // 0x03，断开连接通知包，由服务端发给客户端
 )
 
 // commandID: Packet header，用于表示这个消息的类型
@@ -35,32 +39,35 @@ type Packet interface {
 	Encode() ([]byte, error) // struct -> []byte
 }
 
-// Conn 连接请求包
+// Conn 连接请求包(packet body)，客户端建立连接后发送的第一个 packet
 type Conn struct {
+	ClientID string // 客户端标识，服务端按它做限流等
 }
 
-func (c *Conn) Decode(i []byte) error {
-	//TODO
+func (c *Conn) Decode(pktBody []byte) error {
+	c.ClientID = string(pktBody)
 	return nil
 }
 
 func (c *Conn) Encode() ([]byte, error) {
-	//TODO
-	return nil, nil
+	return []byte(c.ClientID), nil
 }
 
-// 连接响应包
-type connAck struct {
+// ConnAck 连接请求的响应包(packet body)，result
+type ConnAck struct {
+	Result uint8 // 响应状态，取值同 SubmitAck.Result
 }
 
-func (c *connAck) Decode(i []byte) error {
-	//TODO
+func (c *ConnAck) Decode(pktBody []byte) error {
+	if len(pktBody) < 1 {
+		return fmt.Errorf("conn ack packet too short")
+	}
+	c.Result = pktBody[0]
 	return nil
 }
 
-func (c *connAck) Encode() ([]byte, error) {
-	//TODO
-	return nil, nil
+func (c *ConnAck) Encode() ([]byte, error) {
+	return []byte{c.Result}, nil
 }
 
 // Submit 消息请求包(packet body)，ID 和 payload
@@ -71,6 +78,9 @@ type Submit struct {
 
 // Decode 解码 packet 包体
 func (s *Submit) Decode(pktBody []byte) error {
+	if len(pktBody) < 8 {
+		return fmt.Errorf("submit packet too short")
+	}
 	s.ID = string(pktBody[:8]) // 消息流水号(顺序累加，步长为1，循环使用)
 	s.Payload = pktBody[8:]    // 消息的有效荷载，应用层需要的有效数据
 	return nil
@@ -81,22 +91,91 @@ func (s *Submit) Encode() ([]byte, error) {
 	return bytes.Join([][]byte{[]byte(s.ID[:8]), s.Payload}, nil), nil
 }
 
-// SubmitAck 消息响应包(packet body),ID 和 Result
+// SubmitAck 消息响应包(packet body),ID、Result 和可选的 Flags
 type SubmitAck struct {
 	ID     string // 消息流水号(顺序累加，步长为1，循环使用)
-	Result uint8  // 响应状态（0：正常；1：错误）
+	Result uint8  // 响应状态（0：正常；1：错误；2：被限流，消息未处理；3：未通过认证，消息未处理；4：服务端过载，消息未处理）
+	Flags  uint8  // 响应标记，为 0 时不编码，兼容只认识 ID 和 Result 的客户端
 }
 
+// SubmitAck 响应标记
+const (
+	SubmitAckDuplicate = 0x01 // 重复的消息，Result 为第一次收到该消息时的处理结果，消息没有被再次处理
+)
+
+// SubmitAck/ConnAck 响应状态
+const (
+	ResultOK           = iota // 0x00，正常
+	ResultError               // 0x01，错误
+	ResultThrottled           // 0x02，超过限流速率，消息未处理
+	ResultUnauthorized        // 0x03，未通过认证，消息未处理
+	ResultOverloaded          // 0x04，服务端过载，消息未处理
+)
+
 func (s *SubmitAck) Decode(pktBody []byte) error {
+	if len(pktBody) < 9 {
+		return fmt.Errorf("submit ack packet too short")
+	}
 	s.ID = string(pktBody[:8])
 	s.Result = uint8(pktBody[8])
+	s.Flags = 0
+	if len(pktBody) > 9 {
+		s.Flags = pktBody[9]
+	}
 	return nil
 }
 
 func (s *SubmitAck) Encode() ([]byte, error) {
+	if s.Flags != 0 {
+		return bytes.Join([][]byte{[]byte(s.ID[:8]), []byte{s.Result, s.Flags}}, nil), nil
+	}
 	return bytes.Join([][]byte{[]byte(s.ID[:8]), []byte{s.Result}}, nil), nil
 }
 
+// Disconnect 原因码
+const (
+	DisconnectShutdown = iota + 0x01 // 0x01，服务端正在关闭
+	DisconnectRejected               // 0x02，连接数或建连速率超过限制，服务端拒绝了连接
+	DisconnectKicked                 // 0x03，服务端强制断开了该连接
+)
+
+// Disconnect 断开连接通知包(packet body)，code 和 reason。客户端收到后应停止发送并关闭连接
+type Disconnect struct {
+	Code   uint8  // 断开原因码
+	Reason string // 可读的断开原因
+}
+
+func (d *Disconnect) Decode(pktBody []byte) error {
+	if len(pktBody) < 1 {
+		return fmt.Errorf("disconnect packet too short")
+	}
+	d.Code = pktBody[0]
+	d.Reason = string(pktBody[1:])
+	return nil
+}
+
+func (d *Disconnect) Encode() ([]byte, error) {
+	return bytes.Join([][]byte{[]byte{d.Code}, []byte(d.Reason)}, nil), nil
+}
+
+// Name 返回 packet 的类型名，用于日志和 metrics 标签
+func Name(p Packet) string {
+	switch p.(type) {
+	case *Conn:
+		return "conn"
+	case *ConnAck:
+		return "conn_ack"
+	case *Submit:
+		return "submit"
+	case *SubmitAck:
+		return "submit_ack"
+	case *Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
 var SubmitPool = sync.Pool{
 	New: func() interface{} {
 		return &Submit{}
@@ -111,14 +190,27 @@ var SubmitAckPool = sync.Pool{
 
 // Decode 解码 packet 包数据，负责从字节流中解析出对应的类型(根据 commandID)
 func Decode(packet []byte) (Packet, error) {
+	if len(packet) < 1 {
+		return nil, fmt.Errorf("empty packet")
+	}
 	commandID := packet[0] // packet header
 	pktBody := packet[1:]  // packet body
 
 	switch commandID {
 	case CommandConn:
-		return nil, nil
+		c := &Conn{}
+		err := c.Decode(pktBody)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
 	case CommandConnAck:
-		return nil, nil
+		c := &ConnAck{}
+		err := c.Decode(pktBody)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
 	case CommandSubmit:
 		//s := Submit{}
 		s := SubmitPool.Get().(*Submit) // 从 SubmitPool 池中获取一个 Submit 内存对象
@@ -135,6 +227,13 @@ func Decode(packet []byte) (Packet, error) {
 			return nil, err
 		}
 		return s, err
+	case CommandDisconnect:
+		d := &Disconnect{}
+		err := d.Decode(pktBody)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
 	default:
 		return nil, fmt.Errorf("unknown commandID [%d]", commandID)
 	}
@@ -159,13 +258,19 @@ func Encode(p Packet) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *Disconnect:
+		commandID = CommandDisconnect
+		pktBody, err = p.Encode()
+		if err != nil {
+			return nil, err
+		}
 	case *Conn:
 		commandID = CommandConn
 		pktBody, err = p.Encode()
 		if err != nil {
 			return nil, err
 		}
-	case *connAck:
+	case *ConnAck:
 		commandID = CommandConnAck
 		pktBody, err = p.Encode()
 		if err != nil {
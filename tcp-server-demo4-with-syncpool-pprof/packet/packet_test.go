@@ -120,6 +120,97 @@ func TestSubmitAck_Decode(t *testing.T) {
 	if arr.Result != 0 {
 		t.Errorf("want 0,actual %d", arr.Result)
 	}
+	if arr.Flags != 0 {
+		t.Errorf("want 0,actual %d", arr.Flags)
+	}
+}
+
+func TestSubmitAck_Flags(t *testing.T) {
+	id := fmt.Sprintf("%08d", 10) // 8 byte string
+	pkt, err := Encode(&SubmitAck{ID: id, Result: ResultError, Flags: SubmitAckDuplicate})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if len(pkt) != 11 {
+		t.Errorf("want 11,actual %d", len(pkt))
+	}
+	p, err := Decode(pkt)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	ack := p.(*SubmitAck)
+	if ack.ID != id || ack.Result != ResultError || ack.Flags != SubmitAckDuplicate {
+		t.Errorf("want %s/%d/%d,actual %+v", id, ResultError, SubmitAckDuplicate, ack)
+	}
+
+	// 从对象池中复用的 SubmitAck 解码不带 Flags 的包体时 Flags 被清零
+	SubmitAckPool.Put(ack)
+	pkt, _ = Encode(&SubmitAck{ID: id})
+	p, err = Decode(pkt)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if ack := p.(*SubmitAck); ack.Flags != 0 {
+		t.Errorf("want 0,actual %d", ack.Flags)
+	}
+}
+
+func TestDisconnect_EncodeDecode(t *testing.T) {
+	d := &Disconnect{
+		Code:   DisconnectShutdown,
+		Reason: "server shutting down",
+	}
+	pkt, err := Encode(d)
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if int(pkt[0]) != CommandDisconnect {
+		t.Errorf("want %d,actual %d", CommandDisconnect, pkt[0])
+	}
+
+	p, err := Decode(pkt)
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	dd := p.(*Disconnect)
+	if dd.Code != DisconnectShutdown {
+		t.Errorf("want %d,actual %d", DisconnectShutdown, dd.Code)
+	}
+	if dd.Reason != d.Reason {
+		t.Errorf("want %s,actual %s", d.Reason, dd.Reason)
+	}
+
+	// 包体为空
+	_, err = Decode([]byte{CommandDisconnect})
+	if err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestConn_EncodeDecode(t *testing.T) {
+	pkt, err := Encode(&Conn{ClientID: "client-1"})
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	p, err := Decode(pkt)
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if c := p.(*Conn); c.ClientID != "client-1" {
+		t.Errorf("want client-1,actual %s", c.ClientID)
+	}
+
+	pkt, err = Encode(&ConnAck{Result: ResultThrottled})
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	p, err = Decode(pkt)
+	if err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if c := p.(*ConnAck); c.Result != ResultThrottled {
+		t.Errorf("want %d,actual %d", ResultThrottled, c.Result)
+	}
 }
 
 type FailPacket struct {
@@ -150,3 +241,17 @@ func TestDecodeWithFail(t *testing.T) {
 		t.Errorf("want non-nil,actual nil")
 	}
 }
+
+func TestDecodeTooShort(t *testing.T) {
+	// 长度不足的包返回错误而不是 panic
+	for _, data := range [][]byte{
+		{},
+		{CommandSubmit},
+		[]byte("\x02ab"),
+		[]byte("\x8200000001"),
+	} {
+		if _, err := Decode(data); err == nil {
+			t.Errorf("%q: want non-nil,actual nil", data)
+		}
+	}
+}
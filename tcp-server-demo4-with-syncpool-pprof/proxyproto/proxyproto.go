@@ -0,0 +1,251 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyproto 包解析 HAProxy PROXY protocol v1(文本)和 v2(二进制)头，
+// 负载均衡(HAProxy、AWS NLB 等)在转发的连接开头写入客户端的真实地址
+/*
+v1
+	"PROXY TCP4|TCP6 源地址 目的地址 源端口 目的端口\r\n"，或 "PROXY UNKNOWN ...\r\n"，最长 107 字节
+v2
+	12 字节签名，1 字节版本和命令，1 字节地址族和协议，2 字节长度(大端)，之后是地址和 TLV，TLV 被忽略。
+	LOCAL 命令(代理自己发起的连接，如健康检查)和 AF_UNSPEC 不携带客户端地址
+*/
+
+var (
+	// ErrNoHeader 连接开头不是 PROXY protocol 头
+	ErrNoHeader = errors.New("proxyproto: missing proxy protocol header")
+	// ErrInvalidHeader PROXY protocol 头格式错误
+	ErrInvalidHeader = errors.New("proxyproto: invalid proxy protocol header")
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2HeaderLength = 16
+
+	// 读缓存大小，足够容纳完整的 v1 头；多读的数据由 Conn.Read 返回
+	readBufferSize = 256
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header 解析出的 PROXY protocol 头
+type Header struct {
+	Version     int      // 1 或 2
+	Source      net.Addr // 客户端地址，头中不携带地址(LOCAL、UNKNOWN、AF_UNSPEC)时为 nil
+	Destination net.Addr // 客户端连接的代理地址，Source 为 nil 时也为 nil
+}
+
+// Read 从 r 中读取一个 PROXY protocol 头，r 中剩余的数据属于上层协议。
+// 开头不是 v1 或 v2 头时返回 ErrNoHeader
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	if b, err := r.Peek(len(v1Prefix)); err != nil {
+		return nil, err
+	} else if string(b) != v1Prefix {
+		return nil, ErrNoHeader
+	}
+	line, err := r.ReadSlice('\n')
+	if len(line) > v1MaxLength || errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: v1 header longer than %d bytes", ErrInvalidHeader, v1MaxLength)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not terminated by CRLF", ErrInvalidHeader)
+	}
+
+	h := &Header{Version: 1}
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidHeader, line)
+	}
+	src, err := parseV1Addr(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(proto, ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" || addr.Is4() != (proto == "TCP4") {
+		return nil, fmt.Errorf("%w: bad %s address %q", ErrInvalidHeader, proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(v2HeaderLength)
+	if err != nil && len(b) < len(v2Signature) {
+		return nil, err
+	}
+	if !bytes.Equal(b[:len(v2Signature)], v2Signature) {
+		return nil, ErrNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, b[12]>>4)
+	}
+	command, family, transport := b[12]&0x0f, b[13]>>4, b[13]&0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	if _, err := r.Discard(v2HeaderLength); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	// LOCAL 命令忽略地址；只接受 STREAM，DGRAM 不会出现在 TCP 连接上
+	if command == 0 || family == 0 {
+		return h, nil
+	}
+	if transport != 1 {
+		return nil, fmt.Errorf("%w: unsupported transport protocol %d", ErrInvalidHeader, transport)
+	}
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short AF_INET address block", ErrInvalidHeader)
+		}
+		h.Source = tcpAddr(body[0:4], body[8:10])
+		h.Destination = tcpAddr(body[4:8], body[10:12])
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short AF_INET6 address block", ErrInvalidHeader)
+		}
+		h.Source = tcpAddr(body[0:16], body[32:34])
+		h.Destination = tcpAddr(body[16:32], body[34:36])
+	case 3: // AF_UNIX
+		if len(body) < 216 {
+			return nil, fmt.Errorf("%w: short AF_UNIX address block", ErrInvalidHeader)
+		}
+		h.Source = unixAddr(body[0:108])
+		h.Destination = unixAddr(body[108:216])
+	default:
+		return nil, fmt.Errorf("%w: unsupported address family %d", ErrInvalidHeader, family)
+	}
+	return h, nil
+}
+
+func tcpAddr(ip, port []byte) net.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port)))
+}
+
+func unixAddr(b []byte) net.Addr {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return &net.UnixAddr{Name: string(b), Net: "unix"}
+}
+
+// Conn 已读取 PROXY protocol 头的连接，RemoteAddr 和 LocalAddr 返回头中的地址
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader // 读取头时多读的数据，读完后直接读取底层连接
+	header *Header
+}
+
+// Accept 在 timeout 内读取 conn 开头的 PROXY protocol 头，timeout 为 0 表示不限制。
+// 出错时不关闭 conn
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	r := bufio.NewReaderSize(conn, readBufferSize)
+	h, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: r, header: h}, nil
+}
+
+// Read 先返回读取头时多读的数据
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr 返回客户端的真实地址，头中不携带地址时返回代理的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回客户端连接的代理地址，头中不携带地址时返回底层连接的本地地址
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr 返回代理的地址，即底层连接的对端地址
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// Header 返回读取到的 PROXY protocol 头
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// CloseWrite 关闭底层连接的写端
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("proxyproto: underlying connection does not support CloseWrite")
+}
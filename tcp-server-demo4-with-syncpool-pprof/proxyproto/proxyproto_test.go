@@ -0,0 +1,139 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header 构造 v2 头，body 为地址和 TLV
+func v2Header(command, family byte, body []byte) string {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return string(append(b, body...))
+}
+
+func TestRead(t *testing.T) {
+	inet := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x22, 0xb8}
+	inet6 := make([]byte, 36)
+	inet6[15], inet6[31], inet6[33], inet6[35] = 1, 2, 80, 81
+	unix := make([]byte, 216)
+	copy(unix, "/tmp/client.sock")
+	copy(unix[108:], "/tmp/server.sock")
+
+	tests := []struct {
+		name   string
+		input  string
+		source string // 期望的客户端地址，空表示 nil
+		dest   string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 12345 8888\r\n", "203.0.113.7:12345", "10.0.0.1:8888"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 8888\r\n", "[2001:db8::1]:12345", "[2001:db8::2]:8888"},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", ""},
+		{"v2 inet", v2Header(1, 0x11, inet), "203.0.113.7:12345", "10.0.0.1:8888"},
+		{"v2 inet with tlv", v2Header(1, 0x11, append(inet, 0x04, 0x00, 0x01, 0xff)), "203.0.113.7:12345", "10.0.0.1:8888"},
+		{"v2 inet6", v2Header(1, 0x21, inet6), "[::1]:80", "[::2]:81"},
+		{"v2 unix", v2Header(1, 0x31, unix), "/tmp/client.sock", "/tmp/server.sock"},
+		{"v2 local", v2Header(0, 0x11, inet), "", ""},
+		{"v2 unspec", v2Header(1, 0x00, nil), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.input+"rest"), readBufferSize)
+			h, err := Read(r)
+			if err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			if source := addrString(h.Source); source != tt.source {
+				t.Errorf("want %s,actual %s", tt.source, source)
+			}
+			if dest := addrString(h.Destination); dest != tt.dest {
+				t.Errorf("want %s,actual %s", tt.dest, dest)
+			}
+			// 头之后的数据留给上层协议
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Errorf("want rest,actual %q", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestRead_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"frame", "\x00\x00\x00\x10hello", ErrNoHeader},
+		{"http", "GET / HTTP/1.1\r\n", ErrNoHeader},
+		{"v1 prefix only", "PROXY", io.EOF},
+		{"v1 no crlf", "PROXY TCP4 203.0.113.7 10.0.0.1 12345 8888\n", ErrInvalidHeader},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", ErrInvalidHeader},
+		{"v1 bad protocol", "PROXY UDP4 203.0.113.7 10.0.0.1 12345 8888\r\n", ErrInvalidHeader},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 10.0.0.1 12345 8888\r\n", ErrInvalidHeader},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 10.0.0.1 123456 8888\r\n", ErrInvalidHeader},
+		{"v1 missing field", "PROXY TCP4 203.0.113.7 10.0.0.1 12345\r\n", ErrInvalidHeader},
+		{"v2 bad signature", "\r\n\r\n\x00\r\nQUIZ\n\x21\x11\x00\x00", ErrNoHeader},
+		{"v2 bad version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00", ErrInvalidHeader},
+		{"v2 bad command", v2Header(2, 0x11, make([]byte, 12)), ErrInvalidHeader},
+		{"v2 dgram", v2Header(1, 0x12, make([]byte, 12)), ErrInvalidHeader},
+		{"v2 short address", v2Header(1, 0x11, make([]byte, 8)), ErrInvalidHeader},
+		{"v2 truncated", v2Header(1, 0x11, make([]byte, 12))[:20], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(bufio.NewReaderSize(strings.NewReader(tt.input), readBufferSize))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("want %v,actual %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 8888\r\nhello"))
+
+	c, err := Accept(server, time.Second)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if c.RemoteAddr().String() != "203.0.113.7:12345" || c.LocalAddr().String() != "10.0.0.1:8888" {
+		t.Errorf("want 203.0.113.7:12345 10.0.0.1:8888,actual %s %s", c.RemoteAddr(), c.LocalAddr())
+	}
+	if c.ProxyAddr() != server.RemoteAddr() {
+		t.Errorf("want %s,actual %s", server.RemoteAddr(), c.ProxyAddr())
+	}
+	// 读取头时多读的数据先返回
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("want hello,actual %q %v", b, err)
+	}
+}
+
+func TestAccept_Timeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := Accept(server, 20*time.Millisecond)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("want timeout,actual %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// 清理空闲令牌桶的间隔
+const sweepInterval = time.Minute
+
+// Limiter 按 key 限流，每个 key 对应一个令牌桶，所有令牌桶使用相同的速率和容量
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewLimiter 创建按 key 限流的限流器，rate <= 0 表示不限流
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow 消耗 key 的一个令牌，没有令牌时返回 false
+func (l *Limiter) Allow(key string) bool {
+	now := time.Now()
+	return l.bucket(key, now).AllowN(now, 1)
+}
+
+// Reserve 消耗 key 的一个令牌，返回令牌可用前需要等待的时间
+func (l *Limiter) Reserve(key string) time.Duration {
+	now := time.Now()
+	return l.bucket(key, now).ReserveN(now, 1)
+}
+
+// SetLimit 调整所有 key 的速率和容量
+func (l *Limiter) SetLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, burst
+	for _, b := range l.buckets {
+		b.SetLimit(rate, burst)
+	}
+}
+
+// Limit 返回当前的速率和容量
+func (l *Limiter) Limit() (float64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.burst
+}
+
+// Remove 删除 key 的令牌桶，key 不再使用时调用
+func (l *Limiter) Remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// Len 返回令牌桶的数量
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (l *Limiter) bucket(key string, now time.Time) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweep 删除已经装满的令牌桶，避免 key 只增不减
+func (l *Limiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
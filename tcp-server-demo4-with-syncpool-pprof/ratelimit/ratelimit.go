@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// ratelimit 包提供令牌桶限流器
+/*
+令牌桶
+	桶的容量为 burst，以每秒 rate 个的速度放入令牌，桶满后多出的令牌被丢弃；
+	每次请求消耗一个令牌，桶中没有令牌时请求被拒绝。
+	rate <= 0 表示不限流
+*/
+
+// Bucket 令牌桶，可以在多个 goroutine 中并发使用
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64   // 每秒放入的令牌数
+	burst  float64   // 桶的容量
+	tokens float64   // 当前令牌数
+	last   time.Time // 上次计算令牌数的时间
+}
+
+// NewBucket 创建一个装满令牌的令牌桶
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{}
+	b.SetLimit(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// Allow 消耗一个令牌，没有令牌时返回 false
+func (b *Bucket) Allow() bool {
+	return b.AllowN(time.Now(), 1)
+}
+
+// AllowN 在 now 时刻消耗 n 个令牌，令牌不足时不消耗并返回 false
+func (b *Bucket) AllowN(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.advance(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve 消耗一个令牌，返回令牌可用前需要等待的时间
+func (b *Bucket) Reserve() time.Duration {
+	return b.ReserveN(time.Now(), 1)
+}
+
+// ReserveN 在 now 时刻消耗 n 个令牌，令牌不足时预支，返回需要等待的时间
+func (b *Bucket) ReserveN(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.advance(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// SetLimit 调整速率和容量，已有的令牌数不超过新的容量
+func (b *Bucket) SetLimit(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Limit 返回当前的速率和容量
+func (b *Bucket) Limit() (float64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, int(b.burst)
+}
+
+// full 在 now 时刻桶是否已满，满的桶与新建的桶等价
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	return b.tokens >= b.burst
+}
+
+// advance 按经过的时间补充令牌
+func (b *Bucket) advance(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
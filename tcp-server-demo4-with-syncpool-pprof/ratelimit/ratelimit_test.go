@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_AllowN(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 5)
+	b.last = now
+
+	// 初始时桶是满的
+	for i := 0; i < 5; i++ {
+		if !b.AllowN(now, 1) {
+			t.Fatalf("want true,actual false at %d", i)
+		}
+	}
+	if b.AllowN(now, 1) {
+		t.Errorf("want false,actual true")
+	}
+
+	// 100ms 补充一个令牌
+	now = now.Add(100 * time.Millisecond)
+	if !b.AllowN(now, 1) {
+		t.Errorf("want true,actual false")
+	}
+	if b.AllowN(now, 1) {
+		t.Errorf("want false,actual true")
+	}
+
+	// 令牌数不超过容量
+	now = now.Add(time.Hour)
+	if b.AllowN(now, 6) {
+		t.Errorf("want false,actual true")
+	}
+	if !b.AllowN(now, 5) {
+		t.Errorf("want true,actual false")
+	}
+}
+
+func TestBucket_Unlimited(t *testing.T) {
+	b := NewBucket(0, 1)
+	for i := 0; i < 100; i++ {
+		if !b.Allow() {
+			t.Fatalf("want true,actual false at %d", i)
+		}
+	}
+}
+
+func TestBucket_SetLimit(t *testing.T) {
+	b := NewBucket(1, 10)
+	b.SetLimit(1, 2)
+	if rate, burst := b.Limit(); rate != 1 || burst != 2 {
+		t.Errorf("want 1 2,actual %v %d", rate, burst)
+	}
+	// 已有的令牌数被截断为新的容量
+	if !b.Allow() || !b.Allow() {
+		t.Errorf("want true,actual false")
+	}
+	if b.Allow() {
+		t.Errorf("want false,actual true")
+	}
+}
+
+func TestBucket_ReserveN(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 1)
+	b.last = now
+
+	if d := b.ReserveN(now, 1); d != 0 {
+		t.Errorf("want 0,actual %s", d)
+	}
+	// 预支的令牌需要等待补充
+	if d := b.ReserveN(now, 1); d != 100*time.Millisecond {
+		t.Errorf("want 100ms,actual %s", d)
+	}
+	if d := b.ReserveN(now, 1); d != 200*time.Millisecond {
+		t.Errorf("want 200ms,actual %s", d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(0.001, 2)
+	for i := 0; i < 2; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("want true,actual false at %d", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Errorf("want false,actual true")
+	}
+	// 不同 key 互不影响
+	if !l.Allow("b") {
+		t.Errorf("want true,actual false")
+	}
+
+	// 运行时调整对已有的 key 生效
+	l.SetLimit(0, 1)
+	if !l.Allow("a") {
+		t.Errorf("want true,actual false")
+	}
+
+	l.Remove("a")
+	if l.Len() != 1 {
+		t.Errorf("want 1,actual %d", l.Len())
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	l := NewLimiter(1000, 1)
+	l.Allow("a")
+	l.Allow("b")
+
+	// 已经补满的令牌桶被清理
+	l.sweep(time.Now().Add(time.Second))
+	if l.Len() != 0 {
+		t.Errorf("want 0,actual %d", l.Len())
+	}
+}
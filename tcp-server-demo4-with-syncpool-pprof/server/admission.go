@@ -0,0 +1,173 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/ratelimit"
+)
+
+// 准入控制：Accept 之后、启动处理 goroutine 之前检查源 IP 过滤、是否正在排空、是否过载、建连速率、总连接数和单 IP 连接数，
+// 超过限制的连接收到 Disconnect(DisconnectRejected) 后被关闭
+
+const (
+	// 写拒绝原因和等待客户端关闭的最长时间，连接风暴时不能长时间占用文件描述符
+	rejectTimeout = 100 * time.Millisecond
+
+	// Accept 返回临时错误(如文件描述符耗尽)时的重试间隔，从 5ms 开始倍增，最大 1s
+	acceptRetryDelayMin = 5 * time.Millisecond
+	acceptRetryDelayMax = time.Second
+)
+
+// 拒绝原因，同时作为 metrics 的 reason 标签
+const (
+	rejectIPDenied      = "ip_denied"
+	rejectDraining      = "draining"
+	rejectOverloaded    = "overloaded"
+	rejectAcceptRate    = "accept_rate"
+	rejectMaxConns      = "max_conns"
+	rejectMaxConnsPerIP = "max_conns_per_ip"
+)
+
+var rejectReasons = map[string]string{
+	rejectIPDenied:      "connections from your address are not allowed",
+	rejectDraining:      "server is draining, connect to another instance",
+	rejectOverloaded:    "server is overloaded, try again later",
+	rejectAcceptRate:    "too many new connections, try again later",
+	rejectMaxConns:      "too many connections",
+	rejectMaxConnsPerIP: "too many connections from your address",
+}
+
+// WithMaxConns 设置同时保持的最大连接数(复用连接上的 stream 不计入)，0 表示不限制，
+// 可以通过 SetMaxConns 在运行时调整
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP 设置同一个源 IP 同时保持的最大连接数，0 表示不限制。
+// unix socket 上的连接没有源 IP，共用同一个名额
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = n
+	}
+}
+
+// WithAcceptRate 设置每秒接受的新连接数和允许的突发数量，rate <= 0 表示不限制，
+// 可以通过 SetAcceptRate 在运行时调整
+func WithAcceptRate(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.acceptLimiter = ratelimit.NewBucket(rate, burst)
+	}
+}
+
+// SetMaxConns 在运行时调整最大连接数，已经建立的连接不受影响
+func (s *Server) SetMaxConns(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxConns = n
+}
+
+// SetMaxConnsPerIP 在运行时调整单个源 IP 的最大连接数，已经建立的连接不受影响
+func (s *Server) SetMaxConnsPerIP(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxConnsPerIP = n
+}
+
+// MaxConns 返回当前的最大连接数和单个源 IP 的最大连接数
+func (s *Server) MaxConns() (maxConns, maxConnsPerIP int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxConns, s.maxConnsPerIP
+}
+
+// SetAcceptRate 在运行时调整建连速率和容量，rate <= 0 表示不限制
+func (s *Server) SetAcceptRate(rate float64, burst int) {
+	s.acceptLimiter.SetLimit(rate, burst)
+}
+
+// AcceptRate 返回当前的建连速率和容量
+func (s *Server) AcceptRate() (float64, int) {
+	return s.acceptLimiter.Limit()
+}
+
+// admit 检查是否接受新连接，接受时占用一个连接名额并返回空字符串，否则返回拒绝原因
+func (s *Server) admit(ip string) string {
+	if !s.ipFilter.Load().allows(ip) {
+		return rejectIPDenied
+	}
+	if s.draining.Load() {
+		return rejectDraining
+	}
+	if s.budget.overloaded.Load() {
+		return rejectOverloaded
+	}
+	if !s.acceptLimiter.Allow() {
+		return rejectAcceptRate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxConns > 0 && s.numConns >= s.maxConns {
+		return rejectMaxConns
+	}
+	if s.maxConnsPerIP > 0 && s.connsPerIP[ip] >= s.maxConnsPerIP {
+		return rejectMaxConnsPerIP
+	}
+	s.numConns++
+	s.connsPerIP[ip]++
+	return ""
+}
+
+// release 归还 admit 占用的连接名额
+func (s *Server) release(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numConns--
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// reject 向被拒绝的连接发送 Disconnect 后关闭连接。rwc 是 TLS 握手之前的连接，
+// 启用 TLS 时明文的 Disconnect 客户端无法解析，直接关闭
+func (s *Server) reject(rwc net.Conn, reason string) {
+	defer rwc.Close()
+	metrics.ConnRejectedTotal.WithLabelValues(reason).Inc()
+	if s.tlsConfig != nil {
+		return
+	}
+
+	framePayload, err := packet.Encode(&packet.Disconnect{Code: packet.DisconnectRejected, Reason: rejectReasons[reason]})
+	if err != nil {
+		return
+	}
+	rwc.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	if err := frame.NewMyFrameCodec().Encode(rwc, framePayload); err != nil {
+		return
+	}
+	closeWriteAndWait(rwc, rejectTimeout)
+}
+
+// remoteIP 返回连接的源 IP，非 IP 地址(如 unix socket)返回完整地址
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// isTemporary 判断 Accept 返回的错误是否可以重试
+func isTemporary(err error) bool {
+	ne, ok := err.(interface{ Temporary() bool })
+	return ok && ne.Temporary()
+}
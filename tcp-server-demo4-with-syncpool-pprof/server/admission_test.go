@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+func dialAndAck(t *testing.T, addr string) net.Conn {
+	c, err := transport.Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	writeSubmit(t, c, "00000001")
+	readSubmitAck(t, c)
+	return c
+}
+
+func expectRejected(t *testing.T, addr string) {
+	c, err := transport.Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	d, ok := readPacket(t, c).(*packet.Disconnect)
+	if !ok || d.Code != packet.DisconnectRejected {
+		t.Errorf("want rejected disconnect,actual %v", d)
+	}
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"MaxConns", WithMaxConns(2)},
+		{"MaxConnsPerIP", WithMaxConnsPerIP(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, ackHandler, tt.opt)
+			c1 := dialAndAck(t, addr)
+			dialAndAck(t, addr)
+			expectRejected(t, addr)
+
+			// 连接关闭后名额被归还
+			c1.Close()
+			time.Sleep(50 * time.Millisecond)
+			dialAndAck(t, addr)
+		})
+	}
+}
+
+func TestServer_AcceptRate(t *testing.T) {
+	_, addr := startServer(t, ackHandler, WithAcceptRate(0.001, 2))
+	dialAndAck(t, addr)
+	dialAndAck(t, addr)
+	expectRejected(t, addr)
+}
+
+// flakyListener 前 n 次 Accept 返回临时错误
+type flakyListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.n.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServer_AcceptTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	fl := &flakyListener{Listener: l}
+	fl.n.Store(3)
+	srv := New(ackHandler)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(fl)
+	}()
+	defer srv.closeConns()
+
+	// 临时错误被重试，Serve 不退出
+	dialAndAck(t, l.Addr().String())
+
+	// 其他错误使 Serve 返回
+	l.Close()
+	if err := <-serveErr; err == nil || errors.Is(err, ErrServerClosed) {
+		t.Errorf("want accept error,actual %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// 内存预算：统计所有连接上在途的字节数和消息数，超过上限时进入过载状态，削减负载直到用量回落到低水位以下。
+// 在途数据包括已解码、尚未处理完的请求，出站队列中尚未写出的响应，以及每个连接的读写缓存(只计字节数)。
+// 过载期间拒绝新连接，已有连接上的请求按 OverloadAction 处理；
+// 过载完全由连接的读写缓存造成、没有在途消息时削减请求无济于事，已有连接照常处理
+
+const defaultLowWatermark = 0.8
+
+// OverloadAction 过载时对已有连接上请求的处理方式
+type OverloadAction int
+
+const (
+	OverloadPause  OverloadAction = iota // 暂停读取所有连接直到恢复，依靠 TCP 流控让客户端降速
+	OverloadReject                       // 回复 Result 为 ResultOverloaded 的 SubmitAck，Submit 不交给 Handler 处理
+)
+
+// MemoryBudget 在途数据的全局预算，MaxBytes 和 MaxMessages 都 <= 0 表示不启用
+type MemoryBudget struct {
+	MaxBytes     int64          // 在途字节数上限，<= 0 表示不限制
+	MaxMessages  int64          // 在途消息数上限，<= 0 表示不限制
+	LowWatermark float64        // 进入过载后，用量回落到上限的该比例以下才恢复，默认 0.8
+	Action       OverloadAction // 过载时对已有连接上请求的处理方式
+}
+
+// WithMemoryBudget 设置在途数据的全局预算，只对 EngineGoroutine 生效。
+// 设置了 MaxBytes 时 WithMaxFrameSize 不超过 MaxBytes，未设置或更大时按 MaxBytes 限制
+func WithMemoryBudget(b MemoryBudget) Option {
+	return func(s *Server) {
+		s.memoryBudget = b
+	}
+}
+
+// Overloaded 返回服务端是否处于过载状态
+func (s *Server) Overloaded() bool {
+	return s.budget.overloaded.Load()
+}
+
+// InFlight 返回内存预算统计的在途字节数和消息数，未启用内存预算时都为 0
+func (s *Server) InFlight() (bytes, messages int64) {
+	return s.budget.bytes.Load(), s.budget.messages.Load()
+}
+
+// budget 在途数据的计数和过载状态，未启用时所有操作都是空操作
+type budget struct {
+	cfg      MemoryBudget
+	enabled  bool
+	logger   *slog.Logger
+	bytes    atomic.Int64
+	messages atomic.Int64
+
+	overloaded atomic.Bool
+	mu         sync.Mutex    // 串行化过载状态的切换
+	recovered  chan struct{} // 进入过载时创建，恢复时关闭，由 mu 保护
+}
+
+func newBudget(cfg MemoryBudget, logger *slog.Logger) *budget {
+	if cfg.LowWatermark <= 0 || cfg.LowWatermark >= 1 {
+		cfg.LowWatermark = defaultLowWatermark
+	}
+	return &budget{
+		cfg:     cfg,
+		enabled: cfg.MaxBytes > 0 || cfg.MaxMessages > 0,
+		logger:  logger,
+	}
+}
+
+// acquire 增加在途数据，超过上限时进入过载状态
+func (b *budget) acquire(bytes, messages int64) {
+	if !b.enabled {
+		return
+	}
+	n, m := b.bytes.Add(bytes), b.messages.Add(messages)
+	metrics.InflightBytes.Add(float64(bytes))
+	if messages != 0 {
+		metrics.InflightMessages.Add(float64(messages))
+	}
+	if !b.overloaded.Load() && b.over(n, m) {
+		b.transition()
+	}
+}
+
+// release 减少在途数据，过载时回落到低水位以下则恢复
+func (b *budget) release(bytes, messages int64) {
+	if !b.enabled {
+		return
+	}
+	n, m := b.bytes.Add(-bytes), b.messages.Add(-messages)
+	metrics.InflightBytes.Sub(float64(bytes))
+	if messages != 0 {
+		metrics.InflightMessages.Sub(float64(messages))
+	}
+	if b.overloaded.Load() && b.under(n, m) {
+		b.transition()
+	}
+}
+
+// over 是否超过上限
+func (b *budget) over(n, m int64) bool {
+	return (b.cfg.MaxBytes > 0 && n > b.cfg.MaxBytes) || (b.cfg.MaxMessages > 0 && m > b.cfg.MaxMessages)
+}
+
+// under 是否回落到低水位以下
+func (b *budget) under(n, m int64) bool {
+	return (b.cfg.MaxBytes <= 0 || float64(n) <= b.cfg.LowWatermark*float64(b.cfg.MaxBytes)) &&
+		(b.cfg.MaxMessages <= 0 || float64(m) <= b.cfg.LowWatermark*float64(b.cfg.MaxMessages))
+}
+
+// transition 按当前用量切换过载状态，并发的 acquire 和 release 可能同时调用，加锁后重新判断
+func (b *budget) transition() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, m := b.bytes.Load(), b.messages.Load()
+	switch {
+	case !b.overloaded.Load() && b.over(n, m):
+		b.recovered = make(chan struct{})
+		b.overloaded.Store(true)
+		metrics.Overloaded.Set(1)
+		metrics.OverloadTotal.Inc()
+		b.logger.Warn("server overloaded, shedding load", "inflight_bytes", n, "inflight_messages", m)
+	case b.overloaded.Load() && b.under(n, m):
+		b.overloaded.Store(false)
+		close(b.recovered)
+		metrics.Overloaded.Set(0)
+		b.logger.Info("server recovered from overload", "inflight_bytes", n, "inflight_messages", m)
+	}
+}
+
+// shedding 是否需要削减已有连接上的请求
+func (b *budget) shedding() bool {
+	return b.overloaded.Load() && b.messages.Load() > 0
+}
+
+// recoveredC 返回恢复时关闭的 channel，未过载时返回 nil
+func (b *budget) recoveredC() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.overloaded.Load() {
+		return nil
+	}
+	return b.recovered
+}
+
+// waitBudget OverloadPause 时在读取下一个 frame 之前等待过载恢复，期间先把已缓存的响应发出去；
+// Shutdown 或 Kick 时提前结束
+func (c *conn) waitBudget() {
+	b := c.server.budget
+	if b.cfg.Action != OverloadPause || !b.shedding() {
+		return
+	}
+	metrics.OverloadShedTotal.WithLabelValues("pause").Inc()
+	c.requestFlush()
+	timer := time.NewTimer(pausePollInterval)
+	defer timer.Stop()
+	for b.shedding() && !c.server.shuttingDown() && !c.kicked.Load() {
+		recovered := b.recoveredC()
+		if recovered == nil {
+			return
+		}
+		select {
+		case <-recovered:
+			return
+		case <-timer.C:
+			timer.Reset(pausePollInterval)
+		}
+	}
+}
+
+// shedSubmit OverloadReject 时过载期间回复 ResultOverloaded，返回 true 时该 Submit 不再交给 Handler
+func (c *conn) shedSubmit(p *packet.Submit) bool {
+	b := c.server.budget
+	if b.cfg.Action != OverloadReject || !b.shedding() {
+		return false
+	}
+	metrics.OverloadShedTotal.WithLabelValues("reject").Inc()
+	submitAck := packet.SubmitAckPool.Get().(*packet.SubmitAck)
+	submitAck.ID = p.ID
+	submitAck.Result = packet.ResultOverloaded
+	submitAck.Flags = 0
+	if err := c.Write(submitAck); err != nil {
+		c.logger().Info("write overloaded submit ack error", "err", err)
+	}
+	packet.SubmitAckPool.Put(submitAck)
+	return true
+}
+
+// drainOutbound 写 goroutine 退出且出站队列关闭后，归还队列中未写出的 frame 占用的预算
+func (c *conn) drainOutbound() {
+	for {
+		select {
+		case framePayload := <-c.out:
+			c.server.budget.release(int64(len(framePayload)), 1)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func TestBudget_Hysteresis(t *testing.T) {
+	b := newBudget(MemoryBudget{MaxBytes: 1000, MaxMessages: 10, LowWatermark: 0.5}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.acquire(1000, 10)
+	if b.overloaded.Load() {
+		t.Fatalf("want not overloaded at limit,actual overloaded")
+	}
+	b.acquire(0, 1)
+	if !b.overloaded.Load() {
+		t.Fatalf("want overloaded,actual not overloaded")
+	}
+	recovered := b.recoveredC()
+
+	// 低于上限但高于低水位时仍然过载
+	b.release(0, 5)
+	if !b.overloaded.Load() {
+		t.Fatalf("want overloaded above low watermark,actual recovered")
+	}
+	// 消息数回落后字节数仍高于低水位
+	b.release(0, 1)
+	if !b.overloaded.Load() {
+		t.Fatalf("want overloaded while bytes above low watermark,actual recovered")
+	}
+	b.release(500, 0)
+	if b.overloaded.Load() {
+		t.Fatalf("want recovered,actual overloaded")
+	}
+	select {
+	case <-recovered:
+	default:
+		t.Errorf("want recovered closed,actual open")
+	}
+	if b.recoveredC() != nil {
+		t.Errorf("want nil,actual channel")
+	}
+}
+
+// blockingHandler 阻塞到 release 关闭后回复 SubmitAck
+func blockingHandler(release chan struct{}) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-release
+		ackHandler(w, r)
+	})
+}
+
+// waitFor 等待 cond 成立，超时后失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %s,actual timeout", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_MemoryBudgetReject(t *testing.T) {
+	release := make(chan struct{})
+	srv, addr := startServer(t, blockingHandler(release),
+		WithWorkerPool(WorkerPool{Size: 1}),
+		WithMemoryBudget(MemoryBudget{MaxMessages: 2, Action: OverloadReject}))
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	c := dialClient(t, addr, "")
+	for i := 1; i <= 3; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	// 超过预算的第 3 个 Submit 直接回复 ResultOverloaded，不交给 Handler
+	if ack := readSubmitAck(t, c); ack.ID != "00000003" || ack.Result != packet.ResultOverloaded {
+		t.Errorf("want 00000003 %d,actual %s %d", packet.ResultOverloaded, ack.ID, ack.Result)
+	}
+	if !srv.Overloaded() {
+		t.Fatalf("want overloaded,actual not overloaded")
+	}
+
+	// 在途消息数回落到低水位以下之前一直过载，新连接被拒绝
+	if r := submitResult(t, c, "00000004"); r != packet.ResultOverloaded {
+		t.Errorf("want %d,actual %d", packet.ResultOverloaded, r)
+	}
+	expectRejected(t, addr)
+
+	close(release)
+	for i := 1; i <= 2; i++ {
+		if ack := readSubmitAck(t, c); ack.Result != packet.ResultOK {
+			t.Errorf("want %d,actual %d", packet.ResultOK, ack.Result)
+		}
+	}
+	waitFor(t, "recovered", func() bool { return !srv.Overloaded() })
+	if r := submitResult(t, c, "00000005"); r != packet.ResultOK {
+		t.Errorf("want %d,actual %d", packet.ResultOK, r)
+	}
+	dialAndAck(t, addr)
+}
+
+func TestServer_MemoryBudgetPause(t *testing.T) {
+	release := make(chan struct{})
+	srv, addr := startServer(t, blockingHandler(release),
+		WithWorkerPool(WorkerPool{Size: 1}),
+		WithMemoryBudget(MemoryBudget{MaxMessages: 2, Action: OverloadPause}))
+
+	c := dialClient(t, addr, "")
+	for i := 1; i <= 4; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	waitFor(t, "overloaded", srv.Overloaded)
+
+	// 过载后暂停读取，第 4 个 Submit 留在读缓存中
+	time.Sleep(50 * time.Millisecond)
+	if _, m := srv.InFlight(); m != 3 {
+		t.Errorf("want 3,actual %d", m)
+	}
+
+	close(release)
+	for i := 1; i <= 4; i++ {
+		ack := readSubmitAck(t, c)
+		if want := fmt.Sprintf("%08d", i); ack.ID != want || ack.Result != packet.ResultOK {
+			t.Errorf("want %s ok,actual %s %d", want, ack.ID, ack.Result)
+		}
+	}
+	waitFor(t, "recovered", func() bool { return !srv.Overloaded() })
+
+	// 连接关闭后在途数据全部归还
+	c.Close()
+	waitFor(t, "no inflight data", func() bool {
+		n, m := srv.InFlight()
+		return n == 0 && m == 0
+	})
+}
+
+func TestServer_MemoryBudgetLimitsFrameSize(t *testing.T) {
+	_, addr := startServer(t, ackHandler,
+		WithMemoryBudget(MemoryBudget{MaxBytes: 1 << 20, Action: OverloadReject}))
+
+	// 没有设置 MaxFrameSize 时按预算限制 frame 长度，超长的 totalLen 不会分配内存
+	c := dialClient(t, addr, "")
+	c.Write([]byte{0x7f, 0xff, 0xff, 0xff})
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want EOF,actual %v", err)
+	}
+	dialAndAck(t, addr)
+}
+
+func TestServer_MemoryBudgetMalformedFrame(t *testing.T) {
+	srv, addr := startServer(t, ackHandler,
+		WithMemoryBudget(MemoryBudget{MaxMessages: 2, Action: OverloadReject}))
+
+	// 空 frame 和包体过短的 Submit 不计入预算，连接被关闭
+	for _, framePayload := range [][]byte{{}, []byte("\x02ab"), []byte("\x02abc"), {packet.CommandSubmit}} {
+		c := dialClient(t, addr, "")
+		if err := frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("want EOF,actual %v", err)
+		}
+	}
+	waitFor(t, "no inflight data", func() bool {
+		n, m := srv.InFlight()
+		return n == 0 && m == 0
+	})
+	if srv.Overloaded() {
+		t.Errorf("want not overloaded,actual overloaded")
+	}
+	dialAndAck(t, addr)
+}
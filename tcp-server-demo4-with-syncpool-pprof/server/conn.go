@@ -0,0 +1,449 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+)
+
+// 连接状态，用于 Shutdown 时判断连接上是否有正在处理的请求
+const (
+	stateActive  int32 = iota // 正在读取或处理 frame
+	stateIdle                 // 等待下一个 frame
+	stateClosing              // 已被 Shutdown 接管，即将关闭
+)
+
+// Shutdown 时半关闭连接后等待客户端关闭的最长时间
+const closeLingerTimeout = 500 * time.Millisecond
+
+// 读操作所处的阶段，用于区分触发的是哪一种超时
+const (
+	phaseHandshake = iota // 等待第一个完整的 frame
+	phaseIdle             // 等待下一个 frame 的首字节
+	phaseFrame            // 已收到 frame 首字节，读取剩余部分
+)
+
+// conn 服务端的一个连接，既可以是 TCP 连接，也可以是复用连接上的一个 stream
+type conn struct {
+	server *Server
+	id     uint64 // 连接编号，同一个 Server 内唯一
+	rwc    net.Conn
+	parent *conn // stream 所属的复用连接，普通连接为 nil
+
+	proxyAddr net.Addr // 经 PROXY protocol 转发时为负载均衡的地址，stream 继承复用连接的
+
+	logBase *slog.Logger                // 带有 conn_id 和 remote 的日志，经 PROXY protocol 转发时还带有 proxy
+	log     atomic.Pointer[slog.Logger] // 在 logBase 的基础上带有 client_id，客户端标识变化时重新创建
+
+	state   atomic.Int32
+	mux     atomic.Bool  // 是否为多路复用连接
+	streams atomic.Int32 // 复用连接上仍在处理的 stream 数量
+
+	frameCodec frame.StreamFrameCodec
+	// 读缓存变量，避免每次都从 net.Conn 读取，降低 Syscall 调用频率
+	rbuf *bufio.Reader
+
+	// 出站队列，读 goroutine(Handler)和其他 goroutine 写入，写 goroutine 取出后写入连接
+	out        chan []byte
+	outMu      sync.RWMutex  // 保护 outOpen，关闭出站队列时等待正在进行的 enqueue
+	outOpen    bool          // 写 goroutine 是否在运行且出站队列未关闭
+	quit       chan struct{} // 读 goroutine 退出时关闭，通知写 goroutine 写完剩余的 frame 后退出
+	writerDone chan struct{} // 写 goroutine 退出时关闭
+	flushReq   chan struct{} // 读 goroutine 进入空闲或暂停读取时请求刷新写缓存
+	// 写缓存变量，只在写 goroutine 中使用
+	wbuf *bufio.Writer
+
+	disconnectOnce sync.Once
+	kicked         atomic.Bool // 已被 Kick，读 goroutine 每次设置读超时之后检查，避免覆盖 Kick 设置的截止时间
+
+	session *session.Session // 普通连接和 stream 开始处理 frame 时创建
+
+	handshakeDeadline time.Time // 建立连接时间 + handshakeTimeout
+	handshakeDone     bool      // 是否已收到第一个完整的 frame
+	writeTimeoutOnce  sync.Once
+
+	tlsState     *tls.ConnectionState // TLS 连接的状态，非 TLS 连接为 nil
+	certIdentity string               // 客户端证书对应的客户端标识，优先于 Conn 包中的标识
+	clientID     string               // Conn 包中的客户端标识
+	rateKey      string               // Submit 限流的 key
+	rateKeyOwned bool                 // rateKey 是否只属于该连接
+
+	pending     atomic.Int32   // 已交给 worker pool 尚未处理完的请求数
+	tasks       sync.WaitGroup // 与 pending 同步增减，读 goroutine 退出前等待
+	orderKey    uint32         // worker pool 排序 key 的 hash
+	orderKeySet bool
+}
+
+func (s *Server) newConn(rwc net.Conn, parent *conn) *conn {
+	c := &conn{
+		server:     s,
+		id:         s.nextConnID.Add(1),
+		rwc:        rwc,
+		parent:     parent,
+		frameCodec: frame.NewMyFrameCodecWithLimit(s.maxFrameSize),
+		rbuf:       bufio.NewReaderSize(rwc, s.readBufferSize),
+		out:        make(chan []byte, s.outboundQueueSize),
+		quit:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+		flushReq:   make(chan struct{}, 1),
+	}
+	if s.handshakeTimeout > 0 {
+		c.handshakeDeadline = time.Now().Add(s.handshakeTimeout)
+	}
+	c.logBase = s.logger.With("conn_id", c.id, "remote", rwc.RemoteAddr().String())
+	if parent != nil {
+		// stream 继承复用连接的 TLS 状态、客户端证书标识和负载均衡地址
+		c.tlsState = parent.tlsState
+		c.certIdentity = parent.certIdentity
+		c.clientID = parent.certIdentity
+		c.proxyAddr = parent.proxyAddr
+		c.logBase = c.logBase.With("mux_conn_id", parent.id)
+	} else {
+		c.proxyAddr = proxyAddr(rwc)
+	}
+	if c.proxyAddr != nil {
+		c.logBase = c.logBase.With("proxy", c.proxyAddr.String())
+	}
+	c.setLogger()
+	return c
+}
+
+// setLogger 客户端标识变化后重新创建 c.log
+func (c *conn) setLogger() {
+	c.log.Store(c.logBase.With("client_id", c.clientID))
+}
+
+// logger 返回连接的日志，可以在写 goroutine 和 worker 中使用
+func (c *conn) logger() *slog.Logger {
+	return c.log.Load()
+}
+
+// serve 处理连接：多路复用连接为每个 stream 启动一个 conn，普通连接和 stream 循环读取 frame 并交给 Handler
+func (c *conn) serve() {
+	defer c.rwc.Close()
+
+	if c.parent == nil {
+		if tlsConn, ok := c.rwc.(*tls.Conn); ok && !c.handshake(tlsConn) {
+			return
+		}
+		// 根据首字节识别连接类型
+		c.rwc.SetReadDeadline(c.handshakeDeadline)
+		c.state.Store(stateIdle)
+		b, err := c.rbuf.Peek(1)
+		if !c.state.CompareAndSwap(stateIdle, stateActive) {
+			return
+		}
+		if err != nil {
+			c.readError(phaseHandshake, err)
+			return
+		}
+		if b[0] == mux.Magic {
+			// 复用连接的超时由每个 stream 各自处理
+			c.rwc.SetReadDeadline(time.Time{})
+			c.mux.Store(true)
+			c.serveMux()
+			return
+		}
+	}
+	c.serveFrames()
+}
+
+// serveMux 在复用连接上接收 stream，每个 stream 都是一个独立的逻辑连接
+func (c *conn) serveMux() {
+	config := mux.DefaultConfig()
+	config.MaxStreams = c.server.muxMaxStreams
+	session := mux.Server(&bufferedConn{Conn: c.rwc, r: c.rbuf}, config)
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		c.server.serveConn(stream, c, nil)
+	}
+}
+
+func (c *conn) serveFrames() {
+	metrics.ClientConnected.Inc() //连接建立，ClientConnected + 1
+	defer func() {
+		metrics.ClientConnected.Dec() // 连接断开，ClientConnected - 1
+		if err := recover(); err != nil {
+			c.logger().Error("recover panic and close conn", "panic", err)
+		}
+	}()
+
+	c.startSession()
+	defer c.server.sessions.Remove(c.session)
+	c.startWriter()
+	// 连接的读写缓存计入内存预算
+	bufSize := int64(c.server.readBufferSize + c.server.writeBufferSize)
+	c.server.budget.acquire(bufSize, 0)
+	defer c.server.budget.release(bufSize, 0)
+	defer func() {
+		// 因 Shutdown 退出时确保客户端收到 Disconnect
+		shutdown := c.server.shuttingDown()
+		if shutdown {
+			c.disconnect(packet.DisconnectShutdown, "server shutting down", true)
+		}
+		// 等待写 goroutine 写完出站队列中剩余的 frame
+		c.closeOutbound()
+		<-c.writerDone
+		c.drainOutbound()
+		if shutdown || c.kicked.Load() {
+			c.closeWriteAndWait()
+		}
+	}()
+	defer c.releaseRateLimit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 等待已交给 worker pool 的请求处理完，之后才能关闭出站队列
+	defer c.tasks.Wait()
+
+	for {
+		// 过载时暂停读取
+		c.waitBudget()
+		if c.rbuf.Buffered() == 0 {
+			// 读缓存中没有未处理的数据，正在关闭时退出
+			if c.server.shuttingDown() {
+				return
+			}
+			// 进入空闲状态，等待下一个 frame 的首字节；客户端暂时没有更多请求，通知写 goroutine 把已缓存的响应发出去
+			phase := c.setIdleDeadline()
+			if c.kicked.Load() {
+				return
+			}
+			c.state.Store(stateIdle)
+			if c.server.flushPolicy.OnIdle {
+				c.requestFlush()
+			}
+			_, err := c.rbuf.Peek(1)
+			if !c.state.CompareAndSwap(stateIdle, stateActive) {
+				// 已被 Shutdown 接管
+				return
+			}
+			if err != nil {
+				c.readError(phase, err)
+				return
+			}
+		}
+
+		// decode the frame to get the payload
+		// 从 connection 中读取  client 发送的数据内容
+		phase := c.setFrameDeadline()
+		if c.kicked.Load() {
+			return
+		}
+		framePayload, err := c.frameCodec.Decode(c.rbuf)
+		if err != nil {
+			c.readError(phase, err)
+			return
+		}
+		c.handshakeDone = true
+
+		metrics.ReqRecvTotal.Add(1) // 收到并解码一个消息请求，ReqRecvTotal 消息计数器 +1
+		c.session.RecordIn(len(framePayload))
+
+		if len(framePayload) == 0 {
+			c.logger().Info("empty frame")
+			return
+		}
+		p, err := packet.Decode(framePayload)
+		if err != nil {
+			c.logger().Warn("packet decode error", "err", err)
+			return
+		}
+		if p == nil {
+			continue
+		}
+		// 解码成功的请求计入内存预算，处理完后(或不交给 Handler 时)归还
+		size := int64(len(framePayload))
+		c.server.budget.acquire(size, 1)
+		// 热点路径上的 debug 日志，由 Logger 的 Handler 采样
+		if log := c.logger(); log.Enabled(ctx, slog.LevelDebug) {
+			log.Debug("packet received", "packet", packet.Name(p), "size", len(framePayload))
+		}
+		switch p := p.(type) {
+		case *packet.Conn:
+			c.setClientID(p.ClientID)
+		case *packet.Submit:
+			if c.shedSubmit(p) || !c.allowSubmit(p) {
+				releasePacket(p)
+				c.server.budget.release(size, 1)
+				continue
+			}
+		}
+
+		// do something with the packet
+		c.servePacket(&Request{
+			Packet:     p,
+			RemoteAddr: c.rwc.RemoteAddr(),
+			ClientID:   c.clientID,
+			TLS:        c.tlsState,
+			ctx:        ctx,
+			log:        c.logger(),
+			size:       size,
+		})
+	}
+}
+
+// setIdleDeadline 设置等待下一个 frame 首字节的读超时，返回所处的阶段
+func (c *conn) setIdleDeadline() int {
+	if !c.handshakeDone {
+		if c.server.readTimeoutsEnabled() {
+			c.rwc.SetReadDeadline(c.handshakeDeadline)
+		}
+		return phaseHandshake
+	}
+	if c.server.idleTimeout > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(c.server.idleTimeout))
+	} else if c.server.readTimeoutsEnabled() {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
+	return phaseIdle
+}
+
+// setFrameDeadline 设置读取 frame 剩余部分的读超时，返回所处的阶段
+func (c *conn) setFrameDeadline() int {
+	if !c.handshakeDone {
+		// 第一个 frame 受 handshakeTimeout 约束，沿用之前设置的截止时间
+		return phaseHandshake
+	}
+	if c.server.frameTimeout > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(c.server.frameTimeout))
+	} else if c.server.readTimeoutsEnabled() {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
+	return phaseFrame
+}
+
+// readError 记录读错误，超时错误按所处阶段分别计数
+func (c *conn) readError(phase int, err error) {
+	if c.kicked.Load() {
+		// Kick 打断的读操作
+		return
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		if err == io.EOF {
+			c.logger().Debug("conn closed by client")
+		} else {
+			c.logger().Info("frame decode error", "err", err)
+		}
+		return
+	}
+	c.server.readTimedOut(c.logger(), phase)
+}
+
+// readTimedOut 按所处阶段记录读超时
+func (s *Server) readTimedOut(log *slog.Logger, phase int) {
+	switch phase {
+	case phaseHandshake:
+		metrics.HandshakeTimeoutTotal.Inc()
+		log.Info("handshake timeout", "timeout", s.handshakeTimeout)
+	case phaseIdle:
+		metrics.IdleTimeoutTotal.Inc()
+		log.Info("idle timeout", "timeout", s.idleTimeout)
+	case phaseFrame:
+		metrics.FrameTimeoutTotal.Inc()
+		log.Info("frame timeout", "timeout", s.frameTimeout)
+	}
+}
+
+// readTimeout 返回所处阶段的读超时，0 表示不限制
+func (s *Server) readTimeout(phase int) time.Duration {
+	switch phase {
+	case phaseHandshake:
+		return s.handshakeTimeout
+	case phaseIdle:
+		return s.idleTimeout
+	case phaseFrame:
+		return s.frameTimeout
+	}
+	return 0
+}
+
+// writeError 记录写错误，写超时时关闭连接，让阻塞在读操作上的连接 goroutine 也退出
+func (c *conn) writeError(err error) {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return
+	}
+	c.writeTimeoutOnce.Do(func() {
+		metrics.WriteTimeoutTotal.Inc()
+		c.logger().Info("write timeout", "timeout", c.server.writeTimeout)
+		c.rwc.Close()
+	})
+}
+
+// setWriteDeadline 每次可能写入连接之前调用
+func (c *conn) setWriteDeadline() {
+	if c.server.writeTimeout > 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
+	}
+}
+
+// closeIfIdle 由 Shutdown 调用，关闭没有正在处理请求的连接
+func (c *conn) closeIfIdle() {
+	if c.mux.Load() {
+		// 复用连接上的 stream 全部处理完毕后关闭底层连接
+		if c.streams.Load() == 0 && c.state.CompareAndSwap(stateActive, stateClosing) {
+			c.rwc.Close()
+		}
+		return
+	}
+	if c.pending.Load() > 0 {
+		// worker pool 中还有该连接的请求
+		return
+	}
+	if c.state.CompareAndSwap(stateIdle, stateClosing) {
+		// 打断阻塞中的 Peek，连接 goroutine 随后退出
+		c.rwc.SetReadDeadline(time.Now())
+	}
+}
+
+// closeWriteAndWait 半关闭写端并丢弃客户端仍在发送的数据，
+// 避免直接 Close 时因接收缓冲区有未读数据而发送 RST，导致客户端丢失 Disconnect
+func (c *conn) closeWriteAndWait() {
+	closeWriteAndWait(c.rwc, closeLingerTimeout)
+}
+
+func closeWriteAndWait(rwc net.Conn, timeout time.Duration) {
+	cw, ok := rwc.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+	cw.CloseWrite()
+	rwc.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(io.Discard, rwc)
+}
+
+// releasePacket 将 packet.Decode 从对象池取出的对象归还给 Pool 池
+func releasePacket(p packet.Packet) {
+	switch p := p.(type) {
+	case *packet.Submit:
+		packet.SubmitPool.Put(p)
+	case *packet.SubmitAck:
+		packet.SubmitAckPool.Put(p)
+	}
+}
+
+// bufferedConn 包装已被 Peek 过的连接，后续读取先消费 bufio.Reader 中已缓存的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,21 @@
+package server
+
+// StartDrain 开始排空：之后的新连接收到 Disconnect(DisconnectRejected) 后被关闭，
+// 已有的连接不受影响，直到客户端断开或被 Kick。用于把流量从该实例迁走，可以通过 AbortDrain 撤销
+func (s *Server) StartDrain() {
+	if !s.draining.Swap(true) {
+		s.logger.Info("drain started", "sessions", s.sessions.Len())
+	}
+}
+
+// AbortDrain 撤销排空，恢复接受新连接
+func (s *Server) AbortDrain() {
+	if s.draining.Swap(false) {
+		s.logger.Info("drain aborted", "sessions", s.sessions.Len())
+	}
+}
+
+// Draining 是否正在排空
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
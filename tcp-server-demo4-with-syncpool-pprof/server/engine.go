@@ -0,0 +1,33 @@
+package server
+
+import "errors"
+
+// Engine 连接处理模型
+type Engine int
+
+const (
+	// EngineGoroutine 每个连接一个读 goroutine 和一个写 goroutine，各自带读写缓存，支持全部功能
+	EngineGoroutine Engine = iota
+	// EngineEpoll 少量事件循环 goroutine 通过 epoll 处理所有连接，共享读缓存，只在有未处理完的数据时为连接分配内存，
+	// 适合大量空闲连接的场景。仅支持 Linux 上的普通 TCP/unix 连接，
+	// Handler 在事件循环中同步执行，不能阻塞；不支持多路复用、FlushPolicy、Submit 限流、worker pool、内存预算和 PROXY protocol，
+	// Request.Context 不会被取消
+	EngineEpoll
+)
+
+// errEpollUnsupported 当前平台不支持 EngineEpoll
+var errEpollUnsupported = errors.New("server: epoll engine is only supported on linux")
+
+// WithEngine 设置连接处理模型，默认 EngineGoroutine
+func WithEngine(e Engine) Option {
+	return func(s *Server) {
+		s.engine = e
+	}
+}
+
+// WithEventLoops 设置 EngineEpoll 的事件循环数量，默认等于 CPU 核数
+func WithEventLoops(n int) Option {
+	return func(s *Server) {
+		s.eventLoops = n
+	}
+}
@@ -0,0 +1,710 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+)
+
+// EngineEpoll 的实现
+/*
+连接接入
+	Serve 仍然通过 net.Listener 接受连接，之后复制出连接的 fd 交给事件循环，关闭原来的 net.Conn，
+	连接从此不再占用 goroutine 和 bufio 读写缓存
+事件循环
+	每个事件循环一个 epoll 实例，水平触发；连接按 fd 分配给事件循环。
+	可读时用事件循环共享的读缓存读取，切分出完整的 frame 后依次交给 Handler，
+	不完整的 frame 复制到连接自己的 in 中，下次读取时拼接；没有设置 maxFrameSize 时 frame 长度按 epollMaxFrameSize 限制。
+	不支持复用连接，首字节为 mux.Magic 的连接直接关闭
+写出
+	Handler 的响应追加到连接的 out 中，本轮数据处理完后一次性写出；写不完时注册 EPOLLOUT，
+	待发送数据超过 epollOutboundHighWater 时暂停读取该连接。
+	在事件循环之外(异步)调用 Write 时直接尝试写出
+超时
+	连接的读写截止时间由事件循环维护，读超时的阶段划分与 EngineGoroutine 相同；写超时从 out 开始等待写出算起，
+	每次写出部分数据后重新计时。启用任一超时后 EpollWait 不再无限阻塞，事件循环按 sweepInterval 定期检查并关闭超时的连接，
+	因此实际关闭时间最多比超时晚一个检查间隔
+*/
+
+const (
+	epollReadBufferSize    = 64 << 10 // 每个事件循环共享的读缓存大小
+	epollMaxEvents         = 256      // 每次 EpollWait 最多返回的事件数
+	epollOutboundHighWater = 1 << 20  // 待发送数据超过该值时暂停读取
+	epollMaxFrameSize      = 16 << 20 // 没有设置 maxFrameSize 时单个 frame 的最大长度，限制 in 的大小
+
+	epollMinSweepInterval = 10 * time.Millisecond // 检查超时的最短间隔
+	epollMaxSweepInterval = time.Second           // 检查超时的最长间隔
+)
+
+var errNotSyscallConn = errors.New("server: connection does not expose a file descriptor")
+
+type epollEngine struct {
+	server *Server
+	loops  []*eventLoop
+	wg     sync.WaitGroup
+	done   atomic.Bool // 所有事件循环都已退出
+	once   sync.Once
+}
+
+// eventLoop 一个事件循环 goroutine
+type eventLoop struct {
+	engine *epollEngine
+	epfd   int
+	wakeR  int // 唤醒用的管道，Shutdown 时写入
+	wakeW  int
+
+	mu      sync.Mutex
+	conns   map[int]*epollConn
+	closing bool
+
+	buf     []byte       // 共享的读缓存
+	expired []*epollConn // 本次检查中超时的连接，复用底层数组
+}
+
+// epollConn 事件循环管理的一个连接，实现 ResponseWriter
+type epollConn struct {
+	loop          *eventLoop
+	id            uint64
+	fd            int
+	ip            string
+	listenerConns prometheus.Gauge // 接受该连接的 listener 的连接数
+	remoteAddr    net.Addr
+	clientID      string
+	logBase       *slog.Logger // 带有 conn_id 和 remote 的日志
+	log           *slog.Logger // 在 logBase 的基础上带有 client_id
+	in            []byte       // 不完整的 frame，没有时为 nil，只在事件循环中访问
+	session       *session.Session
+	handshakeDone bool      // 已收到第一个完整的 frame，只在事件循环中访问
+	readPhase     int       // 读超时所处的阶段，只在事件循环中访问
+	readDeadline  time.Time // 读超时的截止时间，零值表示不限制，只在事件循环中访问
+	writeClosed   bool      // Shutdown 时已关闭写端，只在事件循环中访问
+
+	mu            sync.Mutex
+	out           []byte // 待发送的数据，没有时为 nil
+	events        uint32 // 当前注册的事件
+	inLoop        bool   // 事件循环正在处理该连接的数据，Write 只追加不写出
+	draining      bool   // 客户端已关闭写端，写完 out 后关闭连接
+	closed        bool
+	writeDeadline time.Time // out 写出的截止时间，没有待发送的数据时为零值
+}
+
+func newEpollEngine(s *Server, loops int) (*epollEngine, error) {
+	e := &epollEngine{server: s}
+	for i := 0; i < loops; i++ {
+		l, err := newEventLoop(e)
+		if err != nil {
+			for _, l := range e.loops {
+				l.closeFds()
+			}
+			return nil, err
+		}
+		e.loops = append(e.loops, l)
+	}
+	e.wg.Add(len(e.loops))
+	for _, l := range e.loops {
+		go l.run()
+	}
+	go func() {
+		e.wg.Wait()
+		e.done.Store(true)
+	}()
+	return e, nil
+}
+
+func newEventLoop(e *epollEngine) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	l := &eventLoop{
+		engine: e,
+		epfd:   epfd,
+		wakeR:  p[0],
+		wakeW:  p[1],
+		conns:  make(map[int]*epollConn),
+		buf:    make([]byte, epollReadBufferSize),
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wakeR, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wakeR)}); err != nil {
+		l.closeFds()
+		return nil, err
+	}
+	return l, nil
+}
+
+// register 接管 Serve 接受的连接：复制 fd 后关闭 rwc
+func (e *epollEngine) register(rwc net.Conn, ip string, listenerConns prometheus.Gauge) error {
+	remoteAddr := rwc.RemoteAddr()
+	fd, err := dupFd(rwc)
+	rwc.Close()
+	if err != nil {
+		return err
+	}
+
+	l := e.loops[fd%len(e.loops)]
+	c := &epollConn{
+		loop:          l,
+		id:            e.server.nextConnID.Add(1),
+		fd:            fd,
+		ip:            ip,
+		listenerConns: listenerConns,
+		remoteAddr:    remoteAddr,
+		events:        syscall.EPOLLIN | syscall.EPOLLRDHUP,
+	}
+	c.logBase = e.server.logger.With("conn_id", c.id, "remote", remoteAddr.String())
+	c.log = c.logBase.With("client_id", "")
+	c.session = session.New(c.id, remoteAddr, c)
+	c.setReadPhase(phaseHandshake, time.Now())
+	l.mu.Lock()
+	if l.closing {
+		l.mu.Unlock()
+		syscall.Close(fd)
+		return ErrServerClosed
+	}
+	l.conns[fd] = c
+	l.mu.Unlock()
+
+	metrics.ClientConnected.Inc()
+	e.server.sessions.Add(c.session)
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: c.events, Fd: int32(fd)}); err != nil {
+		l.mu.Lock()
+		delete(l.conns, fd)
+		l.mu.Unlock()
+		e.server.sessions.Remove(c.session)
+		metrics.ClientConnected.Dec()
+		syscall.Close(fd)
+		return err
+	}
+	return nil
+}
+
+// dupFd 复制连接的 fd，复制出的 fd 为非阻塞、close-on-exec
+func dupFd(rwc net.Conn) (int, error) {
+	sc, ok := rwc.(syscall.Conn)
+	if !ok {
+		return -1, errNotSyscallConn
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(f uintptr) {
+		fd, dupErr = syscall.Dup(int(f))
+	}); err != nil {
+		return -1, err
+	}
+	if dupErr != nil {
+		return -1, dupErr
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// shutdown 通知所有事件循环向连接发送 Disconnect 后关闭连接并退出
+func (e *epollEngine) shutdown() {
+	e.once.Do(func() {
+		for _, l := range e.loops {
+			l.mu.Lock()
+			l.closing = true
+			l.mu.Unlock()
+			syscall.Write(l.wakeW, []byte{1})
+		}
+	})
+}
+
+// stopped 所有事件循环是否都已退出
+func (e *epollEngine) stopped() bool {
+	return e.done.Load()
+}
+
+func (l *eventLoop) run() {
+	defer l.engine.wg.Done()
+	defer l.closeFds()
+
+	events := make([]syscall.EpollEvent, epollMaxEvents)
+	interval := sweepInterval(l.engine.server)
+	nextSweep := time.Now().Add(interval)
+	for {
+		// 启用超时后最多等到下一次检查
+		timeout := -1
+		if interval > 0 {
+			timeout = max(int(time.Until(nextSweep)/time.Millisecond), 0)
+		}
+		n, err := l.wait(events, timeout)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			l.engine.server.logger.Error("eventLoop: epoll wait error", "err", err)
+			l.closeAll()
+			return
+		}
+		for i := 0; i < n; i++ {
+			ev := events[i]
+			fd := int(ev.Fd)
+			if fd == l.wakeR {
+				if l.isClosing() {
+					l.closeAll()
+					return
+				}
+				continue
+			}
+			l.mu.Lock()
+			c := l.conns[fd]
+			l.mu.Unlock()
+			if c == nil {
+				continue
+			}
+			if ev.Events&syscall.EPOLLOUT != 0 && !c.writeOut() {
+				l.closeConn(c)
+				continue
+			}
+			if ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && !l.read(c) {
+				l.closeConn(c)
+			}
+		}
+		if now := time.Now(); interval > 0 && !now.Before(nextSweep) {
+			l.sweep(now)
+			nextSweep = now.Add(interval)
+		}
+	}
+}
+
+// wait 等待事件，最多阻塞 timeout 毫秒，-1 表示不限制
+func (l *eventLoop) wait(events []syscall.EpollEvent, timeout int) (int, error) {
+	return syscall.EpollWait(l.epfd, events, timeout)
+}
+
+// sweepInterval 事件循环检查超时的间隔：启用的超时中最短的 1/10，限制在
+// [epollMinSweepInterval, epollMaxSweepInterval] 之间；没有启用任何超时时返回 0
+func sweepInterval(s *Server) time.Duration {
+	var shortest time.Duration
+	for _, d := range []time.Duration{s.handshakeTimeout, s.idleTimeout, s.frameTimeout, s.writeTimeout} {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	return min(max(shortest/10, epollMinSweepInterval), epollMaxSweepInterval)
+}
+
+// sweep 关闭读写超时的连接，只在事件循环中调用
+func (l *eventLoop) sweep(now time.Time) {
+	l.mu.Lock()
+	for _, c := range l.conns {
+		if c.timedOut(now) {
+			l.expired = append(l.expired, c)
+		}
+	}
+	l.mu.Unlock()
+	for i, c := range l.expired {
+		l.closeConn(c)
+		l.expired[i] = nil
+	}
+	l.expired = l.expired[:0]
+}
+
+func (l *eventLoop) isClosing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closing
+}
+
+// read 读取并处理连接上的数据，返回 false 时关闭连接
+func (l *eventLoop) read(c *epollConn) bool {
+	n, err := syscall.Read(c.fd, l.buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return true
+	}
+	if err != nil || n == 0 {
+		// 客户端关闭了写端，写完剩余的响应后关闭连接
+		return c.drain()
+	}
+
+	data := l.buf[:n]
+	if c.in != nil {
+		c.in = append(c.in, data...)
+		data = c.in
+	}
+
+	c.mu.Lock()
+	c.inLoop = true
+	c.mu.Unlock()
+	consumed, ok := l.handleFrames(c, data)
+	if ok {
+		if rest := data[consumed:]; len(rest) > 0 {
+			// 复制到新的切片，不保留大 frame 的底层数组
+			c.in = append([]byte(nil), rest...)
+		} else {
+			c.in = nil
+		}
+		c.updateReadDeadline(consumed > 0)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inLoop = false
+	return c.flushLocked() && ok
+}
+
+// handleFrames 依次处理 data 中完整的 frame，返回处理掉的字节数
+func (l *eventLoop) handleFrames(c *epollConn, data []byte) (consumed int, ok bool) {
+	s := l.engine.server
+	maxFrameSize := s.maxFrameSize
+	if maxFrameSize <= 0 {
+		// 不完整的 frame 要整个缓存在 in 中，不能不限制
+		maxFrameSize = epollMaxFrameSize
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			c.log.Error("eventLoop: recover panic and close conn", "panic", err)
+			ok = false
+		}
+	}()
+	if !c.handshakeDone && len(data) > 0 && data[0] == mux.Magic {
+		// 复用连接只由 EngineGoroutine 处理
+		c.log.Warn("eventLoop: multiplexed connection is not supported, close conn")
+		return 0, false
+	}
+	for {
+		framePayload, n, err := frame.Split(data[consumed:], maxFrameSize)
+		if err != nil {
+			c.log.Info("eventLoop: frame decode error", "err", err)
+			return consumed, false
+		}
+		if n == 0 {
+			return consumed, true
+		}
+		consumed += n
+		metrics.ReqRecvTotal.Add(1)
+		c.session.RecordIn(len(framePayload))
+
+		if len(framePayload) == 0 {
+			c.log.Info("eventLoop: empty frame")
+			return consumed, false
+		}
+		p, err := packet.Decode(framePayload)
+		if err != nil {
+			c.log.Warn("eventLoop: packet decode error", "err", err)
+			return consumed, false
+		}
+		if p == nil {
+			continue
+		}
+		// 热点路径上的 debug 日志，由 Logger 的 Handler 采样
+		if c.log.Enabled(context.Background(), slog.LevelDebug) {
+			c.log.Debug("packet received", "packet", packet.Name(p), "size", len(framePayload))
+		}
+		if conn, ok := p.(*packet.Conn); ok {
+			c.clientID = conn.ClientID
+			c.log = c.logBase.With("client_id", c.clientID)
+			s.sessions.SetClientID(c.session, c.clientID)
+		}
+		s.handler.ServePacket(c, &Request{
+			Packet:     p,
+			RemoteAddr: c.remoteAddr,
+			ClientID:   c.clientID,
+			log:        c.log,
+		})
+		releasePacket(p)
+	}
+}
+
+// closeConn 关闭连接并归还连接名额，只在事件循环中调用
+func (l *eventLoop) closeConn(c *epollConn) {
+	l.mu.Lock()
+	delete(l.conns, c.fd)
+	l.mu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.out = nil
+	c.mu.Unlock()
+
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	syscall.Close(c.fd)
+	c.in = nil
+	l.engine.server.sessions.Remove(c.session)
+	l.engine.server.connClosed(c.ip, c.listenerConns)
+	metrics.ClientConnected.Dec()
+}
+
+// closeAll Shutdown 时向所有连接发送 Disconnect，写完后关闭写端，并读出丢弃客户端发来的数据，
+// 直到客户端关闭连接或超过 closeLingerTimeout 后关闭。
+// 接收缓冲区中有未读数据时 close 会发出 RST，客户端可能收不到 Disconnect
+func (l *eventLoop) closeAll() {
+	l.mu.Lock()
+	conns := make([]*epollConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.Write(&packet.Disconnect{Code: packet.DisconnectShutdown, Reason: "server shutting down"})
+	}
+
+	events := make([]syscall.EpollEvent, epollMaxEvents)
+	deadline := time.Now().Add(closeLingerTimeout)
+	for len(conns) > 0 {
+		pending := conns[:0]
+		for _, c := range conns {
+			if l.linger(c, deadline) {
+				pending = append(pending, c)
+			} else {
+				l.closeConn(c)
+			}
+		}
+		conns = pending
+		remaining := time.Until(deadline)
+		if len(conns) == 0 || remaining <= 0 {
+			break
+		}
+		// 连接不再关注可读事件，这里只是短暂等待客户端读取或关闭
+		l.wait(events, max(int(min(remaining, epollMinSweepInterval)/time.Millisecond), 1))
+	}
+	for _, c := range conns {
+		l.closeConn(c)
+	}
+}
+
+// linger 写出 out 后关闭写端，读出并丢弃客户端发来的数据，返回 false 表示可以关闭连接
+func (l *eventLoop) linger(c *epollConn, deadline time.Time) bool {
+	c.mu.Lock()
+	c.draining = true
+	ok := c.flushLocked()
+	writing := len(c.out) > 0
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if writing {
+		return true
+	}
+	if !c.writeClosed {
+		syscall.Shutdown(c.fd, syscall.SHUT_WR)
+		c.writeClosed = true
+	}
+	for time.Now().Before(deadline) {
+		n, err := syscall.Read(c.fd, l.buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return true
+		}
+		if err != nil || n == 0 {
+			return false
+		}
+	}
+	return false
+}
+
+func (l *eventLoop) closeFds() {
+	syscall.Close(l.epfd)
+	syscall.Close(l.wakeR)
+	syscall.Close(l.wakeW)
+}
+
+// setReadPhase 进入读超时的 phase 阶段，按该阶段的超时从 now 开始计时，只在事件循环中调用
+func (c *epollConn) setReadPhase(phase int, now time.Time) {
+	c.readPhase = phase
+	if d := c.loop.engine.server.readTimeout(phase); d > 0 {
+		c.readDeadline = now.Add(d)
+	} else {
+		c.readDeadline = time.Time{}
+	}
+}
+
+// updateReadDeadline 处理完读到的数据后更新读超时，framed 表示本次处理了至少一个完整的 frame。
+// 第一个 frame 受 handshakeTimeout 约束；之后没有剩余数据时等待下一个 frame，
+// 有不完整的 frame 时从它的首字节开始按 frameTimeout 计时
+func (c *epollConn) updateReadDeadline(framed bool) {
+	if framed {
+		c.handshakeDone = true
+	}
+	if !c.handshakeDone {
+		return
+	}
+	now := time.Now()
+	if c.in == nil {
+		c.setReadPhase(phaseIdle, now)
+	} else if framed || c.readPhase != phaseFrame {
+		c.setReadPhase(phaseFrame, now)
+	}
+}
+
+// timedOut 检查连接是否超时，超时时记录日志和指标，由调用方关闭连接；只在事件循环中调用
+func (c *epollConn) timedOut(now time.Time) bool {
+	s := c.loop.engine.server
+	c.mu.Lock()
+	draining, writeDeadline := c.draining, c.writeDeadline
+	reading := c.events&syscall.EPOLLIN != 0
+	c.mu.Unlock()
+	if !writeDeadline.IsZero() && now.After(writeDeadline) {
+		metrics.WriteTimeoutTotal.Inc()
+		c.log.Info("write timeout", "timeout", s.writeTimeout)
+		return true
+	}
+	if draining || c.readDeadline.IsZero() {
+		return false
+	}
+	if !reading && c.readPhase != phaseHandshake {
+		// 待发送数据过多而暂停读取，等待期间由写超时约束，恢复读取后重新计时
+		c.setReadPhase(c.readPhase, now)
+		return false
+	}
+	if now.After(c.readDeadline) {
+		s.readTimedOut(c.log, c.readPhase)
+		return true
+	}
+	return false
+}
+
+// Write 实现 ResponseWriter 接口，可以在任意 goroutine 中调用
+func (c *epollConn) Write(p packet.Packet) error {
+	return c.write(p, false)
+}
+
+// TryWrite 实现 session.Conn 接口，待发送数据超过 epollOutboundHighWater 时返回 errOutboundFull
+func (c *epollConn) TryWrite(p packet.Packet) error {
+	return c.write(p, true)
+}
+
+// write 把 packet 追加到 out 中，bounded 为 true 时 out 超过高水位则放弃
+func (c *epollConn) write(p packet.Packet, bounded bool) error {
+	framePayload, err := packet.Encode(p)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.draining {
+		return ErrConnClosed
+	}
+	if bounded && len(c.out) >= epollOutboundHighWater {
+		return errOutboundFull
+	}
+	c.out = frame.AppendFrame(c.out, framePayload)
+	metrics.RspSendTotal.Add(1) // 返回响应后，RspSendTotal 消息计数器 +1
+	c.session.RecordOut(len(framePayload))
+	if !c.inLoop && c.events&syscall.EPOLLOUT == 0 && !c.flushLocked() {
+		// 异步写出失败，由事件循环关闭连接
+		syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// Kick 实现 session.Conn 接口，可以在任意 goroutine 中调用：发送 Disconnect 后不再读取，
+// 写完 out 后关闭连接
+func (c *epollConn) Kick(reason string) {
+	c.Write(&packet.Disconnect{Code: packet.DisconnectKicked, Reason: reason})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.draining {
+		return
+	}
+	// c.log 只在事件循环中访问
+	c.logBase.Info("conn kicked", "client_id", c.session.ClientID(), "reason", reason)
+	c.draining = true
+	if !c.flushLocked() || len(c.out) == 0 {
+		// 不再关注可读事件，由 shutdown 触发的 EPOLLHUP 让事件循环关闭连接
+		syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	}
+}
+
+// writeOut 可写时继续写出 out
+func (c *epollConn) writeOut() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.flushLocked() {
+		return false
+	}
+	return !c.draining || len(c.out) > 0
+}
+
+// drain 客户端关闭写端后调用，out 为空时返回 false 立即关闭连接，否则等待写完
+func (c *epollConn) drain() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	return c.flushLocked() && len(c.out) > 0
+}
+
+// flushLocked 尽量写出 out，写不完时注册 EPOLLOUT，返回 false 表示连接出错
+func (c *epollConn) flushLocked() bool {
+	if c.closed {
+		return false
+	}
+	progressed := false
+	for len(c.out) > 0 {
+		n, err := syscall.Write(c.fd, c.out)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil {
+			return false
+		}
+		c.out = c.out[n:]
+		progressed = progressed || n > 0
+	}
+	if len(c.out) == 0 {
+		c.out = nil
+		c.writeDeadline = time.Time{}
+	} else if d := c.loop.engine.server.writeTimeout; d > 0 && (progressed || c.writeDeadline.IsZero()) {
+		// 写出部分数据后重新计时
+		c.writeDeadline = time.Now().Add(d)
+	}
+
+	// 客户端关闭写端后不再关注可读事件，否则水平触发的 EPOLLRDHUP 会一直触发
+	var events uint32
+	if !c.draining {
+		events |= syscall.EPOLLRDHUP
+		if len(c.out) < epollOutboundHighWater {
+			events |= syscall.EPOLLIN
+		}
+	}
+	if len(c.out) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	if events != c.events {
+		c.events = events
+		if err := syscall.EpollCtl(c.loop.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{Events: events, Fd: int32(c.fd)}); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,316 @@
+//go:build linux
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+var epollOpts = []Option{WithEngine(EngineEpoll), WithEventLoops(2)}
+
+func TestEpoll_SubmitAck(t *testing.T) {
+	_, addr := startServer(t, ackHandler, epollOpts...)
+	c := dialClient(t, addr, "")
+
+	for i := 0; i < 100; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	// 半关闭写端后仍然能收到全部响应
+	c.(*net.TCPConn).CloseWrite()
+	for i := 0; i < 100; i++ {
+		if ack, want := readSubmitAck(t, c), fmt.Sprintf("%08d", i); ack.ID != want {
+			t.Fatalf("want %s,actual %s", want, ack.ID)
+		}
+	}
+}
+
+func TestEpoll_Sessions(t *testing.T) {
+	testSessions(t, epollOpts...)
+}
+
+func TestEpoll_HandshakeTimeout(t *testing.T) {
+	testHandshakeTimeout(t, epollOpts...)
+}
+
+func TestEpoll_IdleTimeout(t *testing.T) {
+	testIdleTimeout(t, epollOpts...)
+}
+
+func TestEpoll_FrameTimeout(t *testing.T) {
+	testFrameTimeout(t, epollOpts...)
+}
+
+func TestEpoll_WriteTimeout(t *testing.T) {
+	testWriteTimeout(t, epollOpts...)
+}
+
+func TestEpoll_PartialFrame(t *testing.T) {
+	_, addr := startServer(t, ackHandler, epollOpts...)
+	c := dialClient(t, addr, "")
+
+	framePayload, _ := packet.Encode(&packet.Submit{ID: "00000001", Payload: []byte("hello")})
+	data := frame.AppendFrame(nil, framePayload)
+	// 逐字节发送，frame 被拆分到多次读取中
+	for _, b := range data {
+		c.Write([]byte{b})
+		time.Sleep(time.Millisecond)
+	}
+	if ack := readSubmitAck(t, c); ack.ID != "00000001" {
+		t.Errorf("want 00000001,actual %s", ack.ID)
+	}
+}
+
+func TestEpoll_AsyncReply(t *testing.T) {
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		id := r.Packet.(*packet.Submit).ID
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			w.Write(&packet.SubmitAck{ID: id})
+		}()
+	})
+	_, addr := startServer(t, h, epollOpts...)
+	c := dialClient(t, addr, "")
+	writeSubmit(t, c, "00000001")
+	if ack := readSubmitAck(t, c); ack.ID != "00000001" {
+		t.Errorf("want 00000001,actual %s", ack.ID)
+	}
+}
+
+func TestEpoll_InvalidFrame(t *testing.T) {
+	_, addr := startServer(t, ackHandler, append(epollOpts, WithMaxFrameSize(64))...)
+	c := dialClient(t, addr, "")
+	// 超长的 frame 导致连接被关闭
+	c.Write([]byte{0x0, 0x0, 0x10, 0x0})
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestEpoll_MaxConns(t *testing.T) {
+	_, addr := startServer(t, ackHandler, append(epollOpts, WithMaxConns(1))...)
+	c := dialAndAck(t, addr)
+	expectRejected(t, addr)
+
+	// 连接关闭后名额被归还
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+	dialAndAck(t, addr)
+}
+
+func TestEpoll_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler, epollOpts...)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+	c := dialAndAck(t, l.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("want ErrServerClosed,actual %v", err)
+	}
+	d, ok := readPacket(t, c).(*packet.Disconnect)
+	if !ok || d.Code != packet.DisconnectShutdown {
+		t.Errorf("want shutdown disconnect,actual %v", d)
+	}
+}
+
+func TestEpoll_ShutdownUnreadData(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler, epollOpts...)
+	go srv.Serve(l)
+	c := dialAndAck(t, l.Addr().String())
+
+	// 客户端一次写入大量 Submit，Shutdown 时服务端的接收缓冲区中还有未读的数据
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 4<<20; i++ {
+		framePayload, err := packet.Encode(&packet.Submit{ID: fmt.Sprintf("%08d", i), Payload: []byte("hello")})
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		if err = frame.NewMyFrameCodec().Encode(&buf, framePayload); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+	}
+	go c.Write(buf.Bytes())
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	// 未读的数据不会让服务端发出 RST，客户端能读到 Disconnect
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	codec := frame.NewMyFrameCodec()
+	for {
+		framePayload, err := codec.Decode(c)
+		if err != nil {
+			t.Fatalf("want shutdown disconnect,actual %s", err.Error())
+		}
+		p, err := packet.Decode(framePayload)
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		if d, ok := p.(*packet.Disconnect); ok {
+			if d.Code != packet.DisconnectShutdown {
+				t.Errorf("want %d,actual %d", packet.DisconnectShutdown, d.Code)
+			}
+			return
+		}
+	}
+}
+
+var benchEngines = []struct {
+	name string
+	opts []Option
+}{
+	{"Goroutine", nil},
+	{"Epoll", []Option{WithEngine(EngineEpoll)}},
+}
+
+func startEngineServer(b *testing.B, opts []Option) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler, opts...)
+	go srv.Serve(l)
+	b.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return l.Addr().String()
+}
+
+// BenchmarkEngine_IdleConns 建立 b.N 个完成一次请求后保持空闲的连接，衡量每个连接占用的内存(含客户端连接)
+func BenchmarkEngine_IdleConns(b *testing.B) {
+	for _, be := range benchEngines {
+		b.Run(be.name, func(b *testing.B) {
+			addr := startEngineServer(b, be.opts)
+			req := encodeSubmitFrame(b, "00000001")
+			conns := make([]net.Conn, 0, b.N)
+			b.Cleanup(func() {
+				for _, c := range conns {
+					c.Close()
+				}
+			})
+
+			runtime.GC()
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conns = append(conns, c)
+				c.Write(req)
+				if _, err := frame.NewMyFrameCodec().Decode(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			runtime.GC()
+			var after runtime.MemStats
+			runtime.ReadMemStats(&after)
+			inuse := func(m *runtime.MemStats) float64 { return float64(m.HeapInuse + m.StackInuse) }
+			b.ReportMetric((inuse(&after)-inuse(&before))/float64(b.N), "bytes/conn")
+		})
+	}
+}
+
+// BenchmarkEngine_Pipelined 64*GOMAXPROCS 个连接并发持续发送请求，衡量吞吐量
+func BenchmarkEngine_Pipelined(b *testing.B) {
+	for _, be := range benchEngines {
+		b.Run(be.name, func(b *testing.B) {
+			addr := startEngineServer(b, be.opts)
+			req := encodeSubmitFrame(b, "00000001")
+
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+
+				// 每批发送 16 个请求后读取 16 个响应
+				const batch = 16
+				reqs := make([]byte, 0, len(req)*batch)
+				for i := 0; i < batch; i++ {
+					reqs = append(reqs, req...)
+				}
+				rbuf := bufio.NewReader(c)
+				codec := frame.NewMyFrameCodec()
+				for pb.Next() {
+					if _, err := c.Write(reqs); err != nil {
+						b.Error(err)
+						return
+					}
+					for i := 0; i < batch; i++ {
+						if _, err := codec.Decode(rbuf); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}
+			})
+			b.ReportMetric(16, "reqs/op")
+		})
+	}
+}
+
+func TestEpoll_DefaultMaxFrameSize(t *testing.T) {
+	_, addr := startServer(t, ackHandler, epollOpts...)
+
+	// 没有设置 MaxFrameSize 时按 epollMaxFrameSize 限制，超长的 frame 不会一直缓存
+	c := dialClient(t, addr, "")
+	c.Write([]byte{0x7f, 0xff, 0xff, 0xff})
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want EOF,actual %v", err)
+	}
+	dialAndAck(t, addr)
+}
+
+func TestEpoll_MuxRejected(t *testing.T) {
+	_, addr := startServer(t, ackHandler, epollOpts...)
+
+	// 不支持复用连接，首字节为 mux.Magic 的连接被直接关闭
+	c := dialClient(t, addr, "")
+	c.Write([]byte{mux.Magic, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want EOF,actual %v", err)
+	}
+	dialAndAck(t, addr)
+}
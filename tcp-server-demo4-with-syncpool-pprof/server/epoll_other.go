@@ -0,0 +1,25 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type epollEngine struct{}
+
+func newEpollEngine(s *Server, loops int) (*epollEngine, error) {
+	return nil, errEpollUnsupported
+}
+
+func (e *epollEngine) register(rwc net.Conn, ip string, listenerConns prometheus.Gauge) error {
+	return errEpollUnsupported
+}
+
+func (e *epollEngine) shutdown() {}
+
+func (e *epollEngine) stopped() bool {
+	return true
+}
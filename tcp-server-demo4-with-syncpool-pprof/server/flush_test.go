@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func TestServer_FlushPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy FlushPolicy
+	}{
+		{"OnIdle", FlushPolicy{OnIdle: true}},
+		{"Interval", FlushPolicy{Interval: 10 * time.Millisecond}},
+		{"Bytes", FlushPolicy{Bytes: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, ackHandler, WithFlushPolicy(tt.policy))
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			defer c.Close()
+
+			// 请求/响应式客户端：发送一个 submit 后等待 ack，不关闭连接
+			for i := 0; i < 3; i++ {
+				id := fmt.Sprintf("%08d", i)
+				writeSubmit(t, c, id)
+				if ack := readSubmitAck(t, c); ack.ID != id {
+					t.Errorf("want %s,actual %s", id, ack.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_FlushPolicyDisabled(t *testing.T) {
+	_, addr := startServer(t, ackHandler, WithFlushPolicy(FlushPolicy{}))
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+
+	// 不启用任何刷新条件时，响应停留在写缓存中
+	writeSubmit(t, c, "00000001")
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := frame.NewMyFrameCodec().Decode(c); err == nil {
+		t.Errorf("want timeout,actual nil")
+	}
+}
+
+// countingListener 统计服务端连接上 Write 系统调用的次数
+type countingListener struct {
+	net.Listener
+	writes *atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c, writes: l.writes}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+var benchPolicies = []struct {
+	name   string
+	policy FlushPolicy
+}{
+	{"OnIdle", FlushPolicy{OnIdle: true}},
+	{"Interval=1ms", FlushPolicy{Interval: time.Millisecond}},
+	{"Bytes=4096+Interval=1ms", FlushPolicy{Bytes: 4096, Interval: time.Millisecond}},
+	{"Bytes=1", FlushPolicy{Bytes: 1}},
+}
+
+func startBenchServer(b *testing.B, policy FlushPolicy) (net.Conn, *atomic.Int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("want nil,actual %s", err.Error())
+	}
+	writes := &atomic.Int64{}
+	srv := New(ackHandler, WithFlushPolicy(policy))
+	go srv.Serve(&countingListener{Listener: l, writes: writes})
+	b.Cleanup(func() {
+		srv.closeConns()
+		l.Close()
+	})
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("want nil,actual %s", err.Error())
+	}
+	b.Cleanup(func() { c.Close() })
+	return c, writes
+}
+
+func encodeSubmitFrame(b *testing.B, id string) []byte {
+	framePayload, err := packet.Encode(&packet.Submit{ID: id, Payload: []byte("hello gopher")})
+	if err != nil {
+		b.Fatalf("want nil,actual %s", err.Error())
+	}
+	w := &frameBuffer{}
+	frame.NewMyFrameCodec().Encode(w, framePayload)
+	return w.b
+}
+
+type frameBuffer struct{ b []byte }
+
+func (f *frameBuffer) Write(p []byte) (int, error) {
+	f.b = append(f.b, p...)
+	return len(p), nil
+}
+
+// BenchmarkFlushPolicy_RequestResponse 客户端发送一个请求后等待响应，衡量每种策略的往返延迟
+func BenchmarkFlushPolicy_RequestResponse(b *testing.B) {
+	for _, bp := range benchPolicies {
+		b.Run(bp.name, func(b *testing.B) {
+			c, writes := startBenchServer(b, bp.policy)
+			req := encodeSubmitFrame(b, "00000001")
+			codec := frame.NewMyFrameCodec()
+			rbuf := bufio.NewReader(c)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(req); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Decode(rbuf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// BenchmarkFlushPolicy_Pipelined 客户端持续发送请求，不等待响应，衡量每种策略的吞吐量和系统调用次数
+func BenchmarkFlushPolicy_Pipelined(b *testing.B) {
+	for _, bp := range benchPolicies {
+		b.Run(bp.name, func(b *testing.B) {
+			c, writes := startBenchServer(b, bp.policy)
+			req := encodeSubmitFrame(b, "00000001")
+			codec := frame.NewMyFrameCodec()
+
+			done := make(chan error, 1)
+			go func() {
+				rbuf := bufio.NewReader(c)
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.Decode(rbuf); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			b.ResetTimer()
+			wbuf := bufio.NewWriter(c)
+			for i := 0; i < b.N; i++ {
+				if _, err := wbuf.Write(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wbuf.Flush()
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
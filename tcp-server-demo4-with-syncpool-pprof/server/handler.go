@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// Handler 处理连接上收到的每一个 packet，通过 ResponseWriter 向客户端写回响应
+//
+// ServePacket 返回后 Request.Packet 会被归还给对象池，Handler 不能在返回后继续持有它；
+// ResponseWriter 则可以在返回后、在其他 goroutine 中继续使用，用于异步、乱序回复或主动推送
+type Handler interface {
+	ServePacket(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc 让普通函数可以作为 Handler 使用
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServePacket 调用 f(w, r)
+func (f HandlerFunc) ServePacket(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// ResponseWriter 向连接写回 packet，可以在多个 goroutine 中并发使用
+type ResponseWriter interface {
+	// Write 编码 packet 并放入连接的出站队列，调用返回后 p 可以被复用。
+	// 出站队列满时阻塞，连接关闭后返回 ErrConnClosed
+	Write(p packet.Packet) error
+}
+
+// Request 一个已解码的请求
+type Request struct {
+	Packet     packet.Packet        // 解码后的 packet
+	RemoteAddr net.Addr             // 客户端地址
+	ClientID   string               // 客户端标识：双向 TLS 时来自客户端证书，否则来自 Conn 包，客户端未发送 Conn 时为空
+	TLS        *tls.ConnectionState // TLS 连接的状态，非 TLS 连接为 nil
+
+	ctx  context.Context
+	log  *slog.Logger
+	size int64 // 请求 frame 的字节数，处理完后归还内存预算
+}
+
+// Context 返回请求的上下文，连接关闭时被取消
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// Logger 返回连接的日志，带有 conn_id、remote 和 client_id
+func (r *Request) Logger() *slog.Logger {
+	if r.log != nil {
+		return r.log
+	}
+	return slog.Default()
+}
+
+// WithContext 返回上下文替换为 ctx 的浅拷贝，供 Interceptor 设置超时等
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
@@ -0,0 +1,30 @@
+package server
+
+// Interceptor 包装 Handler 的调用，用于日志、metrics、recover、认证等横切逻辑，类似 gRPC 的拦截器。
+// Interceptor 调用 next.ServePacket(w, r) 把请求交给下一个 Interceptor 或最终的 Handler，
+// 不调用时请求不再被处理
+type Interceptor func(w ResponseWriter, r *Request, next Handler)
+
+// WithInterceptors 追加 Interceptor，第一个 Interceptor 在最外层，最先看到请求
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// Chain 用 interceptors 包装 h，返回的 Handler 依次经过每个 Interceptor 后调用 h
+func Chain(h Handler, interceptors ...Interceptor) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		h = intercepted{interceptor: interceptors[i], next: h}
+	}
+	return h
+}
+
+type intercepted struct {
+	interceptor Interceptor
+	next        Handler
+}
+
+func (h intercepted) ServePacket(w ResponseWriter, r *Request) {
+	h.interceptor(w, r, h.next)
+}
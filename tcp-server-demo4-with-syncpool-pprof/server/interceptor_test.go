@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func TestChain_Order(t *testing.T) {
+	var calls []string
+	trace := func(name string) Interceptor {
+		return func(w ResponseWriter, r *Request, next Handler) {
+			calls = append(calls, name+">")
+			next.ServePacket(w, r)
+			calls = append(calls, "<"+name)
+		}
+	}
+	h := Chain(HandlerFunc(func(w ResponseWriter, r *Request) {
+		calls = append(calls, "handler")
+	}), trace("a"), trace("b"))
+	h.ServePacket(nil, &Request{})
+
+	want := "a> b> handler <b <a"
+	if actual := strings.Join(calls, " "); actual != want {
+		t.Errorf("want %s,actual %s", want, actual)
+	}
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	// 拦截 ID 为 00000002 的 Submit，回复错误响应，不交给 Handler
+	reject := func(w ResponseWriter, r *Request, next Handler) {
+		if s, ok := r.Packet.(*packet.Submit); ok && s.ID == "00000002" {
+			w.Write(&packet.SubmitAck{ID: s.ID, Result: packet.ResultError})
+			return
+		}
+		next.ServePacket(w, r)
+	}
+	_, addr := startServer(t, ackHandler, WithInterceptors(reject))
+	c := dialClient(t, addr, "")
+	for _, tt := range []struct {
+		id   string
+		want uint8
+	}{
+		{"00000001", packet.ResultOK},
+		{"00000002", packet.ResultError},
+		{"00000003", packet.ResultOK},
+	} {
+		if r := submitResult(t, c, tt.id); r != tt.want {
+			t.Errorf("want %d,actual %d", tt.want, r)
+		}
+	}
+}
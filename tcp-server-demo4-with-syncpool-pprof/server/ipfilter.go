@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/netip"
+)
+
+// IPFilter 按源 IP 过滤新连接，在准入控制的最开始检查，启用 PROXY protocol 时检查的是客户端的真实地址。
+// unix socket 上的连接没有源 IP，不受过滤
+type IPFilter struct {
+	Allow []netip.Prefix // 不为空时只接受这些地址段内的连接
+	Deny  []netip.Prefix // 拒绝这些地址段内的连接，优先于 Allow
+}
+
+// WithIPFilter 设置源 IP 过滤，默认接受所有连接，可以通过 SetIPFilter 在运行时调整
+func WithIPFilter(f IPFilter) Option {
+	return func(s *Server) {
+		s.ipFilter.Store(&f)
+	}
+}
+
+// SetIPFilter 在运行时替换源 IP 过滤，已经建立的连接不受影响
+func (s *Server) SetIPFilter(f IPFilter) {
+	s.ipFilter.Store(&f)
+}
+
+// IPFilter 返回当前的源 IP 过滤
+func (s *Server) IPFilter() IPFilter {
+	return *s.ipFilter.Load()
+}
+
+// allows 是否接受来自 ip 的连接，ip 为 remoteIP 的返回值
+func (f *IPFilter) allows(ip string) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+	addr = addr.WithZone("").Unmap()
+	if containsAddr(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsAddr(f.Allow, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func prefixes(s ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, p := range s {
+		ps = append(ps, netip.MustParsePrefix(p))
+	}
+	return ps
+}
+
+func TestIPFilter_Allows(t *testing.T) {
+	f := IPFilter{
+		Allow: prefixes("10.0.0.0/8", "2001:db8::/32"),
+		Deny:  prefixes("10.0.0.0/24", "2001:db8:1::/48"),
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.0.0.7", false}, // Deny 优先于 Allow
+		{"::ffff:10.1.2.3", true},
+		{"192.168.0.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:1::1", false},
+		{"fe80::1%eth0", false},
+		{"/tmp/server.sock", true}, // unix socket 不受过滤
+	}
+	for _, tt := range tests {
+		if actual := f.allows(tt.ip); actual != tt.want {
+			t.Errorf("%s: want %v,actual %v", tt.ip, tt.want, actual)
+		}
+	}
+	if empty := (&IPFilter{}); !empty.allows("192.168.0.1") {
+		t.Errorf("want allowed,actual denied")
+	}
+}
+
+func TestServer_IPFilter(t *testing.T) {
+	srv, addr := startServer(t, ackHandler, WithIPFilter(IPFilter{Deny: prefixes("127.0.0.1/32")}))
+	denied := metrics.ConnRejectedTotal.WithLabelValues(rejectIPDenied)
+	before := testutil.ToFloat64(denied)
+
+	expectRejected(t, addr)
+	if actual := testutil.ToFloat64(denied); actual != before+1 {
+		t.Errorf("want %v,actual %v", before+1, actual)
+	}
+
+	// 运行时替换后新连接按新的规则检查
+	srv.SetIPFilter(IPFilter{Allow: prefixes("127.0.0.0/8")})
+	c := dialAndAck(t, addr)
+	srv.SetIPFilter(IPFilter{Allow: prefixes("10.0.0.0/8")})
+	expectRejected(t, addr)
+	if f := srv.IPFilter(); len(f.Allow) != 1 || f.Allow[0].String() != "10.0.0.0/8" || len(f.Deny) != 0 {
+		t.Errorf("want allow [10.0.0.0/8],actual %+v", f)
+	}
+
+	// 已经建立的连接不受影响
+	writeSubmit(t, c, "00000002")
+	readSubmitAck(t, c)
+}
+
+func TestServer_IPFilterProxyProtocol(t *testing.T) {
+	_, addr := startServer(t, ackHandler,
+		WithProxyProtocol(ProxyProtocol{TrustedCIDRs: loopback}),
+		WithIPFilter(IPFilter{Allow: prefixes("203.0.113.0/24")}))
+
+	// 检查的是 PROXY 头中的真实地址
+	c := dialProxied(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.1 40001 8888\r\n")
+	writeSubmit(t, c, "00000001")
+	readSubmitAck(t, c)
+	c = dialProxied(t, addr, "PROXY TCP4 198.51.100.7 10.0.0.1 40002 8888\r\n")
+	if d, ok := readPacket(t, c).(*packet.Disconnect); !ok || d.Code != packet.DisconnectRejected {
+		t.Errorf("want rejected disconnect,actual %v", d)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+func TestServer_MultipleListeners(t *testing.T) {
+	srv, tcpAddr := startServer(t, ackHandler, WithMaxConns(2))
+	unixAddr := "unix://" + filepath.Join(t.TempDir(), "server.sock")
+	l, err := transport.Listen(unixAddr, transport.ListenOptions{})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	go srv.Serve(l)
+
+	tcpLabel := "tcp://" + tcpAddr
+	tcpAccepted := testutil.ToFloat64(metrics.ListenerAcceptedTotal.WithLabelValues(tcpLabel, "0"))
+	dialAndAck(t, tcpAddr)
+	c := dialAndAck(t, unixAddr)
+	// 所有 listener 共用连接数限制
+	expectRejected(t, unixAddr)
+	expectRejected(t, tcpAddr)
+
+	if v := testutil.ToFloat64(metrics.ListenerAcceptedTotal.WithLabelValues(tcpLabel, "0")); v != tcpAccepted+1 {
+		t.Errorf("want %v,actual %v", tcpAccepted+1, v)
+	}
+	if v := testutil.ToFloat64(metrics.ListenerConnections.WithLabelValues(unixAddr, "0")); v != 1 {
+		t.Errorf("want 1,actual %v", v)
+	}
+	c.Close()
+	waitMetric(t, metrics.ListenerConnections.WithLabelValues(unixAddr, "0"), 0)
+	dialAndAck(t, unixAddr)
+}
+
+func TestServer_ReusePortShards(t *testing.T) {
+	const shards = 4
+	listeners, err := transport.ListenShards("127.0.0.1:0", shards)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	addr := listeners[0].Addr().String()
+	label := "tcp://" + addr
+	srv := New(ackHandler)
+	serveErr := make(chan error, shards)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			serveErr <- srv.Serve(l)
+		}(l)
+	}
+
+	const conns = 32
+	var cs []net.Conn
+	for i := 0; i < conns; i++ {
+		cs = append(cs, dialAndAck(t, addr))
+	}
+	var total, used float64
+	for i := 0; i < shards; i++ {
+		if n := testutil.ToFloat64(metrics.ListenerConnections.WithLabelValues(label, strconv.Itoa(i))); n > 0 {
+			total += n
+			used++
+		}
+	}
+	if total != conns {
+		t.Errorf("want %d,actual %v", conns, total)
+	}
+	if runtime.GOOS == "linux" && used < 2 {
+		t.Errorf("want connections spread over shards,actual %v shard(s) used", used)
+	}
+
+	// Shutdown 关闭所有分片的 listener，并通知每个连接断开
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+	for _, c := range cs {
+		if d, ok := readPacket(t, c).(*packet.Disconnect); !ok || d.Code != packet.DisconnectShutdown {
+			t.Errorf("want shutdown disconnect,actual %v", d)
+		}
+		c.Close()
+	}
+	if err := <-done; err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	for i := 0; i < shards; i++ {
+		if err := <-serveErr; err != ErrServerClosed {
+			t.Errorf("want %v,actual %v", ErrServerClosed, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+)
+
+// worker pool：Handler 默认在连接的读 goroutine 中同步执行，启用 worker pool 后交给固定数量的 worker 执行，
+// 限制所有连接上 Handler 的总并发数。每个 worker 有自己的任务队列，相同排序 key 的 packet
+// 总是进入同一个 worker 的队列，因此按收到的顺序依次处理。队列满时读 goroutine 阻塞，读取随之暂停
+
+const defaultWorkerQueueDepth = 128
+
+// OrderKey worker pool 中保证处理顺序的维度
+type OrderKey int
+
+const (
+	OrderByConn     OrderKey = iota // 同一个连接(含复用连接上的每个 stream)上的 packet 按顺序处理
+	OrderByClientID                 // 同一个 ClientID 的 packet 按顺序处理，未发送 Conn 的连接按连接排序
+)
+
+// WorkerPool worker pool 配置，Size <= 0 表示不启用
+type WorkerPool struct {
+	Size       int      // worker 数量，即 Handler 的最大并发数
+	QueueDepth int      // 每个 worker 任务队列的长度，默认 128
+	OrderBy    OrderKey // 保证处理顺序的维度
+}
+
+// WithWorkerPool 启用 worker pool 执行 Handler
+func WithWorkerPool(p WorkerPool) Option {
+	return func(s *Server) {
+		s.workerPool = p
+	}
+}
+
+// task 交给 worker 执行的一个请求
+type task struct {
+	c        *conn
+	req      *Request
+	enqueued time.Time
+}
+
+type workerPool struct {
+	queues []chan task
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newWorkerPool(cfg WorkerPool) *workerPool {
+	depth := cfg.QueueDepth
+	if depth <= 0 {
+		depth = defaultWorkerQueueDepth
+	}
+	wp := &workerPool{
+		queues: make([]chan task, cfg.Size),
+		stop:   make(chan struct{}),
+	}
+	for i := range wp.queues {
+		wp.queues[i] = make(chan task, depth)
+		go wp.work(wp.queues[i])
+	}
+	return wp
+}
+
+// dispatch 把请求放入 hash 对应 worker 的队列，队列满时阻塞
+func (wp *workerPool) dispatch(hash uint32, t task) {
+	q := wp.queues[hash%uint32(len(wp.queues))]
+	t.enqueued = time.Now()
+	metrics.WorkerQueueLength.Inc()
+	select {
+	case q <- t:
+	default:
+		metrics.WorkerSaturatedTotal.Inc()
+		q <- t
+	}
+}
+
+func (wp *workerPool) work(q chan task) {
+	for {
+		select {
+		case t := <-q:
+			metrics.WorkerQueueLength.Dec()
+			metrics.WorkerQueueWaitSeconds.Observe(time.Since(t.enqueued).Seconds())
+			wp.run(t)
+		case <-wp.stop:
+			return
+		}
+	}
+}
+
+func (wp *workerPool) run(t task) {
+	metrics.WorkerBusy.Inc()
+	defer func() {
+		metrics.WorkerBusy.Dec()
+		releasePacket(t.req.Packet)
+		t.c.server.budget.release(t.req.size, 1)
+		t.c.pending.Add(-1)
+		t.c.tasks.Done()
+		if err := recover(); err != nil {
+			t.req.Logger().Error("worker: recover panic", "panic", err)
+		}
+	}()
+	t.c.server.handler.ServePacket(t.c, t.req)
+}
+
+// close 停止所有 worker，只在所有连接都退出后调用
+func (wp *workerPool) close() {
+	wp.once.Do(func() {
+		close(wp.stop)
+	})
+}
+
+// servePacket 执行请求：启用 worker pool 时交给 worker，否则在当前 goroutine 中执行
+func (c *conn) servePacket(req *Request) {
+	if wp := c.server.workers; wp != nil {
+		// orderHash 可能等待已交给 worker 的请求，必须在计数之前调用
+		hash := c.orderHash()
+		c.pending.Add(1)
+		c.tasks.Add(1)
+		wp.dispatch(hash, task{c: c, req: req})
+		return
+	}
+	// Handler panic 时也要归还预算，否则计数永远回不到低水位以下
+	defer c.server.budget.release(req.size, 1)
+	c.server.handler.ServePacket(c, req)
+	releasePacket(req.Packet)
+}
+
+// orderHash 返回连接的排序 key 的 hash，结果缓存在 c.orderKey 中，收到 Conn 包时失效。
+// key 变化时先等待按旧 key 交给 worker 的请求处理完，否则新旧 key 对应的两个 worker 并发处理，
+// Conn 包前后的请求可能乱序
+func (c *conn) orderHash() uint32 {
+	if c.orderKeySet {
+		return c.orderKey
+	}
+	key := uint32(c.id)
+	if c.server.workerPool.OrderBy == OrderByClientID && c.clientID != "" {
+		h := fnv.New32a()
+		h.Write([]byte(c.clientID))
+		key = h.Sum32()
+	}
+	if key != c.orderKey && c.pending.Load() > 0 {
+		c.tasks.Wait()
+	}
+	c.orderKey = key
+	c.orderKeySet = true
+	return key
+}
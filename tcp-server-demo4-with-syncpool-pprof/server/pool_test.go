@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func TestServer_WorkerPoolConcurrency(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		ackHandler(w, r)
+	})
+	_, addr := startServer(t, h, WithWorkerPool(WorkerPool{Size: 2}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		c := dialClient(t, addr, "")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				writeSubmit(t, c, fmt.Sprintf("%08d", j))
+			}
+			for j := 0; j < 3; j++ {
+				readSubmitAck(t, c)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Handler 的并发数不超过 worker 数量
+	if m := maxRunning.Load(); m != 2 {
+		t.Errorf("want 2,actual %d", m)
+	}
+}
+
+func TestServer_WorkerPoolOrdering(t *testing.T) {
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		ackHandler(w, r)
+	})
+	tests := []struct {
+		name    string
+		orderBy OrderKey
+	}{
+		{"ByConn", OrderByConn},
+		{"ByClientID", OrderByClientID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, h, WithWorkerPool(WorkerPool{Size: 4, QueueDepth: 2, OrderBy: tt.orderBy}))
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				c := dialClient(t, addr, fmt.Sprintf("client-%d", i))
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// 同一个连接上的请求按顺序处理，响应按顺序返回
+					const n = 50
+					for j := 0; j < n; j++ {
+						writeSubmit(t, c, fmt.Sprintf("%08d", j))
+					}
+					for j := 0; j < n; j++ {
+						if ack, want := readSubmitAck(t, c), fmt.Sprintf("%08d", j); ack.ID != want {
+							t.Errorf("want %s,actual %s", want, ack.ID)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestServer_WorkerPoolOrderKeyChange(t *testing.T) {
+	// Conn 包之前的请求处理得慢，之后的请求处理得快
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.ClientID == "" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		ackHandler(w, r)
+	})
+	_, addr := startServer(t, h, WithWorkerPool(WorkerPool{Size: 4, OrderBy: OrderByClientID}))
+
+	// 排序 key 从连接变为 ClientID 时，之前交给 worker 的请求先处理完
+	c := dialClient(t, addr, "")
+	for j := 0; j < 5; j++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", j))
+	}
+	writeConn(t, c, "client-1")
+	for j := 5; j < 10; j++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", j))
+	}
+	for j := 0; j < 10; j++ {
+		if ack, want := readSubmitAck(t, c), fmt.Sprintf("%08d", j); ack.ID != want {
+			t.Fatalf("want %s,actual %s", want, ack.ID)
+		}
+	}
+}
+
+func TestServer_WorkerPoolShutdown(t *testing.T) {
+	release := make(chan struct{})
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-release
+		ackHandler(w, r)
+	})
+	srv, addr := startServer(t, h, WithWorkerPool(WorkerPool{Size: 1}))
+	c := dialClient(t, addr, "")
+	writeSubmit(t, c, "00000001")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	// 读 goroutine 空闲，但 worker 中还有该连接的请求，Shutdown 等待其完成
+	select {
+	case err := <-done:
+		t.Fatalf("want Shutdown blocked,actual %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+
+	// 先收到 Disconnect，随后收到 worker 中请求的响应
+	if _, ok := readPacket(t, c).(*packet.Disconnect); !ok {
+		t.Errorf("want *packet.Disconnect")
+	}
+	if ack := readSubmitAck(t, c); ack.ID != "00000001" {
+		t.Errorf("want 00000001,actual %s", ack.ID)
+	}
+}
+
+func TestServer_WorkerPoolShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv, addr := startServer(t, blockingHandler(release), WithWorkerPool(WorkerPool{Size: 1}))
+	c := dialClient(t, addr, "")
+	writeSubmit(t, c, "00000001")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded,actual %v", err)
+	}
+
+	// Shutdown 超时返回后，worker 处理完剩余的请求、连接全部退出时停止
+	close(release)
+	waitFor(t, "workers stopped", func() bool {
+		select {
+		case <-srv.workers.stop:
+			return true
+		default:
+			return false
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/proxyproto"
+)
+
+// PROXY protocol：服务端部署在 HAProxy、AWS NLB 等负载均衡之后时，连接的对端地址是负载均衡，
+// 负载均衡在连接开头用 PROXY protocol 头告知客户端的真实地址。
+// 来自可信上游的连接在准入控制之前读取 PROXY 头，之后准入控制、Submit 限流、会话和日志都使用真实地址；
+// 可信上游必须发送 PROXY 头，其他连接不读取 PROXY 头，无法伪造地址
+
+// defaultProxyHeaderTimeout 默认的读取 PROXY 头的最长时间
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// errProxyEpoll EngineEpoll 不支持 PROXY protocol
+var errProxyEpoll = errors.New("server: proxy protocol is not supported with the epoll engine")
+
+// ProxyProtocol PROXY protocol 的配置，TrustedCIDRs 为空表示不启用
+type ProxyProtocol struct {
+	TrustedCIDRs  []netip.Prefix // 可信上游的地址段，来自这些地址的连接必须以 PROXY 头开始
+	HeaderTimeout time.Duration  // 读取 PROXY 头的最长时间，<= 0 时默认 5s
+}
+
+// WithProxyProtocol 启用 PROXY protocol v1/v2，只对 EngineGoroutine 生效。
+// 头中不携带客户端地址(如负载均衡的健康检查)的连接仍使用负载均衡的地址
+func WithProxyProtocol(p ProxyProtocol) Option {
+	return func(s *Server) {
+		if p.HeaderTimeout <= 0 {
+			p.HeaderTimeout = defaultProxyHeaderTimeout
+		}
+		s.proxyProtocol = p
+	}
+}
+
+// proxyEnabled 是否启用了 PROXY protocol
+func (s *Server) proxyEnabled() bool {
+	return len(s.proxyProtocol.TrustedCIDRs) > 0
+}
+
+// trustedProxy 连接是否来自可信上游，unix socket 上的连接没有源 IP，总是不可信
+func (s *Server) trustedProxy(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := ta.AddrPort().Addr().Unmap()
+	for _, p := range s.proxyProtocol.TrustedCIDRs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader 读取可信上游连接开头的 PROXY 头，出错时关闭连接并返回 nil。
+// 读取期间 Shutdown 直接关闭连接
+func (s *Server) readProxyHeader(rwc net.Conn) net.Conn {
+	if !s.trackProxyConn(rwc, true) {
+		rwc.Close()
+		return nil
+	}
+	pc, err := proxyproto.Accept(rwc, s.proxyProtocol.HeaderTimeout)
+	s.trackProxyConn(rwc, false)
+	if err != nil {
+		metrics.ProxyHeaderErrorTotal.Inc()
+		s.logger.Info("proxy protocol header error", "proxy", rwc.RemoteAddr().String(), "err", err)
+		rwc.Close()
+		return nil
+	}
+	return pc
+}
+
+func (s *Server) trackProxyConn(rwc net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.proxyConns[rwc] = struct{}{}
+	} else {
+		delete(s.proxyConns, rwc)
+	}
+	return true
+}
+
+// proxyAddr 返回经 PROXY protocol 转发的连接的负载均衡地址，其他连接返回 nil
+func proxyAddr(rwc net.Conn) net.Addr {
+	if tlsConn, ok := rwc.(*tls.Conn); ok {
+		rwc = tlsConn.NetConn()
+	}
+	if pc, ok := rwc.(*proxyproto.Conn); ok {
+		return pc.ProxyAddr()
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+// dialProxied 以负载均衡的身份建立连接并写入 PROXY 头
+func dialProxied(t *testing.T, addr, header string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write([]byte(header)); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return c
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	srv, addr := startServer(t, ackHandler,
+		WithProxyProtocol(ProxyProtocol{TrustedCIDRs: loopback}),
+		WithMaxConnsPerIP(1))
+
+	c1 := dialProxied(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.1 40001 8888\r\n")
+	writeConn(t, c1, "device-1")
+	writeSubmit(t, c1, "00000001")
+	readSubmitAck(t, c1)
+	s := lookupSession(t, srv.Sessions(), "device-1")
+	if s.RemoteAddr.String() != "203.0.113.7:40001" || s.ProxyAddr.String() != c1.LocalAddr().String() {
+		t.Errorf("want 203.0.113.7:40001 %s,actual %s %s", c1.LocalAddr(), s.RemoteAddr, s.ProxyAddr)
+	}
+
+	// 单 IP 连接数按真实地址计算
+	c2 := dialProxied(t, addr, "PROXY TCP4 203.0.113.8 10.0.0.1 40002 8888\r\n")
+	writeSubmit(t, c2, "00000001")
+	readSubmitAck(t, c2)
+	c3 := dialProxied(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.1 40003 8888\r\n")
+	if d, ok := readPacket(t, c3).(*packet.Disconnect); !ok || d.Code != packet.DisconnectRejected {
+		t.Errorf("want rejected disconnect,actual %v", d)
+	}
+
+	// 健康检查等不携带地址的连接使用负载均衡的地址
+	c4 := dialProxied(t, addr, "PROXY UNKNOWN\r\n")
+	writeSubmit(t, c4, "00000001")
+	readSubmitAck(t, c4)
+}
+
+func TestServer_ProxyProtocolUntrusted(t *testing.T) {
+	srv, addr := startServer(t, ackHandler,
+		WithProxyProtocol(ProxyProtocol{TrustedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}),
+		WithMaxFrameSize(1024))
+
+	// 不可信的连接不读取 PROXY 头，无法伪造地址；PROXY 头被当作 frame，长度超限后连接被关闭
+	c := dialProxied(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.1 40001 8888\r\n")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+
+	c = dialAndAck(t, addr)
+	writeConn(t, c, "device-1")
+	if s := lookupSession(t, srv.Sessions(), "device-1"); s.RemoteAddr.String() != c.LocalAddr().String() || s.ProxyAddr != nil {
+		t.Errorf("want %s <nil>,actual %s %v", c.LocalAddr(), s.RemoteAddr, s.ProxyAddr)
+	}
+}
+
+func TestServer_ProxyProtocolHeaderError(t *testing.T) {
+	_, addr := startServer(t, ackHandler,
+		WithProxyProtocol(ProxyProtocol{TrustedCIDRs: loopback, HeaderTimeout: 50 * time.Millisecond}))
+	before := testutil.ToFloat64(metrics.ProxyHeaderErrorTotal)
+
+	// 可信上游必须发送 PROXY 头
+	c := dialProxied(t, addr, "")
+	writeSubmit(t, c, "00000001")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+
+	// 超时未发送 PROXY 头
+	c = dialProxied(t, addr, "PROXY TCP4 203.0.113.7")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+	waitMetric(t, metrics.ProxyHeaderErrorTotal, before+2)
+}
+
+func TestServer_ProxyProtocolTLS(t *testing.T) {
+	f := newTLSFixture(t)
+	srv, addr := startServer(t, ackHandler,
+		WithProxyProtocol(ProxyProtocol{TrustedCIDRs: loopback}),
+		WithTLSConfig(f.server))
+
+	// PROXY 头在 TLS 握手之前
+	raw := dialProxied(t, addr, "PROXY TCP6 2001:db8::7 2001:db8::1 40001 8888\r\n")
+	config := f.client.Clone()
+	config.ServerName = "127.0.0.1"
+	c := tls.Client(raw, config)
+	writeSubmit(t, c, "00000001")
+	readSubmitAck(t, c)
+	if s := lookupSession(t, srv.Sessions(), "device-1"); s.RemoteAddr.String() != "[2001:db8::7]:40001" {
+		t.Errorf("want [2001:db8::7]:40001,actual %s", s.RemoteAddr)
+	}
+}
+
+func TestServer_ProxyProtocolEpollUnsupported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler, WithEngine(EngineEpoll), WithProxyProtocol(ProxyProtocol{TrustedCIDRs: loopback}))
+	if err := srv.Serve(l); err != errProxyEpoll {
+		t.Errorf("want %v,actual %v", errProxyEpoll, err)
+	}
+}
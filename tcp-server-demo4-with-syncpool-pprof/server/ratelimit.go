@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/ratelimit"
+)
+
+// Submit 限流：每个 key 一个令牌桶，每个 Submit 消耗一个令牌
+
+// 暂停读取时检查 Shutdown 的间隔
+const pausePollInterval = 100 * time.Millisecond
+
+// RateLimitKey 限流的维度
+type RateLimitKey int
+
+const (
+	RateLimitByConn     RateLimitKey = iota // 每个连接(含复用连接上的每个 stream)单独限流
+	RateLimitByClientID                     // 按 Conn 包中的 ClientID 限流，未发送 Conn 的连接按连接限流
+	RateLimitByIP                           // 同一个源 IP 的所有连接共用一个令牌桶
+)
+
+// RateLimitAction 超过限流速率时的处理方式
+type RateLimitAction int
+
+const (
+	RateLimitThrottle RateLimitAction = iota // 回复 Result 为 ResultThrottled 的 SubmitAck，Submit 不交给 Handler 处理
+	RateLimitPause                           // 暂停读取该连接直到令牌可用，依靠 TCP 流控让客户端降速
+)
+
+// RateLimit Submit 限流配置，Rate <= 0 表示不限流
+type RateLimit struct {
+	Rate   float64         // 每秒允许的 Submit 数
+	Burst  int             // 允许的突发数量
+	Key    RateLimitKey    // 限流的维度
+	Action RateLimitAction // 超过限流速率时的处理方式
+}
+
+// WithSubmitRateLimit 设置 Submit 限流，Rate 和 Burst 可以通过 SetSubmitRateLimit 在运行时调整
+func WithSubmitRateLimit(rl RateLimit) Option {
+	return func(s *Server) {
+		s.rateLimit = rl
+	}
+}
+
+// SetSubmitRateLimit 在运行时调整 Submit 限流的速率和容量，对已有连接立即生效，rate <= 0 表示不限流
+func (s *Server) SetSubmitRateLimit(rate float64, burst int) {
+	s.submitLimiter.SetLimit(rate, burst)
+	s.submitLimited.Store(rate > 0)
+}
+
+// SubmitRateLimit 返回当前 Submit 限流的速率和容量
+func (s *Server) SubmitRateLimit() (float64, int) {
+	return s.submitLimiter.Limit()
+}
+
+// SubmitRateLimitSupported 当前引擎是否支持 Submit 限流，EngineEpoll 不支持，SetSubmitRateLimit 不生效
+func (s *Server) SubmitRateLimitSupported() bool {
+	return s.engine != EngineEpoll
+}
+
+func (s *Server) initRateLimit() {
+	s.submitLimiter = ratelimit.NewLimiter(s.rateLimit.Rate, s.rateLimit.Burst)
+	s.submitLimited.Store(s.rateLimit.Rate > 0)
+}
+
+// allowSubmit 对 Submit 限流，返回 false 时该 Submit 已被回复 ResultThrottled，不再交给 Handler
+func (c *conn) allowSubmit(p *packet.Submit) bool {
+	if !c.server.submitLimited.Load() {
+		return true
+	}
+	key := c.rateLimitKey()
+
+	if c.server.rateLimit.Action == RateLimitPause {
+		if d := c.server.submitLimiter.Reserve(key); d > 0 {
+			metrics.SubmitThrottledTotal.WithLabelValues("pause").Inc()
+			c.pause(d)
+		}
+		return true
+	}
+
+	if c.server.submitLimiter.Allow(key) {
+		return true
+	}
+	metrics.SubmitThrottledTotal.WithLabelValues("throttle").Inc()
+	submitAck := packet.SubmitAckPool.Get().(*packet.SubmitAck)
+	submitAck.ID = p.ID
+	submitAck.Result = packet.ResultThrottled
+	submitAck.Flags = 0
+	if err := c.Write(submitAck); err != nil {
+		c.logger().Info("write throttled submit ack error", "err", err)
+	}
+	packet.SubmitAckPool.Put(submitAck)
+	return false
+}
+
+// pause 暂停读取 d，期间先把已缓存的响应发出去；Shutdown 时提前结束
+func (c *conn) pause(d time.Duration) {
+	c.requestFlush()
+	for d > 0 && !c.server.shuttingDown() {
+		step := d
+		if step > pausePollInterval {
+			step = pausePollInterval
+		}
+		time.Sleep(step)
+		d -= step
+	}
+}
+
+// rateLimitKey 返回连接的限流 key，结果缓存在 c.rateKey 中，收到 Conn 包时失效
+func (c *conn) rateLimitKey() string {
+	if c.rateKey != "" {
+		return c.rateKey
+	}
+	c.rateKeyOwned = false
+	switch c.server.rateLimit.Key {
+	case RateLimitByClientID:
+		if c.clientID != "" {
+			c.rateKey = "client:" + c.clientID
+			return c.rateKey
+		}
+	case RateLimitByIP:
+		c.rateKey = "ip:" + remoteIP(c.rwc.RemoteAddr())
+		return c.rateKey
+	}
+	c.rateKey = fmt.Sprintf("conn:%p", c)
+	c.rateKeyOwned = true
+	return c.rateKey
+}
+
+// releaseRateLimit 连接退出时删除只属于该连接的令牌桶
+func (c *conn) releaseRateLimit() {
+	if c.rateKeyOwned {
+		c.server.submitLimiter.Remove(c.rateKey)
+	}
+}
+
+// setClientID 记录 Conn 包中的客户端标识，已由客户端证书确定标识时忽略
+func (c *conn) setClientID(id string) {
+	if c.certIdentity != "" {
+		return
+	}
+	c.releaseRateLimit()
+	c.clientID = id
+	c.setLogger()
+	c.server.sessions.SetClientID(c.session, id)
+	c.rateKey = ""
+	c.rateKeyOwned = false
+	c.orderKeySet = false
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func dialClient(t *testing.T, addr, clientID string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	if clientID != "" {
+		writeConn(t, c, clientID)
+	}
+	return c
+}
+
+func writeConn(t *testing.T, c net.Conn, clientID string) {
+	framePayload, err := packet.Encode(&packet.Conn{ClientID: clientID})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if err = frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+}
+
+func submitResult(t *testing.T, c net.Conn, id string) uint8 {
+	writeSubmit(t, c, id)
+	ack := readSubmitAck(t, c)
+	if ack.ID != id {
+		t.Errorf("want %s,actual %s", id, ack.ID)
+	}
+	return ack.Result
+}
+
+func TestServer_SubmitRateLimitThrottle(t *testing.T) {
+	tests := []struct {
+		name string
+		key  RateLimitKey
+		// 第二个连接与第一个连接是否共用令牌桶
+		shared bool
+		ids    [2]string
+	}{
+		{"ByConn", RateLimitByConn, false, [2]string{"", ""}},
+		{"ByClientID", RateLimitByClientID, true, [2]string{"client-1", "client-1"}},
+		{"ByClientIDDistinct", RateLimitByClientID, false, [2]string{"client-1", "client-2"}},
+		{"ByIP", RateLimitByIP, true, [2]string{"", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, ackHandler, WithSubmitRateLimit(RateLimit{Rate: 0.001, Burst: 2, Key: tt.key}))
+
+			c1 := dialClient(t, addr, tt.ids[0])
+			for i, want := range []uint8{packet.ResultOK, packet.ResultOK, packet.ResultThrottled} {
+				if r := submitResult(t, c1, fmt.Sprintf("%08d", i)); r != want {
+					t.Errorf("want %d,actual %d", want, r)
+				}
+			}
+
+			want := uint8(packet.ResultOK)
+			if tt.shared {
+				want = packet.ResultThrottled
+			}
+			c2 := dialClient(t, addr, tt.ids[1])
+			if r := submitResult(t, c2, "00000001"); r != want {
+				t.Errorf("want %d,actual %d", want, r)
+			}
+		})
+	}
+}
+
+func TestServer_SubmitRateLimitPause(t *testing.T) {
+	_, addr := startServer(t, ackHandler, WithSubmitRateLimit(RateLimit{Rate: 20, Burst: 1, Action: RateLimitPause}))
+	c := dialClient(t, addr, "")
+
+	// 超过速率的 Submit 不会被拒绝，而是被延迟处理
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	for i := 0; i < 5; i++ {
+		if ack := readSubmitAck(t, c); ack.Result != packet.ResultOK {
+			t.Errorf("want %d,actual %d", packet.ResultOK, ack.Result)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("want >= 150ms,actual %s", elapsed)
+	}
+}
+
+func TestServer_SetSubmitRateLimit(t *testing.T) {
+	srv, addr := startServer(t, ackHandler)
+	c := dialClient(t, addr, "")
+
+	if r := submitResult(t, c, "00000001"); r != packet.ResultOK {
+		t.Errorf("want %d,actual %d", packet.ResultOK, r)
+	}
+
+	// 运行时启用限流，对已有连接生效
+	srv.SetSubmitRateLimit(0.001, 1)
+	if rate, burst := srv.SubmitRateLimit(); rate != 0.001 || burst != 1 {
+		t.Errorf("want 0.001 1,actual %v %d", rate, burst)
+	}
+	submitResult(t, c, "00000002")
+	if r := submitResult(t, c, "00000003"); r != packet.ResultThrottled {
+		t.Errorf("want %d,actual %d", packet.ResultThrottled, r)
+	}
+
+	// 运行时关闭限流
+	srv.SetSubmitRateLimit(0, 1)
+	if r := submitResult(t, c, "00000004"); r != packet.ResultOK {
+		t.Errorf("want %d,actual %d", packet.ResultOK, r)
+	}
+}
@@ -0,0 +1,510 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/ratelimit"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+// server 包提供可嵌入的 TCP 服务端：负责监听、连接管理、frame/packet 编解码，业务逻辑由 Handler 实现
+
+// ErrServerClosed Shutdown 之后 Serve 和 ListenAndServe 返回该错误
+var ErrServerClosed = errors.New("server: Server closed")
+
+const (
+	defaultAddr            = ":8888"
+	defaultReadBufferSize  = 4096
+	defaultWriteBufferSize = 4096
+
+	shutdownPollIntervalMax = 500 * time.Millisecond
+)
+
+// Option 服务端配置项
+type Option func(*Server)
+
+// WithLogger 设置日志，默认 slog.Default()。每个连接的日志都带有 conn_id、remote 和 client_id
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithAddr 设置 ListenAndServe 的监听地址，默认 :8888，格式见 transport.ParseAddr
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithReadBufferSize 设置每个连接读缓存的大小，默认 4KiB
+func WithReadBufferSize(size int) Option {
+	return func(s *Server) {
+		s.readBufferSize = size
+	}
+}
+
+// WithWriteBufferSize 设置每个连接写缓存的大小，默认 4KiB
+func WithWriteBufferSize(size int) Option {
+	return func(s *Server) {
+		s.writeBufferSize = size
+	}
+}
+
+// WithMaxFrameSize 设置单个 frame 的最大长度(含 4 字节帧头)，超过时关闭连接，0 表示不限制；
+// EngineEpoll 要缓存不完整的 frame，0 时按 16MiB 限制
+func WithMaxFrameSize(size int) Option {
+	return func(s *Server) {
+		s.maxFrameSize = size
+	}
+}
+
+// WithHandshakeTimeout 设置从建立连接到收到第一个完整 frame 的最长时间，0 表示不限制
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handshakeTimeout = d
+	}
+}
+
+// WithIdleTimeout 设置两个 frame 之间连接允许空闲的最长时间，0 表示不限制
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithFrameTimeout 设置收到 frame 的首字节后读完整个 frame 的最长时间，0 表示不限制
+func WithFrameTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.frameTimeout = d
+	}
+}
+
+// WithWriteTimeout 设置每次向连接写出数据的最长时间，客户端不读取响应时连接会被关闭，0 表示不限制
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithMuxMaxStreams 设置每条复用连接上同时打开的 stream 数量上限，超过后新的 stream 会被 RST，
+// 默认 mux.DefaultMaxStreams，0 表示不限制
+func WithMuxMaxStreams(n int) Option {
+	return func(s *Server) {
+		s.muxMaxStreams = n
+	}
+}
+
+// FlushPolicy 写缓存的刷新策略。多个条件可以同时启用，任一条件满足即刷新；
+// 全部不启用时只在写缓存写满或连接关闭时刷新
+type FlushPolicy struct {
+	OnIdle   bool          // 读缓存中没有待处理的请求且出站队列为空时刷新，适合请求/响应式的客户端
+	Interval time.Duration // 响应在写缓存中停留的最长时间，0 表示不启用
+	Bytes    int           // 写缓存中的数据达到该字节数时刷新，0 表示不启用
+}
+
+// WithFlushPolicy 设置写缓存的刷新策略，默认 FlushPolicy{OnIdle: true}
+func WithFlushPolicy(p FlushPolicy) Option {
+	return func(s *Server) {
+		s.flushPolicy = p
+	}
+}
+
+// Server TCP 服务端
+type Server struct {
+	addr            string
+	handler         Handler // 已用 interceptors 包装
+	logger          *slog.Logger
+	interceptors    []Interceptor
+	readBufferSize  int
+	writeBufferSize int
+	maxFrameSize    int
+	flushPolicy     FlushPolicy
+
+	outboundQueueSize int
+	muxMaxStreams     int
+
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	frameTimeout     time.Duration
+	writeTimeout     time.Duration
+
+	maxConns      int
+	maxConnsPerIP int
+	acceptLimiter *ratelimit.Bucket // 建连速率，速率 <= 0 时不限制
+	ipFilter      atomic.Pointer[IPFilter]
+
+	rateLimit     RateLimit
+	submitLimiter *ratelimit.Limiter
+	submitLimited atomic.Bool // Submit 限流是否启用
+
+	memoryBudget MemoryBudget
+	budget       *budget
+
+	workerPool WorkerPool
+	workers    *workerPool // 未启用 worker pool 时为 nil
+
+	nextConnID atomic.Uint64
+	sessions   *session.Registry
+
+	tlsConfig      *tls.Config // 为 nil 时不启用 TLS
+	clientIdentity func(cert *x509.Certificate) string
+
+	proxyProtocol ProxyProtocol
+
+	engine     Engine
+	eventLoops int
+	epoll      *epollEngine // EngineEpoll 的事件循环，第一次 Serve 时创建，由 mu 保护
+
+	inShutdown atomic.Bool
+	draining   atomic.Bool // 排空中，拒绝新连接
+
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	conns      map[*conn]struct{}
+	proxyConns map[net.Conn]struct{} // 正在读取 PROXY 头的连接
+	numConns   int                   // 已接受的连接数，不含 stream
+	connsPerIP map[string]int        // 每个源 IP 已接受的连接数
+}
+
+// New 创建一个服务端，每个连接上收到的 packet 都交给 handler 处理
+func New(handler Handler, opts ...Option) *Server {
+	s := &Server{
+		addr:            defaultAddr,
+		handler:         handler,
+		readBufferSize:  defaultReadBufferSize,
+		writeBufferSize: defaultWriteBufferSize,
+		flushPolicy:     FlushPolicy{OnIdle: true},
+		clientIdentity:  defaultClientIdentity,
+		logger:          slog.Default(),
+
+		outboundQueueSize: defaultOutboundQueueSize,
+		muxMaxStreams:     mux.DefaultMaxStreams,
+		listeners:         make(map[*net.Listener]struct{}),
+		conns:             make(map[*conn]struct{}),
+		proxyConns:        make(map[net.Conn]struct{}),
+		connsPerIP:        make(map[string]int),
+		sessions:          session.NewRegistry(),
+		acceptLimiter:     ratelimit.NewBucket(0, 1),
+	}
+	s.ipFilter.Store(&IPFilter{})
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.handler = Chain(s.handler, s.interceptors...)
+	s.initRateLimit()
+	s.budget = newBudget(s.memoryBudget, s.logger)
+	// 请求在解码之后才计入预算，启用字节预算时单个 frame 不能超过预算，
+	// 避免一个超长的 totalLen 在计入预算之前就分配大块内存
+	if b := s.memoryBudget.MaxBytes; b > 0 && (s.maxFrameSize <= 0 || int64(s.maxFrameSize) > b) {
+		s.maxFrameSize = int(min(b, math.MaxInt32))
+	}
+	if s.workerPool.Size > 0 {
+		s.workers = newWorkerPool(s.workerPool)
+	}
+	return s
+}
+
+// ListenAndServe 监听 TCP 或 unix socket 地址并调用 Serve 处理连接
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, err := transport.Listen(s.addr, transport.ListenOptions{})
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve 在 listener 上接受连接，为每个连接启动一个 goroutine。Serve 总是返回非 nil 的错误，
+// Shutdown 之后返回 ErrServerClosed。
+// 可以在多个 listener 上同时调用 Serve，所有 listener 共用 Handler 和连接数限制。
+// 启用 PROXY protocol 时来自可信上游的连接先在单独的 goroutine 中读取 PROXY 头，再做准入控制
+func (s *Server) Serve(l net.Listener) error {
+	// metrics 的 listener 和 shard 标签，不是 transport.ListenShards 创建的 listener 时 shard 为 0
+	listener, shard := transport.Format(l.Addr()), "0"
+	if sl, ok := l.(transport.Shard); ok {
+		shard = strconv.Itoa(sl.Shard())
+	}
+	accepted := metrics.ListenerAcceptedTotal.WithLabelValues(listener, shard)
+	conns := metrics.ListenerConnections.WithLabelValues(listener, shard)
+	if s.engine == EngineEpoll {
+		if s.tlsConfig != nil {
+			l.Close()
+			return errTLSEpoll
+		}
+		if s.proxyEnabled() {
+			l.Close()
+			return errProxyEpoll
+		}
+	}
+	if !s.trackListener(&l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+
+	var epoll *epollEngine
+	if s.engine == EngineEpoll {
+		var err error
+		if epoll, err = s.startEpoll(); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	var retryDelay time.Duration // Accept 临时错误的重试间隔
+	// DeadLoop 不断监控是否有新的连接
+	for {
+		// 在没有新连接的时候，这个服务会阻塞在 Accept 调用上，直到有客户端连接上来，Accept 方法将返回一个 net.Conn 实例
+		rwc, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				if retryDelay == 0 {
+					retryDelay = acceptRetryDelayMin
+				} else if retryDelay *= 2; retryDelay > acceptRetryDelayMax {
+					retryDelay = acceptRetryDelayMax
+				}
+				metrics.AcceptErrorTotal.Inc()
+				s.logger.Warn("accept error", "listener", listener, "err", err, "retry_in", retryDelay)
+				time.Sleep(retryDelay)
+				continue
+			}
+			return err
+		}
+		retryDelay = 0
+
+		if s.proxyEnabled() && s.trustedProxy(rwc.RemoteAddr()) {
+			// 读取 PROXY 头可能阻塞，不能占用 accept 循环
+			go func() {
+				if rwc := s.readProxyHeader(rwc); rwc != nil {
+					s.accept(rwc, epoll, accepted, conns)
+				}
+			}()
+			continue
+		}
+		s.accept(rwc, epoll, accepted, conns)
+	}
+}
+
+// accept 对 Serve 接受的连接做准入控制，通过后交给事件循环或启动处理 goroutine
+func (s *Server) accept(rwc net.Conn, epoll *epollEngine, accepted prometheus.Counter, conns prometheus.Gauge) {
+	// 准入控制在 TLS 握手之前进行，被拒绝的连接不占用握手的开销
+	ip := remoteIP(rwc.RemoteAddr())
+	if reason := s.admit(ip); reason != "" {
+		// 拒绝的连接由 conn_rejected_total 计数；deny 列表应对的是大量连接，逐条记录只用 debug 日志，由 Handler 采样
+		if reason == rejectIPDenied && s.logger.Enabled(context.Background(), slog.LevelDebug) {
+			s.logger.Debug("connection denied by ip filter", "remote", rwc.RemoteAddr().String())
+		}
+		go s.reject(rwc, reason)
+		return
+	}
+	if s.tlsConfig != nil {
+		// PROXY 头在 TLS 握手之前，不能用 tls.NewListener 包装 listener
+		rwc = tls.Server(rwc, s.tlsConfig)
+	}
+	accepted.Inc()
+	conns.Inc()
+
+	if epoll != nil {
+		// 交给事件循环处理
+		if err := epoll.register(rwc, ip, conns); err != nil {
+			s.logger.Error("epoll register error", "remote", rwc.RemoteAddr().String(), "err", err)
+			s.connClosed(ip, conns)
+		}
+		return
+	}
+
+	// start a new goroutine to handle the new connection.
+	s.serveConn(rwc, nil, conns)
+}
+
+// Shutdown 优雅关闭服务端：先关闭所有 listener，再向每个连接发送 Disconnect，
+// 等待连接处理完读缓存中已收到的请求、刷新写缓存后关闭。
+// ctx 结束时强制关闭剩余的连接并返回 ctx.Err()，worker pool 在剩余的请求处理完后停止
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	for l := range s.listeners {
+		(*l).Close()
+	}
+	for rwc := range s.proxyConns {
+		rwc.Close()
+	}
+	for c := range s.conns {
+		// 客户端不读取时写 Disconnect 会阻塞，不能占用 s.mu
+		go c.disconnect(packet.DisconnectShutdown, "server shutting down", true)
+	}
+	if s.epoll != nil {
+		// 事件循环中的请求都是同步处理的，直接通知客户端并关闭连接
+		s.epoll.shutdown()
+	}
+	s.mu.Unlock()
+
+	// 轮询关闭空闲连接，间隔从 1ms 开始倍增，最大 500ms
+	pollInterval := time.Millisecond
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	for {
+		if s.closeIdleConns() && s.epollStopped() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-timer.C:
+			if pollInterval < shutdownPollIntervalMax {
+				pollInterval *= 2
+			}
+			timer.Reset(pollInterval)
+		}
+	}
+}
+
+// startEpoll 创建 EngineEpoll 的事件循环，多次 Serve 共用同一组事件循环
+func (s *Server) startEpoll() (*epollEngine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.epoll == nil {
+		loops := s.eventLoops
+		if loops <= 0 {
+			loops = runtime.NumCPU()
+		}
+		e, err := newEpollEngine(s, loops)
+		if err != nil {
+			return nil, err
+		}
+		s.epoll = e
+	}
+	return s.epoll, nil
+}
+
+func (s *Server) epollStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.epoll == nil || s.epoll.stopped()
+}
+
+// readTimeoutsEnabled 是否设置了任意一种读超时
+func (s *Server) readTimeoutsEnabled() bool {
+	return s.handshakeTimeout > 0 || s.idleTimeout > 0 || s.frameTimeout > 0
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+		s.closeWorkersLocked()
+	}
+	return true
+}
+
+// closeWorkersLocked Shutdown 开始后最后一个连接退出时停止 worker pool，调用方持有 s.mu。
+// 连接退出前会等待它交给 worker 的请求处理完，因此 Shutdown 超时返回后 worker 也会在剩余的请求处理完后退出
+func (s *Server) closeWorkersLocked() {
+	if s.workers != nil && len(s.conns) == 0 && s.shuttingDown() {
+		s.workers.close()
+	}
+}
+
+// closeIdleConns 关闭空闲连接，所有连接都已退出时返回 true
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.closeIfIdle()
+	}
+	s.closeWorkersLocked()
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.rwc.Close()
+	}
+	if s.epoll != nil {
+		s.epoll.shutdown()
+	}
+	s.closeWorkersLocked()
+}
+
+// serveConn 为 net.Conn 启动处理 goroutine，parent 不为 nil 时 rwc 是复用连接上的 stream，
+// 否则 rwc 是 Serve 接受的连接，退出时归还 admit 占用的连接名额
+func (s *Server) serveConn(rwc net.Conn, parent *conn, listenerConns prometheus.Gauge) {
+	c := s.newConn(rwc, parent)
+	if !s.trackConn(c, true) {
+		if parent == nil {
+			s.connClosed(remoteIP(rwc.RemoteAddr()), listenerConns)
+		}
+		rwc.Close()
+		return
+	}
+	if parent != nil {
+		parent.streams.Add(1)
+	}
+	go func() {
+		defer func() {
+			if parent != nil {
+				parent.streams.Add(-1)
+			} else {
+				s.connClosed(remoteIP(rwc.RemoteAddr()), listenerConns)
+			}
+			s.trackConn(c, false)
+		}()
+		c.serve()
+	}()
+}
+
+// connClosed 在 Serve 接受的连接关闭后归还连接名额，并更新所属 listener 的连接数
+func (s *Server) connClosed(ip string, listenerConns prometheus.Gauge) {
+	s.release(ip)
+	listenerConns.Dec()
+}
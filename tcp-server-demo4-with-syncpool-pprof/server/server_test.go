@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// ackHandler 对每个 Submit 回复 Result 为 0 的 SubmitAck
+var ackHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
+	if s, ok := r.Packet.(*packet.Submit); ok {
+		w.Write(&packet.SubmitAck{ID: s.ID, Result: 0})
+	}
+})
+
+func startServer(t *testing.T, h Handler, opts ...Option) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(h, opts...)
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, l.Addr().String()
+}
+
+func writeSubmit(t *testing.T, c net.Conn, id string) {
+	framePayload, err := packet.Encode(&packet.Submit{ID: id, Payload: []byte("hello")})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if err = frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+}
+
+func readPacket(t *testing.T, c net.Conn) packet.Packet {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	framePayload, err := frame.NewMyFrameCodec().Decode(c)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	p, err := packet.Decode(framePayload)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return p
+}
+
+func readSubmitAck(t *testing.T, c net.Conn) *packet.SubmitAck {
+	p := readPacket(t, c)
+	ack, ok := p.(*packet.SubmitAck)
+	if !ok {
+		t.Fatalf("want *packet.SubmitAck,actual %T", p)
+	}
+	return ack
+}
+
+func TestServer_SubmitAck(t *testing.T) {
+	_, addr := startServer(t, ackHandler)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	// 半关闭写端，服务端读到 EOF 后刷新写缓存
+	c.(*net.TCPConn).CloseWrite()
+
+	for i := 0; i < 10; i++ {
+		ack := readSubmitAck(t, c)
+		if want := fmt.Sprintf("%08d", i); ack.ID != want {
+			t.Errorf("want %s,actual %s", want, ack.ID)
+		}
+	}
+}
+
+func TestServer_Mux(t *testing.T) {
+	_, addr := startServer(t, ackHandler)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	session := mux.Client(c, nil)
+	defer session.Close()
+
+	for i := 0; i < 3; i++ {
+		stream, err := session.Open()
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		id := fmt.Sprintf("%08d", i)
+		writeSubmit(t, stream, id)
+		stream.Close()
+
+		if ack := readSubmitAck(t, stream); ack.ID != id {
+			t.Errorf("want %s,actual %s", id, ack.ID)
+		}
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	writeSubmit(t, c, "00000001")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("want ErrServerClosed,actual %v", err)
+	}
+
+	// Shutdown 前已处理的请求，其响应在连接关闭前被刷出，随后收到 Disconnect
+	if ack := readSubmitAck(t, c); ack.ID != "00000001" {
+		t.Errorf("want 00000001,actual %s", ack.ID)
+	}
+	d, ok := readPacket(t, c).(*packet.Disconnect)
+	if !ok || d.Code != packet.DisconnectShutdown {
+		t.Errorf("want shutdown disconnect,actual %v", d)
+	}
+}
+
+func TestServer_ShutdownDrainsInflight(t *testing.T) {
+	release := make(chan struct{})
+	slowHandler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-release
+		ackHandler(w, r)
+	})
+	srv, addr := startServer(t, slowHandler)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	writeSubmit(t, c, "00000001")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	// 正在处理请求的连接不会被关闭，Shutdown 等待其完成
+	select {
+	case err := <-done:
+		t.Fatalf("want Shutdown blocked,actual %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+
+	// 先收到 Disconnect，随后收到处理中请求的响应
+	if _, ok := readPacket(t, c).(*packet.Disconnect); !ok {
+		t.Errorf("want *packet.Disconnect")
+	}
+	if ack := readSubmitAck(t, c); ack.ID != "00000001" {
+		t.Errorf("want 00000001,actual %s", ack.ID)
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srv, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-block
+	}))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	writeSubmit(t, c, "00000001")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want context.DeadlineExceeded,actual %v", err)
+	}
+}
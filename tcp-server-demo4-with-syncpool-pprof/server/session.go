@@ -0,0 +1,39 @@
+package server
+
+import (
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+)
+
+// Sessions 返回在线会话的注册表。普通连接和复用连接上的每个 stream 各是一个会话，
+// 复用连接本身不是会话
+func (s *Server) Sessions() *session.Registry {
+	return s.sessions
+}
+
+// startSession 创建会话并加入注册表，在启动写 goroutine 之前调用
+func (c *conn) startSession() {
+	c.session = session.New(c.id, c.rwc.RemoteAddr(), c)
+	c.session.ProxyAddr = c.proxyAddr
+	c.server.sessions.Add(c.session)
+	if c.clientID != "" {
+		c.server.sessions.SetClientID(c.session, c.clientID)
+	}
+}
+
+// Kick 实现 session.Conn 接口，不会阻塞：把 Disconnect 放入出站队列后打断读 goroutine，
+// 连接 goroutine 随后写完出站队列中的 frame 并关闭连接。
+// 出站队列满说明客户端没有读取响应，不再发送 Disconnect，直接关闭连接。
+// Disconnect 必须在打断读 goroutine 之前入队，否则连接 goroutine 可能已经关闭出站队列
+func (c *conn) Kick(reason string) {
+	c.kicked.Store(true)
+	c.logger().Info("conn kicked", "reason", reason)
+	err := c.disconnect(packet.DisconnectKicked, reason, false)
+	c.rwc.SetReadDeadline(time.Now())
+	if err == errOutboundFull {
+		// 复用连接上 stream 的 Close 要写 FIN，底层连接写满时也会阻塞
+		go c.rwc.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/session"
+)
+
+// lookupSession 等待客户端标识为 clientID 的会话出现在注册表中
+func lookupSession(t *testing.T, r *session.Registry, clientID string) *session.Session {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if sessions := r.Lookup(clientID); len(sessions) == 1 {
+			return sessions[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want session of %s,actual %d sessions", clientID, len(r.Lookup(clientID)))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitSessions(t *testing.T, r *session.Registry, want int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Len() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d sessions,actual %d", want, r.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testSessions 在 opts 创建的服务端上验证会话的查找、计数、发送、广播和强制断开
+func testSessions(t *testing.T, opts ...Option) {
+	srv, addr := startServer(t, ackHandler, opts...)
+	sessions := srv.Sessions()
+	c1 := dialClient(t, addr, "device-1")
+	c2 := dialClient(t, addr, "device-2")
+	submitResult(t, c1, "00000001")
+	submitResult(t, c2, "00000001")
+
+	s1 := lookupSession(t, sessions, "device-1")
+	if stats := s1.Stats(); stats.PacketsIn != 2 || stats.PacketsOut != 1 {
+		t.Errorf("want 2 packets in and 1 out,actual %+v", stats)
+	}
+	if s1.RemoteAddr.String() != c1.LocalAddr().String() {
+		t.Errorf("want %s,actual %s", c1.LocalAddr(), s1.RemoteAddr)
+	}
+
+	if err := s1.Send(&packet.SubmitAck{ID: "push0001"}); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if ack := readSubmitAck(t, c1); ack.ID != "push0001" {
+		t.Errorf("want push0001,actual %s", ack.ID)
+	}
+
+	if n := sessions.Broadcast(&packet.SubmitAck{ID: "bcast001"}); n != 2 {
+		t.Errorf("want 2,actual %d", n)
+	}
+	if ack := readSubmitAck(t, c1); ack.ID != "bcast001" {
+		t.Errorf("want bcast001,actual %s", ack.ID)
+	}
+	if ack := readSubmitAck(t, c2); ack.ID != "bcast001" {
+		t.Errorf("want bcast001,actual %s", ack.ID)
+	}
+
+	s1.Kick("maintenance")
+	d, ok := readPacket(t, c1).(*packet.Disconnect)
+	if !ok || d.Code != packet.DisconnectKicked || d.Reason != "maintenance" {
+		t.Fatalf("want kicked disconnect,actual %+v", d)
+	}
+	waitClosed(t, c1)
+	waitSessions(t, sessions, 1)
+
+	// 其他会话不受影响
+	if result := submitResult(t, c2, "00000002"); result != packet.ResultOK {
+		t.Errorf("want %d,actual %d", packet.ResultOK, result)
+	}
+}
+
+func TestServer_Sessions(t *testing.T) {
+	testSessions(t)
+}
+
+func TestServer_SessionsMuxStream(t *testing.T) {
+	srv, addr := startServer(t, ackHandler)
+	c := dialClient(t, addr, "")
+	client := mux.Client(c, nil)
+	defer client.Close()
+
+	streams := make([]net.Conn, 2)
+	for i, id := range []string{"device-1", "device-2"} {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		writeConn(t, stream, id)
+		streams[i] = stream
+	}
+
+	// 强制断开一个 stream，同一复用连接上的其他 stream 不受影响
+	lookupSession(t, srv.Sessions(), "device-1").Kick("maintenance")
+	if d, ok := readPacket(t, streams[0]).(*packet.Disconnect); !ok || d.Code != packet.DisconnectKicked {
+		t.Fatalf("want kicked disconnect,actual %+v", d)
+	}
+	lookupSession(t, srv.Sessions(), "device-2")
+	waitSessions(t, srv.Sessions(), 1)
+	if result := submitResult(t, streams[1], "00000001"); result != packet.ResultOK {
+		t.Errorf("want %d,actual %d", packet.ResultOK, result)
+	}
+}
+
+func TestServer_KickNotReading(t *testing.T) {
+	srv, addr := startServer(t, ackHandler, WithWriteTimeout(0), WithOutboundQueueSize(1))
+	dialClient(t, addr, "device-1")
+	s := lookupSession(t, srv.Sessions(), "device-1")
+
+	// 客户端不读取，写 goroutine 阻塞后出站队列被填满
+	big := &packet.Disconnect{Reason: strings.Repeat("x", 64<<10)}
+	go func() {
+		for s.Send(big) == nil {
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// 没有写超时时 Kick 也不阻塞，连接被直接关闭
+	kicked := make(chan struct{})
+	go func() {
+		s.Kick("maintenance")
+		close(kicked)
+	}()
+	select {
+	case <-kicked:
+	case <-time.After(time.Second):
+		t.Fatalf("want kick returned,actual blocked")
+	}
+	waitSessions(t, srv.Sessions(), 0)
+}
+
+func TestServer_BroadcastNotReading(t *testing.T) {
+	srv, addr := startServer(t, ackHandler, WithWriteTimeout(0), WithOutboundQueueSize(1))
+	dialClient(t, addr, "device-1")
+	c2 := dialClient(t, addr, "device-2")
+	s1 := lookupSession(t, srv.Sessions(), "device-1")
+	lookupSession(t, srv.Sessions(), "device-2")
+
+	// device-1 不读取，写 goroutine 阻塞后出站队列被填满
+	big := &packet.Disconnect{Reason: strings.Repeat("x", 64<<10)}
+	go func() {
+		for s1.Send(big) == nil {
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// 没有写超时时 Broadcast 也不阻塞，跳过 device-1
+	done := make(chan int, 1)
+	go func() {
+		done <- srv.Sessions().Broadcast(&packet.SubmitAck{ID: "bcast001"})
+	}()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("want 1,actual %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("want broadcast returned,actual blocked")
+	}
+	if ack := readSubmitAck(t, c2); ack.ID != "bcast001" {
+		t.Errorf("want bcast001,actual %s", ack.ID)
+	}
+}
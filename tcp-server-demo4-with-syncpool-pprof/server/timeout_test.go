@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// waitClosed 等待服务端关闭连接，返回从调用到连接关闭的时间
+func waitClosed(t *testing.T, c net.Conn) time.Duration {
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("want closed by server,actual %s", err.Error())
+			}
+			return time.Since(start)
+		}
+	}
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	testHandshakeTimeout(t)
+}
+
+func testHandshakeTimeout(t *testing.T, opts ...Option) {
+	_, addr := startServer(t, ackHandler, append(opts, WithHandshakeTimeout(50*time.Millisecond), WithIdleTimeout(time.Hour))...)
+	before := testutil.ToFloat64(metrics.HandshakeTimeoutTotal)
+
+	// 建立连接后什么都不发送
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	waitClosed(t, c)
+
+	// 只发送半个 frame 同样受 handshakeTimeout 约束
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c2.Close()
+	c2.Write([]byte{0x0, 0x0, 0x0, 0x10, 0x02})
+	waitClosed(t, c2)
+
+	if d := testutil.ToFloat64(metrics.HandshakeTimeoutTotal) - before; d != 2 {
+		t.Errorf("want 2,actual %v", d)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	testIdleTimeout(t)
+}
+
+func testIdleTimeout(t *testing.T, opts ...Option) {
+	_, addr := startServer(t, ackHandler, append(opts, WithHandshakeTimeout(time.Second), WithIdleTimeout(50*time.Millisecond))...)
+	before := testutil.ToFloat64(metrics.IdleTimeoutTotal)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+
+	// 有请求时连接保持，空闲后关闭
+	for i := 0; i < 3; i++ {
+		writeSubmit(t, c, "00000001")
+		readSubmitAck(t, c)
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitClosed(t, c)
+
+	if d := testutil.ToFloat64(metrics.IdleTimeoutTotal) - before; d != 1 {
+		t.Errorf("want 1,actual %v", d)
+	}
+}
+
+func TestServer_FrameTimeout(t *testing.T) {
+	testFrameTimeout(t)
+}
+
+func testFrameTimeout(t *testing.T, opts ...Option) {
+	_, addr := startServer(t, ackHandler, append(opts, WithIdleTimeout(time.Hour), WithFrameTimeout(50*time.Millisecond))...)
+	before := testutil.ToFloat64(metrics.FrameTimeoutTotal)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	writeSubmit(t, c, "00000001")
+	readSubmitAck(t, c)
+
+	// 慢速发送：只发送 frame 的一部分
+	c.Write([]byte{0x0, 0x0, 0x0, 0x10, 0x02})
+	waitClosed(t, c)
+
+	if d := testutil.ToFloat64(metrics.FrameTimeoutTotal) - before; d != 1 {
+		t.Errorf("want 1,actual %v", d)
+	}
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+	testWriteTimeout(t)
+}
+
+func testWriteTimeout(t *testing.T, opts ...Option) {
+	bigAck := HandlerFunc(func(w ResponseWriter, r *Request) {
+		// 用大包尽快填满客户端的接收缓冲区
+		w.Write(&packet.Disconnect{Code: 0, Reason: string(make([]byte, 64*1024))})
+	})
+	_, addr := startServer(t, bigAck, append(opts, WithWriteTimeout(50*time.Millisecond))...)
+	before := testutil.ToFloat64(metrics.WriteTimeoutTotal)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+
+	// 客户端只发送不读取
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && testutil.ToFloat64(metrics.WriteTimeoutTotal) == before {
+		c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		framePayload, _ := packet.Encode(&packet.Submit{ID: "00000001", Payload: []byte("x")})
+		if err := frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+			break
+		}
+	}
+	waitMetric(t, metrics.WriteTimeoutTotal, before+1)
+}
+
+func waitMetric(t *testing.T, m prometheus.Collector, want float64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if testutil.ToFloat64(m) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("want %v,actual %v", want, testutil.ToFloat64(m))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+)
+
+// errTLSEpoll EngineEpoll 不支持 TLS
+var errTLSEpoll = errors.New("server: tls is not supported with the epoll engine")
+
+// WithTLSConfig 启用 TLS，Serve 用 config 包装接受的连接(在 PROXY 头之后)。
+// config 要求并校验客户端证书(双向 TLS)时，客户端证书的 Subject 作为连接的客户端标识，
+// 此后 Conn 包中的客户端标识被忽略
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithClientIdentity 设置从已校验的客户端证书得到客户端标识的方法，默认使用 Subject.CommonName
+func WithClientIdentity(fn func(cert *x509.Certificate) string) Option {
+	return func(s *Server) {
+		s.clientIdentity = fn
+	}
+}
+
+func defaultClientIdentity(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// handshake 完成 TLS 握手，记录连接状态和客户端证书对应的客户端标识。
+// 握手受 handshakeTimeout 约束，握手期间连接处于空闲状态，Shutdown 可以直接关闭
+func (c *conn) handshake(tlsConn *tls.Conn) bool {
+	ctx := context.Background()
+	if !c.handshakeDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.handshakeDeadline)
+		defer cancel()
+	}
+	c.state.Store(stateIdle)
+	err := tlsConn.HandshakeContext(ctx)
+	if !c.state.CompareAndSwap(stateIdle, stateActive) {
+		return false
+	}
+	if err != nil {
+		metrics.TLSHandshakeErrorTotal.Inc()
+		c.logger().Info("tls handshake error", "err", err)
+		return false
+	}
+
+	state := tlsConn.ConnectionState()
+	c.tlsState = &state
+	if len(state.VerifiedChains) > 0 {
+		c.certIdentity = c.server.clientIdentity(state.PeerCertificates[0])
+		c.clientID = c.certIdentity
+		c.setLogger()
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/internal/testcert"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/mux"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/tlsutil"
+)
+
+// tlsFixture 生成 CA、服务端证书和 CommonName 为 device-1 的客户端证书
+type tlsFixture struct {
+	server *tls.Config // 要求客户端证书
+	client *tls.Config // 带客户端证书
+	anon   *tls.Config // 不带客户端证书
+}
+
+func newTLSFixture(t *testing.T) *tlsFixture {
+	dir := t.TempDir()
+	ca := testcert.NewCA(t, "test-ca")
+	caFile := testcert.WriteFile(t, dir, "ca.pem", ca.PEM)
+	serverCert, serverKey := ca.Issue(t, "server")
+	clientCert, clientKey := ca.Issue(t, "device-1")
+
+	certs, err := tlsutil.NewServerReloader(tlsutil.ServerOptions{
+		CertFile:     testcert.WriteFile(t, dir, "server.pem", serverCert),
+		KeyFile:      testcert.WriteFile(t, dir, "server-key.pem", serverKey),
+		ClientCAFile: caFile,
+	})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	client, err := tlsutil.ClientConfig(tlsutil.ClientOptions{
+		CAFile:   caFile,
+		CertFile: testcert.WriteFile(t, dir, "client.pem", clientCert),
+		KeyFile:  testcert.WriteFile(t, dir, "client-key.pem", clientKey),
+	})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	anon, err := tlsutil.ClientConfig(tlsutil.ClientOptions{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return &tlsFixture{server: certs.Config(), client: client, anon: anon}
+}
+
+func dialTLS(t *testing.T, addr string, config *tls.Config) net.Conn {
+	c, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// identityHandler 把每个 Submit 的客户端标识发给 ids，并回复 SubmitAck
+func identityHandler(ids chan<- string) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if s, ok := r.Packet.(*packet.Submit); ok {
+			if r.TLS == nil {
+				ids <- "<no tls>"
+			} else {
+				ids <- r.ClientID
+			}
+			w.Write(&packet.SubmitAck{ID: s.ID, Result: 0})
+		}
+	})
+}
+
+func TestServer_TLSClientIdentity(t *testing.T) {
+	f := newTLSFixture(t)
+	ids := make(chan string, 4)
+	_, addr := startServer(t, identityHandler(ids), WithTLSConfig(f.server))
+
+	c := dialTLS(t, addr, f.client)
+	// 客户端证书确定的标识优先于 Conn 包中的标识
+	writeConn(t, c, "spoofed")
+	writeSubmit(t, c, "00000001")
+	readSubmitAck(t, c)
+	if id := <-ids; id != "device-1" {
+		t.Errorf("want device-1,actual %s", id)
+	}
+
+	// 复用连接上的 stream 继承客户端证书的标识
+	session := mux.Client(dialTLS(t, addr, f.client), nil)
+	defer session.Close()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	writeSubmit(t, stream, "00000002")
+	readSubmitAck(t, stream)
+	if id := <-ids; id != "device-1" {
+		t.Errorf("want device-1,actual %s", id)
+	}
+}
+
+func TestServer_TLSClientCertRequired(t *testing.T) {
+	f := newTLSFixture(t)
+	_, addr := startServer(t, ackHandler, WithTLSConfig(f.server))
+	before := testutil.ToFloat64(metrics.TLSHandshakeErrorTotal)
+
+	// TLS 1.3 中客户端握手先于服务端校验完成，服务端拒绝后读取失败
+	c, err := tls.Dial("tcp", addr, f.anon)
+	if err == nil {
+		defer c.Close()
+		writeSubmit(t, c, "00000001")
+		if _, err = c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("want non-nil,actual nil")
+		}
+	}
+	waitMetric(t, metrics.TLSHandshakeErrorTotal, before+1)
+}
+
+func TestServer_TLSEpollUnsupported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	srv := New(ackHandler, WithEngine(EngineEpoll), WithTLSConfig(&tls.Config{}))
+	if err := srv.Serve(l); err != errTLSEpoll {
+		t.Errorf("want %v,actual %v", errTLSEpoll, err)
+	}
+}
+
+func TestServer_TLSRejectWithoutHandshake(t *testing.T) {
+	fx := newTLSFixture(t)
+	_, addr := startServer(t, ackHandler, WithTLSConfig(fx.server), WithIPFilter(IPFilter{Deny: prefixes("127.0.0.1/32")}))
+	denied := metrics.ConnRejectedTotal.WithLabelValues(rejectIPDenied)
+	before := testutil.ToFloat64(denied)
+
+	// 被拒绝的客户端不发送 ClientHello，服务端也不等待握手，直接关闭连接
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	waitClosed(t, c)
+	if actual := testutil.ToFloat64(denied); actual != before+1 {
+		t.Errorf("want %v,actual %v", before+1, actual)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// 每个连接一个读 goroutine 和一个写 goroutine，两者通过有界的出站队列连接：
+// ResponseWriter.Write 编码 packet 后放入出站队列，写 goroutine 合并队列中已有的 frame 后按 FlushPolicy 刷新写缓存。
+// 出站队列满时 Write 阻塞，Handler 在读 goroutine 中同步调用 Write 时读取随之暂停
+
+const defaultOutboundQueueSize = 64
+
+// ErrConnClosed 连接已关闭，ResponseWriter.Write 返回该错误
+var ErrConnClosed = errors.New("server: connection closed")
+
+// errOutboundFull 出站队列已满，不阻塞的入队返回该错误
+var errOutboundFull = errors.New("server: outbound queue full")
+
+// WithOutboundQueueSize 设置每个连接出站队列的长度，默认 64
+func WithOutboundQueueSize(size int) Option {
+	return func(s *Server) {
+		s.outboundQueueSize = size
+	}
+}
+
+// Write 实现 ResponseWriter 接口，编码 packet 并放入出站队列，调用返回后 p 可以被复用。
+// 可以在任意 goroutine 中调用，出站队列满时阻塞，连接关闭后返回 ErrConnClosed
+func (c *conn) Write(p packet.Packet) error {
+	framePayload, err := packet.Encode(p)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(framePayload, true)
+}
+
+// TryWrite 实现 session.Conn 接口，与 Write 相同，但出站队列满时返回 errOutboundFull
+func (c *conn) TryWrite(p packet.Packet) error {
+	framePayload, err := packet.Encode(p)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(framePayload, false)
+}
+
+// enqueue 把 frame 放入出站队列，block 为 false 时队列满则返回 errOutboundFull
+func (c *conn) enqueue(framePayload []byte, block bool) error {
+	c.outMu.RLock()
+	defer c.outMu.RUnlock()
+	if !c.outOpen {
+		return ErrConnClosed
+	}
+	// 入队之前计入内存预算，写 goroutine 写出后归还
+	size := int64(len(framePayload))
+	c.server.budget.acquire(size, 1)
+	if !block {
+		select {
+		case c.out <- framePayload:
+			return nil
+		default:
+			c.server.budget.release(size, 1)
+			return errOutboundFull
+		}
+	}
+	select {
+	case c.out <- framePayload:
+		return nil
+	case <-c.writerDone:
+		c.server.budget.release(size, 1)
+		return ErrConnClosed
+	}
+}
+
+// disconnect 通知客户端断开连接，只发送一次。block 为 false 时出站队列满则放弃发送，返回 errOutboundFull
+func (c *conn) disconnect(code uint8, reason string, block bool) error {
+	err := ErrConnClosed
+	c.disconnectOnce.Do(func() {
+		var framePayload []byte
+		if framePayload, err = packet.Encode(&packet.Disconnect{Code: code, Reason: reason}); err != nil {
+			return
+		}
+		if err = c.enqueue(framePayload, block); err == nil {
+			c.requestFlush()
+		}
+	})
+	return err
+}
+
+// requestFlush 通知写 goroutine 写完队列中的 frame 后立即刷新写缓存
+func (c *conn) requestFlush() {
+	select {
+	case c.flushReq <- struct{}{}:
+	default:
+	}
+}
+
+// startWriter 启动写 goroutine
+func (c *conn) startWriter() {
+	c.wbuf = bufio.NewWriterSize(c.rwc, c.server.writeBufferSize)
+	c.outMu.Lock()
+	c.outOpen = true
+	c.outMu.Unlock()
+	go c.writeLoop()
+}
+
+// closeOutbound 关闭出站队列，之后的 Write 返回 ErrConnClosed，写 goroutine 写完剩余的 frame 后退出
+func (c *conn) closeOutbound() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.outOpen {
+		c.outOpen = false
+		close(c.quit)
+	}
+}
+
+// writeLoop 写 goroutine，写连接出错时关闭连接，让读 goroutine 也退出
+func (c *conn) writeLoop() {
+	defer close(c.writerDone)
+
+	policy := c.server.flushPolicy
+	// FlushPolicy.Interval 启用时，写缓存由空变为非空后启动的刷新定时器
+	var flushTimer *time.Timer
+	var flushC <-chan time.Time
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+	}()
+
+	var err error
+	for quit := false; err == nil && !quit; {
+		select {
+		case framePayload := <-c.out:
+			// 合并队列中已有的 frame 后再决定是否刷新
+			if err = c.writeFrames(framePayload); err != nil {
+				break
+			}
+			if policy.OnIdle && c.state.Load() != stateActive {
+				err = c.flush()
+			} else if policy.Interval > 0 && flushC == nil && c.wbuf.Buffered() > 0 {
+				// 写缓存中第一个未刷新的响应开始计时
+				if flushTimer == nil {
+					flushTimer = time.NewTimer(policy.Interval)
+				} else {
+					flushTimer.Reset(policy.Interval)
+				}
+				flushC = flushTimer.C
+			}
+		case <-flushC:
+			flushC = nil
+			err = c.flush()
+		case <-c.flushReq:
+			if err = c.writeFrames(nil); err == nil {
+				err = c.flush()
+			}
+		case <-c.quit:
+			// 读 goroutine 已退出，不会再有新的 frame 入队
+			if err = c.writeFrames(nil); err == nil {
+				err = c.flush()
+			}
+			quit = true
+		}
+	}
+	if err != nil {
+		c.writeError(err)
+		c.rwc.Close()
+	}
+}
+
+// writeFrames 把 framePayload 和出站队列中已有的 frame 写入写缓存
+func (c *conn) writeFrames(framePayload []byte) error {
+	for {
+		if framePayload != nil {
+			if err := c.writeFrame(framePayload); err != nil {
+				return err
+			}
+		}
+		select {
+		case framePayload = <-c.out:
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *conn) writeFrame(framePayload []byte) error {
+	defer c.server.budget.release(int64(len(framePayload)), 1)
+	// 写缓存满时 bufio 会直接写入连接
+	c.setWriteDeadline()
+	// write ack frame to the connection
+	if err := c.frameCodec.Encode(c.wbuf, framePayload); err != nil {
+		return err
+	}
+	metrics.RspSendTotal.Add(1) // 返回响应后，RspSendTotal 消息计数器 +1
+	c.session.RecordOut(len(framePayload))
+
+	if bytes := c.server.flushPolicy.Bytes; bytes > 0 && c.wbuf.Buffered() >= bytes {
+		return c.flush()
+	}
+	return nil
+}
+
+// flush 把写缓存中的数据写入连接
+func (c *conn) flush() error {
+	if c.wbuf.Buffered() == 0 {
+		return nil
+	}
+	c.setWriteDeadline()
+	return c.wbuf.Flush()
+}
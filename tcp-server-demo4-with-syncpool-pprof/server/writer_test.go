@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+func TestServer_AsyncReply(t *testing.T) {
+	// 先收到的请求后回复
+	asyncHandler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		s := r.Packet.(*packet.Submit)
+		id := s.ID // Request.Packet 在 ServePacket 返回后被复用，异步回复前先复制
+		var delay time.Duration
+		fmt.Sscanf(id, "%d", &delay)
+		go func() {
+			time.Sleep((3 - delay) * 20 * time.Millisecond)
+			w.Write(&packet.SubmitAck{ID: id, Result: packet.ResultOK})
+		}()
+	})
+	_, addr := startServer(t, asyncHandler)
+	c := dialClient(t, addr, "")
+
+	for i := 0; i < 3; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+	for i := 2; i >= 0; i-- {
+		if ack, want := readSubmitAck(t, c), fmt.Sprintf("%08d", i); ack.ID != want {
+			t.Errorf("want %s,actual %s", want, ack.ID)
+		}
+	}
+}
+
+func TestServer_WriteAfterClose(t *testing.T) {
+	writers := make(chan ResponseWriter, 1)
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		writers <- w
+	}))
+	c := dialClient(t, addr, "")
+	writeSubmit(t, c, "00000001")
+	w := <-writers
+	c.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := w.Write(&packet.SubmitAck{ID: "00000001"}); err == ErrConnClosed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("want ErrConnClosed,actual nil")
+}
+
+// gatedListener 接受的连接在 gate 关闭前阻塞所有 Write
+type gatedListener struct {
+	net.Listener
+	gate chan struct{}
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{Conn: c, gate: l.gate}, nil
+}
+
+type gatedConn struct {
+	net.Conn
+	gate chan struct{}
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	<-c.gate
+	return c.Conn.Write(p)
+}
+
+func TestServer_OutboundBackpressure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	gate := make(chan struct{})
+	var handled atomic.Int32
+	srv := New(HandlerFunc(func(w ResponseWriter, r *Request) {
+		handled.Add(1)
+		ackHandler(w, r)
+	}), WithOutboundQueueSize(1), WithWriteBufferSize(16))
+	go srv.Serve(&gatedListener{Listener: l, gate: gate})
+	defer srv.closeConns()
+
+	c := dialClient(t, l.Addr().String(), "")
+	const n = 50
+	for i := 0; i < n; i++ {
+		writeSubmit(t, c, fmt.Sprintf("%08d", i))
+	}
+
+	// 写 goroutine 阻塞，出站队列满后读取暂停
+	time.Sleep(100 * time.Millisecond)
+	if h := handled.Load(); h >= 10 {
+		t.Errorf("want < 10,actual %d", h)
+	}
+
+	close(gate)
+	for i := 0; i < n; i++ {
+		if ack, want := readSubmitAck(t, c), fmt.Sprintf("%08d", i); ack.ID != want {
+			t.Fatalf("want %s,actual %s", want, ack.ID)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package session
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// session 包维护服务端当前在线的逻辑连接(普通连接和复用连接上的 stream)
+/*
+Registry
+	按连接编号和客户端标识索引所有 Session，Handler 和管理工具可以并发地查询、
+	向单个会话发送 packet、广播或强制断开连接
+Session
+	一个逻辑连接的编号、客户端地址、客户端标识、建立时间和收发计数，
+	由服务端在连接开始处理 frame 时创建、关闭时移除
+*/
+
+// Conn 会话对应的连接，由服务端实现
+type Conn interface {
+	// Write 编码 packet 并发送给客户端，可以在任意 goroutine 中调用
+	Write(p packet.Packet) error
+	// TryWrite 与 Write 相同，但出站队列满时不阻塞，直接返回错误
+	TryWrite(p packet.Packet) error
+	// Kick 向客户端发送 Disconnect 后关闭连接，不等待关闭完成
+	Kick(reason string)
+}
+
+// Session 一个在线的逻辑连接
+type Session struct {
+	ID          uint64    // 连接编号，同一个服务端内唯一
+	RemoteAddr  net.Addr  // 客户端地址，经 PROXY protocol 转发时为头中的真实地址
+	ProxyAddr   net.Addr  // 经 PROXY protocol 转发时为负载均衡的地址，否则为 nil
+	ConnectedAt time.Time // 连接建立的时间
+
+	conn     Conn
+	clientID atomic.Pointer[string]
+
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+}
+
+// Stats 会话的收发计数，字节数为 frame payload 的长度
+type Stats struct {
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
+}
+
+// New 创建一个会话，之后由 Registry.Add 加入注册表
+func New(id uint64, remoteAddr net.Addr, conn Conn) *Session {
+	s := &Session{
+		ID:          id,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+		conn:        conn,
+	}
+	s.clientID.Store(new(string))
+	return s
+}
+
+// ClientID 返回客户端标识，客户端尚未发送 Conn 包时为空
+func (s *Session) ClientID() string {
+	return *s.clientID.Load()
+}
+
+// Stats 返回当前的收发计数
+func (s *Session) Stats() Stats {
+	return Stats{
+		PacketsIn:  s.packetsIn.Load(),
+		PacketsOut: s.packetsOut.Load(),
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+	}
+}
+
+// RecordIn 由服务端在收到一个 packet 后调用
+func (s *Session) RecordIn(size int) {
+	s.packetsIn.Add(1)
+	s.bytesIn.Add(uint64(size))
+}
+
+// RecordOut 由服务端在发出一个 packet 后调用
+func (s *Session) RecordOut(size int) {
+	s.packetsOut.Add(1)
+	s.bytesOut.Add(uint64(size))
+}
+
+// Send 向会话发送 packet，调用返回后 p 可以被复用。出站队列满时阻塞，连接关闭后返回错误
+func (s *Session) Send(p packet.Packet) error {
+	return s.conn.Write(p)
+}
+
+// TrySend 与 Send 相同，但出站队列满时不阻塞，直接返回错误
+func (s *Session) TrySend(p packet.Packet) error {
+	return s.conn.TryWrite(p)
+}
+
+// Kick 强制断开会话：客户端先收到 code 为 packet.DisconnectKicked 的 Disconnect，之后连接被关闭
+func (s *Session) Kick(reason string) {
+	s.conn.Kick(reason)
+}
+
+// Registry 在线会话的注册表，可以在多个 goroutine 中并发使用
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[uint64]*Session
+	byClient map[string]map[uint64]*Session // 同一个客户端标识可能对应多条连接
+}
+
+// NewRegistry 创建一个空的注册表
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[uint64]*Session),
+		byClient: make(map[string]map[uint64]*Session),
+	}
+}
+
+// Add 加入会话
+func (r *Registry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.ID] = s
+	r.indexLocked(s, s.ClientID())
+}
+
+// Remove 移除会话，连接关闭后调用
+func (r *Registry) Remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s.ID)
+	r.unindexLocked(s, s.ClientID())
+}
+
+// SetClientID 更新会话的客户端标识
+func (r *Registry) SetClientID(s *Session, clientID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := s.ClientID()
+	if old == clientID {
+		return
+	}
+	s.clientID.Store(&clientID)
+	if _, ok := r.sessions[s.ID]; !ok {
+		// 尚未加入或已经移除，只更新标识
+		return
+	}
+	r.unindexLocked(s, old)
+	r.indexLocked(s, clientID)
+}
+
+func (r *Registry) indexLocked(s *Session, clientID string) {
+	if clientID == "" {
+		return
+	}
+	m := r.byClient[clientID]
+	if m == nil {
+		m = make(map[uint64]*Session)
+		r.byClient[clientID] = m
+	}
+	m[s.ID] = s
+}
+
+func (r *Registry) unindexLocked(s *Session, clientID string) {
+	m := r.byClient[clientID]
+	if m == nil {
+		return
+	}
+	delete(m, s.ID)
+	if len(m) == 0 {
+		delete(r.byClient, clientID)
+	}
+}
+
+// Get 按连接编号查找会话
+func (r *Registry) Get(id uint64) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Lookup 按客户端标识查找会话，按连接编号排序
+func (r *Registry) Lookup(clientID string) []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sorted(r.byClient[clientID])
+}
+
+// List 返回所有会话的快照，按连接编号排序
+func (r *Registry) List() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sorted(r.sessions)
+}
+
+// Len 返回在线会话数
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// Broadcast 依次向所有会话发送 p，返回发送成功的会话数。
+// 不阻塞：出站队列已满(客户端没有读取)的会话被跳过，不计入成功数
+func (r *Registry) Broadcast(p packet.Packet) int {
+	n := 0
+	for _, s := range r.List() {
+		if err := s.TrySend(p); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func sorted(m map[uint64]*Session) []*Session {
+	list := make([]*Session, 0, len(m))
+	for _, s := range m {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,132 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+var errFull = errors.New("outbound queue full")
+
+// fakeConn 记录写入的 packet 和 Kick 的原因
+type fakeConn struct {
+	mu      sync.Mutex
+	written []packet.Packet
+	kicked  string
+	closed  bool
+	full    bool // 模拟客户端不读取，TryWrite 返回错误
+}
+
+func (c *fakeConn) Write(p packet.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.written = append(c.written, p)
+	return nil
+}
+
+func (c *fakeConn) TryWrite(p packet.Packet) error {
+	c.mu.Lock()
+	full := c.full
+	c.mu.Unlock()
+	if full {
+		return errFull
+	}
+	return c.Write(p)
+}
+
+func (c *fakeConn) Kick(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kicked = reason
+	c.closed = true
+}
+
+func addSession(r *Registry, id uint64, clientID string) (*Session, *fakeConn) {
+	c := &fakeConn{}
+	s := New(id, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(id)}, c)
+	r.Add(s)
+	if clientID != "" {
+		r.SetClientID(s, clientID)
+	}
+	return s, c
+}
+
+func ids(sessions []*Session) []uint64 {
+	var ids []uint64
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestRegistry_Lookup(t *testing.T) {
+	r := NewRegistry()
+	s1, _ := addSession(r, 1, "device-1")
+	addSession(r, 3, "device-2")
+	addSession(r, 2, "device-1")
+	addSession(r, 4, "")
+
+	if got := ids(r.Lookup("device-1")); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("want [1 2],actual %v", got)
+	}
+	if got := ids(r.List()); len(got) != 4 || got[0] != 1 || got[3] != 4 {
+		t.Errorf("want [1 2 3 4],actual %v", got)
+	}
+
+	// 客户端标识变化后按新标识索引
+	r.SetClientID(s1, "device-2")
+	if got := ids(r.Lookup("device-1")); len(got) != 1 || got[0] != 2 {
+		t.Errorf("want [2],actual %v", got)
+	}
+	if got := ids(r.Lookup("device-2")); len(got) != 2 || got[0] != 1 {
+		t.Errorf("want [1 3],actual %v", got)
+	}
+
+	r.Remove(s1)
+	if _, ok := r.Get(1); ok {
+		t.Errorf("want session 1 removed,actual found")
+	}
+	if got := ids(r.Lookup("device-2")); len(got) != 1 || got[0] != 3 {
+		t.Errorf("want [3],actual %v", got)
+	}
+	if r.Len() != 3 {
+		t.Errorf("want 3,actual %d", r.Len())
+	}
+}
+
+func TestRegistry_BroadcastAndKick(t *testing.T) {
+	r := NewRegistry()
+	s1, c1 := addSession(r, 1, "device-1")
+	_, c2 := addSession(r, 2, "device-2")
+	_, c3 := addSession(r, 3, "device-3")
+	c3.full = true
+
+	s1.Kick("maintenance")
+	if c1.kicked != "maintenance" {
+		t.Errorf("want maintenance,actual %s", c1.kicked)
+	}
+	// 已断开和出站队列已满的会话写入失败，不计入成功数
+	if n := r.Broadcast(&packet.Disconnect{Code: packet.DisconnectShutdown}); n != 1 {
+		t.Errorf("want 1,actual %d", n)
+	}
+	if len(c2.written) != 1 {
+		t.Errorf("want 1,actual %d", len(c2.written))
+	}
+}
+
+func TestSession_Stats(t *testing.T) {
+	s := New(1, nil, &fakeConn{})
+	s.RecordIn(10)
+	s.RecordIn(5)
+	s.RecordOut(9)
+	want := Stats{PacketsIn: 2, PacketsOut: 1, BytesIn: 15, BytesOut: 9}
+	if got := s.Stats(); got != want {
+		t.Errorf("want %+v,actual %+v", want, got)
+	}
+}
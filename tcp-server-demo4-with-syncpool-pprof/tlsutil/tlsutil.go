@@ -0,0 +1,157 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// tlsutil 包根据证书文件创建 server 和 client 使用的 tls.Config
+/*
+服务端
+	ServerReloader 持有证书、私钥和(可选的)客户端 CA，Reload 重新读取文件，
+	之后的新连接使用新的证书，已建立的连接不受影响。
+	设置了客户端 CA 时启用双向 TLS，要求客户端提供由该 CA 签发的证书
+客户端
+	ClientConfig 使用指定的 CA 校验服务端证书，设置了客户端证书时在双向 TLS 中提供给服务端
+*/
+
+// ServerOptions 服务端 TLS 配置
+type ServerOptions struct {
+	CertFile     string // 服务端证书(PEM)
+	KeyFile      string // 服务端私钥(PEM)
+	ClientCAFile string // 校验客户端证书的 CA(PEM)，为空时不要求客户端证书
+	MinVersion   string // 最低 TLS 版本："1.2" 或 "1.3"，为空时为 1.2
+}
+
+// ClientOptions 客户端 TLS 配置
+type ClientOptions struct {
+	CAFile     string // 校验服务端证书的 CA(PEM)，为空时使用系统 CA
+	CertFile   string // 客户端证书(PEM)，双向 TLS 时使用
+	KeyFile    string // 客户端私钥(PEM)
+	ServerName string // 校验服务端证书时使用的主机名，为空时使用拨号地址中的主机名
+	MinVersion string // 最低 TLS 版本："1.2" 或 "1.3"，为空时为 1.2
+}
+
+// ParseVersion 解析 TLS 版本号
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version %q, want 1.2 or 1.3", v)
+	}
+}
+
+// ServerReloader 可以在运行时重新加载证书文件的服务端 TLS 配置
+type ServerReloader struct {
+	opts ServerOptions
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// NewServerReloader 读取证书文件并创建 ServerReloader
+func NewServerReloader(opts ServerOptions) (*ServerReloader, error) {
+	r := &ServerReloader{opts: opts}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新读取证书文件，失败时继续使用原来的配置
+func (r *ServerReloader) Reload() error {
+	config, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *ServerReloader) load() (*tls.Config, error) {
+	minVersion, err := ParseVersion(r.opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+	if r.opts.ClientCAFile != "" {
+		pool, err := loadCertPool(r.opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Config 返回用于 tls.NewListener 的配置，每个新连接使用最近一次加载的证书
+func (r *ServerReloader) Config() *tls.Config {
+	r.mu.RLock()
+	minVersion := r.config.MinVersion
+	r.mu.RUnlock()
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// ClientConfig 创建客户端使用的 tls.Config
+func ClientConfig(opts ClientOptions) (*tls.Config, error) {
+	minVersion, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: minVersion,
+	}
+	if opts.CAFile != "" {
+		if config.RootCAs, err = loadCertPool(opts.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("tls cert and key must be set together")
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
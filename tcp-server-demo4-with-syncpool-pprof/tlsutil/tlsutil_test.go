@@ -0,0 +1,163 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/internal/testcert"
+)
+
+// handshake 用 serverConfig 和 clientConfig 完成一次握手，返回服务端证书的 CommonName
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer l.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer c.Close()
+		serverErr <- tls.Server(c, serverConfig).Handshake()
+	}()
+
+	client, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		<-serverErr
+		return "", err
+	}
+	defer client.Close()
+	// TLS 1.3 中客户端先完成握手，服务端拒绝客户端证书时在之后的读取中返回错误
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		<-serverErr
+		return "", err
+	}
+	if err := <-serverErr; err != nil {
+		return "", err
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+		ok   bool
+	}{
+		{"", tls.VersionTLS12, true},
+		{"1.2", tls.VersionTLS12, true},
+		{"1.3", tls.VersionTLS13, true},
+		{"1.1", 0, false},
+	}
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.in)
+		if (err == nil) != tt.ok || v != tt.want {
+			t.Errorf("want %d(ok=%v),actual %d(%v)", tt.want, tt.ok, v, err)
+		}
+	}
+}
+
+func TestServerReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := testcert.NewCA(t, "test-ca")
+	cert, key := ca.Issue(t, "server-1")
+	opts := ServerOptions{
+		CertFile: testcert.WriteFile(t, dir, "server.pem", cert),
+		KeyFile:  testcert.WriteFile(t, dir, "server-key.pem", key),
+	}
+	r, err := NewServerReloader(opts)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	serverConfig := r.Config()
+	clientConfig, err := ClientConfig(ClientOptions{
+		CAFile:     testcert.WriteFile(t, dir, "ca.pem", ca.PEM),
+		ServerName: "localhost",
+	})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+
+	if cn, err := handshake(t, serverConfig, clientConfig); err != nil || cn != "server-1" {
+		t.Errorf("want server-1,actual %s(%v)", cn, err)
+	}
+
+	// 替换证书文件，Reload 之后新的握手使用新证书
+	cert, key = ca.Issue(t, "server-2")
+	testcert.WriteFile(t, dir, "server.pem", cert)
+	testcert.WriteFile(t, dir, "server-key.pem", key)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if cn, err := handshake(t, serverConfig, clientConfig); err != nil || cn != "server-2" {
+		t.Errorf("want server-2,actual %s(%v)", cn, err)
+	}
+
+	// 文件损坏时 Reload 失败，继续使用原来的证书
+	testcert.WriteFile(t, dir, "server.pem", []byte("broken"))
+	if err := r.Reload(); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+	if cn, err := handshake(t, serverConfig, clientConfig); err != nil || cn != "server-2" {
+		t.Errorf("want server-2,actual %s(%v)", cn, err)
+	}
+}
+
+func TestServerReloader_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := testcert.NewCA(t, "test-ca")
+	other := testcert.NewCA(t, "other-ca")
+	caFile := testcert.WriteFile(t, dir, "ca.pem", ca.PEM)
+	serverCert, serverKey := ca.Issue(t, "server")
+	r, err := NewServerReloader(ServerOptions{
+		CertFile:     testcert.WriteFile(t, dir, "server.pem", serverCert),
+		KeyFile:      testcert.WriteFile(t, dir, "server-key.pem", serverKey),
+		ClientCAFile: caFile,
+		MinVersion:   "1.3",
+	})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+
+	tests := []struct {
+		name string
+		ca   *testcert.CA // 签发客户端证书的 CA，nil 表示不提供客户端证书
+		ok   bool
+	}{
+		{"TrustedCert", ca, true},
+		{"UntrustedCert", other, false},
+		{"NoCert", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := ClientOptions{CAFile: caFile, ServerName: "localhost"}
+			if tt.ca != nil {
+				cert, key := tt.ca.Issue(t, "device-1")
+				opts.CertFile = testcert.WriteFile(t, dir, tt.name+".pem", cert)
+				opts.KeyFile = testcert.WriteFile(t, dir, tt.name+"-key.pem", key)
+			}
+			clientConfig, err := ClientConfig(opts)
+			if err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			if _, err := handshake(t, r.Config(), clientConfig); (err == nil) != tt.ok {
+				t.Errorf("want ok=%v,actual %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestClientConfig_CertWithoutKey(t *testing.T) {
+	if _, err := ClientConfig(ClientOptions{CertFile: "client.pem"}); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package transport
+
+import "syscall"
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
@@ -0,0 +1,214 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// transport 包解析带协议前缀的地址，并据此监听和拨号
+/*
+地址格式
+	tcp://host:port    TCP 地址
+	unix:///path/sock  unix domain socket，路径为 unix:// 之后的部分
+	host:port          没有前缀时按 TCP 地址处理
+*/
+
+const (
+	schemeTCP  = "tcp://"
+	schemeUnix = "unix://"
+)
+
+// errReusePortUnsupported 当前平台不支持 SO_REUSEPORT
+var errReusePortUnsupported = errors.New("transport: SO_REUSEPORT is not supported on this platform")
+
+// staleSocketDialTimeout 判断遗留的 socket 文件是否仍有进程在监听时的拨号超时
+const staleSocketDialTimeout = 100 * time.Millisecond
+
+// ParseAddr 把地址解析为 net.Listen/net.Dial 使用的 network 和 address
+func ParseAddr(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, schemeUnix):
+		network, address = "unix", strings.TrimPrefix(addr, schemeUnix)
+	case strings.HasPrefix(addr, schemeTCP):
+		network, address = "tcp", strings.TrimPrefix(addr, schemeTCP)
+	case strings.Contains(addr, "://"):
+		return "", "", fmt.Errorf("unsupported address %q, want tcp:// or unix://", addr)
+	default:
+		network, address = "tcp", addr
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("empty address in %q", addr)
+	}
+	return network, address, nil
+}
+
+// Format 返回 listener 或连接地址带协议前缀的形式，如 tcp://127.0.0.1:8888
+func Format(addr net.Addr) string {
+	network := addr.Network()
+	if network == "unix" {
+		return schemeUnix + addr.String()
+	}
+	return network + "://" + addr.String()
+}
+
+// ParsePrefix 解析 CIDR 地址段，单个 IP 转换为只包含该地址的地址段，地址段的主机位被清零
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("invalid IP %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParsePrefixes 解析逗号分隔的地址段列表，格式见 ParsePrefix，忽略空项
+func ParsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// ListenOptions 监听选项
+type ListenOptions struct {
+	SocketMode os.FileMode // unix socket 文件的权限，0 表示保持 umask 决定的默认权限
+}
+
+// Listen 监听 addr。unix socket 文件已存在但没有进程在监听时先删除它
+func Listen(addr string, opts ListenOptions) (net.Listener, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SocketMode != 0 {
+		if err := os.Chmod(address, opts.SocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket 删除上次异常退出时遗留的 socket 文件，文件不是 socket 或仍有进程在监听时返回错误
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, staleSocketDialTimeout); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// Shard 由 ListenShards 创建的 listener，同一个地址上的每个 listener 有各自的编号
+type Shard interface {
+	net.Listener
+	Shard() int
+}
+
+type shardListener struct {
+	net.Listener
+	shard int
+}
+
+func (l *shardListener) Shard() int {
+	return l.shard
+}
+
+// File 返回底层 listener 文件描述符的副本，用于平滑升级时交给新进程
+func (l *shardListener) File() (*os.File, error) {
+	fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("transport: listener %s has no file descriptor", l.Addr())
+	}
+	return fl.File()
+}
+
+// NewShard 把 l 包装为编号为 shard 的 Shard，用于恢复平滑升级时从旧进程继承的分片 listener
+func NewShard(l net.Listener, shard int) Shard {
+	return &shardListener{Listener: l, shard: shard}
+}
+
+// ListenShards 用 SO_REUSEPORT 在同一个 TCP 地址上打开 n 个 listener，
+// 每个 listener 由各自的 goroutine Accept，内核在它们之间分配新连接。
+// 返回的 listener 都实现了 Shard，编号从 0 开始。
+// 地址中的端口为 0 时，其余 listener 使用第一个 listener 分配到的端口
+func ListenShards(addr string, n int) ([]net.Listener, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return nil, fmt.Errorf("SO_REUSEPORT requires a tcp address, actual %q", addr)
+	}
+
+	lc := net.ListenConfig{Control: setReusePort}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			address = l.Addr().String()
+		}
+		listeners = append(listeners, &shardListener{Listener: l, shard: i})
+	}
+	return listeners, nil
+}
+
+// Dial 连接 addr，tlsConfig 不为 nil 时使用 TLS
+func Dial(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		return tls.Dial(network, address, tlsConfig)
+	}
+	return net.Dial(network, address)
+}
@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+		ok      bool
+	}{
+		{":8888", "tcp", ":8888", true},
+		{"tcp://127.0.0.1:8888", "tcp", "127.0.0.1:8888", true},
+		{"unix:///tmp/server.sock", "unix", "/tmp/server.sock", true},
+		{"unix://server.sock", "unix", "server.sock", true},
+		{"unix://", "", "", false},
+		{"udp://:8888", "", "", false},
+	}
+	for _, tt := range tests {
+		network, address, err := ParseAddr(tt.in)
+		if (err == nil) != tt.ok || network != tt.network || address != tt.address {
+			t.Errorf("%s: want %s %s(ok=%v),actual %s %s(%v)", tt.in, tt.network, tt.address, tt.ok, network, address, err)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "[]", true},
+		{"10.1.2.3/8, 192.168.0.10,", "[10.0.0.0/8 192.168.0.10/32]", true},
+		{"2001:db8::1/32,::ffff:10.0.0.1", "[2001:db8::/32 10.0.0.1/32]", true},
+		{"10.0.0.0/33", "[]", false},
+		{"fe80::1%eth0", "[]", false},
+		{"example.com", "[]", false},
+	}
+	for _, tt := range tests {
+		prefixes, err := ParsePrefixes(tt.in)
+		if (err == nil) != tt.ok || fmt.Sprint(prefixes) != tt.want {
+			t.Errorf("%s: want %s(ok=%v),actual %v(%v)", tt.in, tt.want, tt.ok, prefixes, err)
+		}
+	}
+}
+
+func TestListen_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	addr := "unix://" + path
+	l, err := Listen(addr, ListenOptions{SocketMode: 0o600})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("want %o,actual %o", 0o600, perm)
+	}
+	if s := Format(l.Addr()); s != addr {
+		t.Errorf("want %s,actual %s", addr, s)
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+	c, err := Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("want ok,actual %s(%v)", buf, err)
+	}
+
+	// 仍在监听的 socket 不能被删除
+	if _, err := Listen(addr, ListenOptions{}); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestListen_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	// 模拟异常退出后遗留的 socket 文件
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = Listen("unix://"+path, ListenOptions{})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	l.Close()
+
+	// 不是 socket 的文件不会被删除
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if _, err := Listen("unix://"+path, ListenOptions{}); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
+
+func TestListenShards(t *testing.T) {
+	listeners, err := ListenShards("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	addr := listeners[0].Addr().String()
+	accepted := make([]atomic.Int32, len(listeners))
+	for i, l := range listeners {
+		defer l.Close()
+		if s := l.(Shard).Shard(); s != i {
+			t.Errorf("want %d,actual %d", i, s)
+		}
+		if a := l.Addr().String(); a != addr {
+			t.Errorf("want %s,actual %s", addr, a)
+		}
+		go func(i int, l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted[i].Add(1)
+				c.Close()
+			}
+		}(i, l)
+	}
+
+	const conns = 64
+	for i := 0; i < conns; i++ {
+		c, err := Dial(addr, nil)
+		if err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		c.Read(make([]byte, 1)) // 等待 Accept 后关闭
+		c.Close()
+	}
+	var total, used int32
+	for i := range accepted {
+		if n := accepted[i].Load(); n > 0 {
+			total += n
+			used++
+		}
+	}
+	if total != conns {
+		t.Errorf("want %d,actual %d", conns, total)
+	}
+	// Linux 按四元组 hash 在所有 listener 之间分配连接
+	if runtime.GOOS == "linux" && used < 2 {
+		t.Errorf("want connections spread over shards,actual %d shard(s) used", used)
+	}
+}
+
+func TestListenShards_Unix(t *testing.T) {
+	if _, err := ListenShards("unix://"+filepath.Join(t.TempDir(), "server.sock"), 2); err == nil {
+		t.Errorf("want non-nil,actual nil")
+	}
+}
@@ -0,0 +1,93 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// upgrade 包实现不中断服务的二进制升级：旧进程启动新版本的可执行文件，通过 ExtraFiles 把 listener 的
+// 文件描述符交给它，新进程在继承的 listener 上接受新连接，旧进程停止接受新连接并排空已有连接
+/*
+交接过程
+	1. 旧进程调用 Start，以相同的参数启动 os.Executable()，listener 依次作为 fd 3、4... 传入，
+	   环境变量中按 fd 顺序列出各个 listener 的名称，最后一个 fd 是通知就绪的管道
+	2. 新进程调用 Inherited 取回 listener，完成启动后调用 Ready 通知旧进程
+	3. Start 收到通知后返回，旧进程关闭自己的 listener 副本并排空连接；
+	   新进程提前退出或没有按时就绪时 Start 结束新进程并返回错误，旧进程继续服务
+	内核中的监听 socket 始终没有关闭，交接期间到达的连接在 accept 队列中等待，不会被拒绝
+*/
+
+const (
+	envListeners = "TCP_SERVER_UPGRADE_LISTENERS" // 继承的 listener 名称，逗号分隔，按 fd 顺序排列
+	envReadyFD   = "TCP_SERVER_UPGRADE_READY_FD"  // 通知旧进程就绪的管道写端
+	firstFD      = 3                              // ExtraFiles 中第一个文件在新进程中的 fd
+)
+
+// ErrUnsupported 当前平台不支持平滑升级
+var ErrUnsupported = errors.New("upgrade: not supported on this platform")
+
+// Inherited 返回从旧进程继承的 listener，按 Start 时的名称索引；不是由 Start 启动的进程返回空 map。
+// 只有第一次调用返回继承的 listener，调用方负责关闭其中用不到的 listener
+func Inherited() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	value := os.Getenv(envListeners)
+	if value == "" {
+		return listeners, nil
+	}
+	os.Unsetenv(envListeners)
+	for i, name := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener 复制了文件描述符
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("upgrade: inherit listener %s: %w", name, err)
+		}
+		// 继承的 unix socket 由新进程负责在关闭时删除
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// Upgraded 当前进程是否由 Start 启动且尚未调用 Ready
+func Upgraded() bool {
+	return os.Getenv(envReadyFD) != ""
+}
+
+// Ready 通知旧进程新进程已经完成启动，旧进程随后停止接受新连接；不是由 Start 启动的进程什么也不做
+func Ready() error {
+	value := os.Getenv(envReadyFD)
+	if value == "" {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("upgrade: invalid %s %q", envReadyFD, value)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// environ 返回去掉交接用环境变量的当前环境
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envListeners+"=") || strings.HasPrefix(kv, envReadyFD+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package upgrade
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// Signals 触发平滑升级的信号，当前平台不支持平滑升级，为空
+var Signals []os.Signal
+
+// Start 当前平台不支持平滑升级
+func Start(ctx context.Context, listeners map[string]net.Listener) (*os.Process, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,108 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Signals 触发平滑升级的信号
+var Signals = []os.Signal{syscall.SIGUSR2}
+
+// Start 以当前进程的参数启动新版本的可执行文件，把 listeners 交给它并等待它调用 Ready。
+// 新进程提前退出或 ctx 结束前没有就绪时结束新进程并返回错误。
+// 成功后旧进程关闭 unix socket listener 时不再删除 socket 文件；返回的进程不需要 Wait，旧进程退出后由 init 回收
+func Start(ctx context.Context, listeners map[string]net.Listener) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		if name == "" || strings.Contains(name, ",") {
+			return nil, fmt.Errorf("upgrade: invalid listener name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// File 返回文件描述符的副本，新进程启动后关闭
+	files := make([]*os.File, 0, len(names)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		fl, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("upgrade: listener %s has no file descriptor", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: listener %s: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(environ(),
+		envListeners+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", envReadyFD, firstFD+len(names)))
+	err = cmd.Start()
+	// 关闭旧进程中的写端，新进程退出时读端收到 EOF
+	w.Close()
+	// StartProcess 通过 Fd() 取文件描述符时把它们设为阻塞模式，阻塞模式属于两个进程共享的 socket，
+	// 旧进程的 Accept 会因此阻塞在系统调用中，Close 无法打断，需要恢复为非阻塞模式
+	for _, f := range files {
+		unix.SetNonblock(int(f.Fd()), true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err == io.EOF {
+			err = errors.New("upgrade: new process exited before ready")
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
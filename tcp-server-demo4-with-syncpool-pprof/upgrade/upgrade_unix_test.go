@@ -0,0 +1,213 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/server"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/transport"
+)
+
+// 设置后由 Start 启动的测试进程在就绪之前退出
+const envChildFail = "UPGRADE_TEST_CHILD_FAIL"
+
+// pidHandler 回复 ID 为进程号的 SubmitAck，用于区分请求由哪个进程处理
+var pidHandler = server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+	if _, ok := r.Packet.(*packet.Submit); ok {
+		w.Write(&packet.SubmitAck{ID: pidID(os.Getpid())})
+	}
+})
+
+func pidID(pid int) string {
+	return fmt.Sprintf("%08d", pid%100000000)
+}
+
+// TestMain 由 Start 启动的测试进程作为新版本的服务端运行，收到 SIGTERM 后退出
+func TestMain(m *testing.M) {
+	if os.Getenv(envListeners) == "" {
+		os.Exit(m.Run())
+	}
+	if os.Getenv(envChildFail) != "" {
+		os.Exit(1)
+	}
+	listeners, err := Inherited()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	srv := server.New(pidHandler)
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+	if err := Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	os.Exit(0)
+}
+
+// submit 发送一个 Submit，返回收到的 packet
+func submit(t *testing.T, c net.Conn) packet.Packet {
+	framePayload, err := packet.Encode(&packet.Submit{ID: "00000001", Payload: []byte("hello")})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if err := frame.NewMyFrameCodec().Encode(c, framePayload); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return readPacket(t, c)
+}
+
+func readPacket(t *testing.T, c net.Conn) packet.Packet {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	framePayload, err := frame.NewMyFrameCodec().Decode(c)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	p, err := packet.Decode(framePayload)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return p
+}
+
+// servedBy 在新连接上发送 Submit，返回处理该请求的进程号
+func servedBy(t *testing.T, addr string) string {
+	c, err := transport.Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer c.Close()
+	ack, ok := submit(t, c).(*packet.SubmitAck)
+	if !ok {
+		t.Fatalf("want *packet.SubmitAck,actual %T", ack)
+	}
+	return ack.ID
+}
+
+func listenPair(t *testing.T) (map[string]net.Listener, []string) {
+	tl, err := transport.Listen("tcp://127.0.0.1:0", transport.ListenOptions{})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	unixAddr := "unix://" + filepath.Join(t.TempDir(), "server.sock")
+	ul, err := transport.Listen(unixAddr, transport.ListenOptions{})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return map[string]net.Listener{"tcp": tl, "unix": ul}, []string{transport.Format(tl.Addr()), unixAddr}
+}
+
+func TestStart_Handoff(t *testing.T) {
+	listeners, addrs := listenPair(t)
+	srv := server.New(pidHandler)
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+	old, err := transport.Dial(addrs[0], nil)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer old.Close()
+	if ack := submit(t, old).(*packet.SubmitAck); ack.ID != pidID(os.Getpid()) {
+		t.Fatalf("want %s,actual %s", pidID(os.Getpid()), ack.ID)
+	}
+
+	// 交接期间不断建立新连接，一次都不能被拒绝
+	var dialErrs, dials atomic.Int32
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c, err := transport.Dial(addrs[0], nil)
+			dials.Add(1)
+			if err != nil {
+				dialErrs.Add(1)
+				continue
+			}
+			c.Close()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	proc, err := Start(ctx, listeners)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	defer func() {
+		proc.Signal(syscall.SIGTERM)
+		proc.Wait()
+	}()
+
+	// 旧进程停止接受新连接并排空已有连接
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if d, ok := readPacket(t, old).(*packet.Disconnect); !ok || d.Code != packet.DisconnectShutdown {
+		t.Errorf("want shutdown disconnect,actual %v", d)
+	}
+
+	// 关闭旧进程的 listener 后 unix socket 文件仍然存在，新连接都由新进程处理
+	for _, addr := range addrs {
+		if id := servedBy(t, addr); id != pidID(proc.Pid) {
+			t.Errorf("%s: want %s,actual %s", addr, pidID(proc.Pid), id)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if n := dialErrs.Load(); n != 0 {
+		t.Errorf("want 0 dial errors,actual %d of %d", n, dials.Load())
+	}
+}
+
+func TestStart_ChildFails(t *testing.T) {
+	t.Setenv(envChildFail, "1")
+	listeners, addrs := listenPair(t)
+	srv := server.New(pidHandler)
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := Start(ctx, listeners); err == nil {
+		t.Fatalf("want error,actual nil")
+	}
+	// 新进程启动失败时旧进程继续服务
+	for _, addr := range addrs {
+		if id := servedBy(t, addr); id != pidID(os.Getpid()) {
+			t.Errorf("%s: want %s,actual %s", addr, pidID(os.Getpid()), id)
+		}
+	}
+}
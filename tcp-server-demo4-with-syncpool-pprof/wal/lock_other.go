@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package wal
+
+import (
+	"os"
+	"time"
+)
+
+// lockDir 当前平台不支持 flock，不加锁
+func lockDir(dir string, timeout time.Duration) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package wal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpen_Locked(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{})
+
+	// flock 按打开的文件加锁，同一个进程中再次打开也会被拒绝
+	start := time.Now()
+	if _, err := Open(dir, Options{Logger: discardLogger, LockTimeout: 100 * time.Millisecond}); err != ErrLocked {
+		t.Fatalf("want %v,actual %v", ErrLocked, err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("want wait at least 100ms,actual %s", d)
+	}
+
+	// 等待中的 Open 在持有锁的 Log 关闭后成功
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.Close()
+	}()
+	l2, err := Open(dir, Options{Logger: discardLogger, LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	l2.Close()
+}
@@ -0,0 +1,221 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	headerSize    = 8         // length(4) + crc(4)
+	minBodySize   = 8 + 2 + 2 // timestamp + 两个长度字段
+	maxRecordSize = 64 << 20  // 单条记录 body 的最大字节数，超过时 Append 返回 ErrTooLarge
+	segmentSuffix = ".wal"    // 段文件的扩展名
+	segmentFormat = "%020d" + segmentSuffix
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendRecord 把 rec 编码后追加到 b
+func appendRecord(b []byte, rec Record) []byte {
+	start := len(b)
+	b = append(b, make([]byte, headerSize)...)
+	b = binary.BigEndian.AppendUint64(b, uint64(rec.Time.UnixNano()))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rec.ClientID)))
+	b = append(b, rec.ClientID...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rec.ID)))
+	b = append(b, rec.ID...)
+	b = append(b, rec.Payload...)
+	body := b[start+headerSize:]
+	binary.BigEndian.PutUint32(b[start:], uint32(len(body)))
+	binary.BigEndian.PutUint32(b[start+4:], crc32.Checksum(body, crcTable))
+	return b
+}
+
+// checkRecord 检查 rec 能否编码为一条记录
+func checkRecord(rec Record) error {
+	if len(rec.ClientID) > math.MaxUint16 || len(rec.ID) > math.MaxUint16 ||
+		minBodySize+len(rec.ClientID)+len(rec.ID)+len(rec.Payload) > maxRecordSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// decodeBody 解码 crc 校验通过的 body，Payload 引用 body 的内存
+func decodeBody(body []byte) (Record, bool) {
+	var rec Record
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+	body = body[8:]
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n+2 {
+		return rec, false
+	}
+	rec.ClientID = string(body[2 : 2+n])
+	body = body[2+n:]
+	n = int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return rec, false
+	}
+	rec.ID = string(body[2 : 2+n])
+	rec.Payload = body[2+n:]
+	return rec, true
+}
+
+// scanSegment 依次读取段文件中的记录并调用 fn，返回完整记录的字节数。
+// 遇到不完整或校验失败的记录时停止，此时返回值小于文件大小
+func scanSegment(path string, fn func(Record) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	var valid int64
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, nil
+			}
+			return valid, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length < minBodySize || length > maxRecordSize {
+			return valid, nil
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, nil
+			}
+			return valid, err
+		}
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			return valid, nil
+		}
+		rec, ok := decodeBody(body)
+		if !ok {
+			return valid, nil
+		}
+		if fn != nil {
+			if err := fn(rec); err != nil {
+				return valid, err
+			}
+		}
+		valid += headerSize + int64(length)
+	}
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf(segmentFormat, seq))
+}
+
+// listSegments 返回 dir 中所有段文件的序号，从小到大排列
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// createSegment 创建新的段文件，并 fsync 目录使文件本身在崩溃后仍然存在
+func createSegment(dir string, seq uint64) (*os.File, error) {
+	f, err := os.OpenFile(segmentPath(dir, seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// truncateSegment 把段文件截断到 size 字节并 fsync
+func truncateSegment(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Replay 按追加顺序读取 dir 中的所有记录并调用 fn，fn 返回错误时停止并返回该错误。
+// 最后一个段末尾不完整的记录被忽略，其他段中的损坏返回 ErrCorrupt。
+// 可以在 Open 之前或 Close 之后调用，与正在写入的 Log 并发调用时可能读不到最新的记录
+func Replay(dir string, fn func(Record) error) error {
+	return ReplaySince(dir, time.Time{}, fn)
+}
+
+// ReplaySince 同 Replay，但只读取 Time 不早于 since 的记录；
+// 最后修改时间早于 since 的段中不会有这样的记录，直接跳过
+func ReplaySince(dir string, since time.Time, fn func(Record) error) error {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for i, seq := range seqs {
+		path := segmentPath(dir, seq)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().Before(since) {
+			continue
+		}
+		valid, err := scanSegment(path, func(rec Record) error {
+			if rec.Time.Before(since) {
+				return nil
+			}
+			return fn(rec)
+		})
+		if err != nil {
+			return err
+		}
+		if i < len(seqs)-1 && valid < fi.Size() {
+			return fmt.Errorf("%w: %s at offset %d", ErrCorrupt, filepath.Base(path), valid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,555 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/metrics"
+)
+
+// wal 包把收到的 Submit 追加到磁盘上的预写日志(write-ahead log)，记录 fsync 之后才回复 SubmitAck
+/*
+文件布局
+	日志目录中是按序号命名的段文件，如 00000000000000000001.wal，记录只追加到序号最大的段，
+	段文件超过 SegmentSize 后先 fsync 再创建下一个段
+记录格式
+	| length(4) | crc(4) | timestamp(8) | client id 长度(2) | client id | message id 长度(2) | message id | payload |
+	length 为 crc 之后的字节数，crc 为这些字节的 CRC-32C，整数均为大端序
+fsync 策略
+	always   每条记录写入后立即 fsync，追加调用在 fsync 完成后返回
+	batch    后台 goroutine 在上一次 fsync 完成后，把期间追加的所有记录一起 fsync(group commit)
+	interval 后台 goroutine 每隔 SyncInterval fsync 一次
+目录锁
+	Open 对日志目录中的 LOCK 文件加 flock，同一时间只有一个进程写入；平滑升级时新进程等待旧进程 Close 后再打开
+恢复
+	崩溃时最后一个段末尾可能留下写了一半的记录(torn write)，Open 从最后一个段中第一条不完整
+	或校验失败的记录处截断文件；之前的段在创建下一个段时已经 fsync，不再校验
+保留
+	Log 不会自动删除段，日志会一直增长直到磁盘写满。调用方通过 Segments 查看所有段，
+	通过 RemoveBefore 按保留时间删除最早的段
+*/
+
+var (
+	ErrClosed   = errors.New("wal: log closed")
+	ErrCorrupt  = errors.New("wal: corrupt record")
+	ErrTooLarge = errors.New("wal: record too large")
+	ErrLocked   = errors.New("wal: directory locked by another process")
+)
+
+// lockFile 日志目录中用于加锁的文件
+const lockFile = "LOCK"
+
+// SyncPolicy fsync 策略
+type SyncPolicy int
+
+const (
+	SyncBatch    SyncPolicy = iota // group commit，默认
+	SyncAlways                     // 每条记录 fsync 一次
+	SyncInterval                   // 定期 fsync
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncBatch:    "batch",
+	SyncAlways:   "always",
+	SyncInterval: "interval",
+}
+
+func (p SyncPolicy) String() string {
+	if name, ok := syncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// ParseSyncPolicy 解析 always、batch 或 interval
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for p, name := range syncPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("wal: unknown sync policy %q, want always, batch or interval", s)
+}
+
+// Options Log 的配置
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration // SyncInterval 策略的 fsync 间隔，默认 10ms
+	SegmentSize  int64         // 段文件的最大字节数，默认 64MB；单条记录超过该大小时独占一个段
+	Logger       *slog.Logger  // 记录恢复过程，默认 slog.Default()
+	LockTimeout  time.Duration // 日志目录被其他进程锁定时等待的最长时间，0 表示不等待，超时后 Open 返回 ErrLocked
+}
+
+// Record 一条日志记录
+type Record struct {
+	Time     time.Time // 收到消息的时间，为零值时 Append 使用当前时间
+	ClientID string    // 客户端标识
+	ID       string    // 消息 ID
+	Payload  []byte    // 消息内容
+}
+
+// waiter 等待记录 fsync 的回调
+type waiter struct {
+	seq  uint64
+	done func(error)
+}
+
+// callback 已 fsync 或失败的记录的回调及其结果，由回调 goroutine 调用
+type callback struct {
+	done func(error)
+	err  error
+}
+
+// Log 只追加的预写日志，可以在多个 goroutine 中并发使用
+type Log struct {
+	dir  string
+	opts Options
+	lock *os.File // 目录锁，Close 时释放
+
+	mu      sync.Mutex
+	f       *os.File      // 当前段
+	w       *bufio.Writer // 当前段的写缓存
+	seg     uint64        // 当前段的序号
+	size    int64         // 当前段的字节数，含写缓存中的数据
+	retired []*os.File    // 已写满并 fsync、等待关闭的段
+	written uint64        // 已追加的记录数
+	durable uint64        // 已 fsync 的记录数
+	waiters []waiter      // 等待 fsync 的回调，按追加顺序排列
+	err     error         // 写入或 fsync 失败的错误，之后的追加都返回该错误
+	closed  bool
+	buf     []byte // 编码记录的缓存
+
+	callbacks     []callback // 等待回调 goroutine 调用的回调，按追加顺序排列
+	callbacksDone bool       // Close 已交出最后的回调，回调 goroutine 调用完后退出
+
+	notify    chan struct{}
+	callbackC chan struct{} // callbacks 不为空时通知回调 goroutine
+	quit      chan struct{}
+	wg        sync.WaitGroup // syncLoop
+	cbwg      sync.WaitGroup // callbackLoop
+}
+
+// Open 打开 dir 中的日志，目录不存在时创建；最后一个段末尾不完整的记录被截断。
+// 目录被其他进程的 Log 锁定时最多等待 LockTimeout
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = 10 * time.Millisecond
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	l, err := open(dir, opts)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, err
+	}
+	l.lock = lock
+	return l, nil
+}
+
+// open 在持有目录锁的情况下打开日志
+func open(dir string, opts Options) (*Log, error) {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:       dir,
+		opts:      opts,
+		notify:    make(chan struct{}, 1),
+		callbackC: make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+	if len(seqs) == 0 {
+		l.seg = 1
+		if l.f, err = createSegment(dir, l.seg); err != nil {
+			return nil, err
+		}
+	} else {
+		l.seg = seqs[len(seqs)-1]
+		if l.size, err = recoverSegment(segmentPath(dir, l.seg), opts.Logger); err != nil {
+			return nil, err
+		}
+		if l.f, err = os.OpenFile(segmentPath(dir, l.seg), os.O_WRONLY|os.O_APPEND, 0); err != nil {
+			return nil, err
+		}
+	}
+	l.w = bufio.NewWriterSize(l.f, 64<<10)
+
+	if opts.Sync != SyncAlways {
+		l.wg.Add(1)
+		go l.syncLoop()
+		l.cbwg.Add(1)
+		go l.callbackLoop()
+	}
+	return l, nil
+}
+
+// recoverSegment 校验最后一个段，截断末尾不完整的记录，返回截断后的大小
+func recoverSegment(path string, logger *slog.Logger) (int64, error) {
+	records := 0
+	valid, err := scanSegment(path, func(Record) error {
+		records++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if valid < fi.Size() {
+		logger.Warn("wal: truncating torn write", "segment", filepath.Base(path), "offset", valid, "bytes", fi.Size()-valid)
+		if err := truncateSegment(path, valid); err != nil {
+			return 0, err
+		}
+	}
+	logger.Info("wal: recovered", "segment", filepath.Base(path), "records", records)
+	return valid, nil
+}
+
+// Segment 日志目录中的一个段文件
+type Segment struct {
+	Seq     uint64
+	Path    string
+	Size    int64
+	ModTime time.Time // 最后写入的时间，段中记录的 Time 都不晚于它
+	Active  bool      // 正在写入的段，不能删除
+}
+
+// Segments 返回日志目录中的所有段，按序号从小到大排列，最后一个是正在写入的段
+func (l *Log) Segments() ([]Segment, error) {
+	l.mu.Lock()
+	closed, active := l.closed, l.seg
+	l.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	seqs, err := listSegments(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	segs := make([]Segment, 0, len(seqs))
+	for _, seq := range seqs {
+		path := segmentPath(l.dir, seq)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, Segment{Seq: seq, Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Active: seq >= active})
+	}
+	return segs, nil
+}
+
+// RemoveBefore 从最早的段开始删除最后写入时间早于 t 的段，遇到不早于 t 的段时停止，
+// 剩下的记录仍然是连续的；正在写入的段不会被删除。返回删除的段数
+func (l *Log) RemoveBefore(t time.Time) (int, error) {
+	segs, err := l.Segments()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, seg := range segs {
+		if seg.Active || !seg.ModTime.Before(t) {
+			break
+		}
+		// 已写满的段只读，等待关闭的段被删除后也不影响 fsync
+		if err := os.Remove(seg.Path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	if removed > 0 {
+		if err := syncDir(l.dir); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Dir 返回日志目录
+func (l *Log) Dir() string {
+	return l.dir
+}
+
+// Append 追加一条记录，在记录 fsync 之后返回
+func (l *Log) Append(rec Record) error {
+	ch := make(chan error, 1)
+	l.AppendAsync(rec, func(err error) { ch <- err })
+	return <-ch
+}
+
+// AppendAsync 追加一条记录，记录 fsync 之后或失败时调用 done。
+// 调用返回时 rec 已被复制，调用方可以复用 Payload。
+// always 策略下 done 在当前 goroutine 中调用；其他策略下按追加顺序在专门的回调 goroutine 中调用，
+// done 阻塞会推迟所有后续记录的回调，但不影响写入和 fsync，调用方应避免在 done 中长时间阻塞
+func (l *Log) AppendAsync(rec Record, done func(error)) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	l.mu.Lock()
+	if err := l.writeLocked(rec); err != nil {
+		l.mu.Unlock()
+		done(err)
+		return
+	}
+	l.written++
+	if l.opts.Sync == SyncAlways {
+		err := l.syncLocked()
+		l.mu.Unlock()
+		done(err)
+		return
+	}
+	l.waiters = append(l.waiters, waiter{seq: l.written, done: done})
+	l.mu.Unlock()
+
+	if l.opts.Sync == SyncBatch {
+		select {
+		case l.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeLocked 把记录写入写缓存，当前段写满时切换到下一个段
+func (l *Log) writeLocked(rec Record) error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+	if err := checkRecord(rec); err != nil {
+		return err
+	}
+	l.buf = appendRecord(l.buf[:0], rec)
+	if l.size > 0 && l.size+int64(len(l.buf)) > l.opts.SegmentSize {
+		if err := l.rotateLocked(); err != nil {
+			l.err = fmt.Errorf("wal: rotate segment: %w", err)
+			return l.err
+		}
+	}
+	if _, err := l.w.Write(l.buf); err != nil {
+		l.err = fmt.Errorf("wal: write: %w", err)
+		return l.err
+	}
+	l.size += int64(len(l.buf))
+	return nil
+}
+
+// rotateLocked 把写缓存写入当前段并 fsync 后创建下一个段，崩溃时只有最后一个段可能不完整；
+// 锁外的 fsync 可能仍在使用旧段，旧段在下一次 fsync 时关闭
+func (l *Log) rotateLocked() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	f, err := createSegment(l.dir, l.seg+1)
+	if err != nil {
+		return err
+	}
+	l.retired = append(l.retired, l.f)
+	l.f = f
+	l.w.Reset(f)
+	l.seg++
+	l.size = 0
+	return nil
+}
+
+// syncLocked 在持有锁的情况下 fsync 所有已追加的记录，用于 always 策略和 Close
+func (l *Log) syncLocked() error {
+	if l.err != nil {
+		return l.err
+	}
+	if l.durable == l.written && len(l.retired) == 0 {
+		return nil
+	}
+	if err := l.w.Flush(); err != nil {
+		l.err = fmt.Errorf("wal: write: %w", err)
+		return l.err
+	}
+	retired := l.retired
+	l.retired = nil
+	if err := syncFiles(retired, l.f, l.written-l.durable); err != nil {
+		l.err = fmt.Errorf("wal: sync: %w", err)
+		return l.err
+	}
+	l.durable = l.written
+	return nil
+}
+
+// syncFiles 关闭 retired 中已经 fsync 的段，再 fsync 当前段
+func syncFiles(retired []*os.File, f *os.File, records uint64) error {
+	start := time.Now()
+	for _, rf := range retired {
+		rf.Close()
+	}
+	err := f.Sync()
+	if err == nil {
+		metrics.WALSyncSeconds.Observe(time.Since(start).Seconds())
+		metrics.WALSyncRecords.Observe(float64(records))
+	}
+	return err
+}
+
+// syncLoop batch 和 interval 策略下的后台 fsync
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	var tick <-chan time.Time
+	if l.opts.Sync == SyncInterval {
+		t := time.NewTicker(l.opts.SyncInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-l.notify:
+		case <-tick:
+		case <-l.quit:
+			return
+		}
+		l.sync()
+	}
+}
+
+// sync 在锁外 fsync，期间可以继续追加记录
+func (l *Log) sync() {
+	l.mu.Lock()
+	target, durable, f := l.written, l.durable, l.f
+	retired := l.retired
+	l.retired = nil
+	err := l.err
+	if err == nil && target > durable {
+		if err = l.w.Flush(); err != nil {
+			l.err = fmt.Errorf("wal: write: %w", err)
+		}
+	}
+	l.mu.Unlock()
+
+	// 追加记录时才会切换段，所以没有新记录时 retired 为空；
+	// 写缓存已写入 f，锁外 fsync 期间 f 可能被切换到 retired，但只有这里会关闭它
+	if err == nil && target > durable {
+		err = syncFiles(retired, f, target-durable)
+	} else {
+		for _, rf := range retired {
+			rf.Close()
+		}
+	}
+
+	l.mu.Lock()
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("wal: sync: %w", err)
+	}
+	if err == nil && target > l.durable {
+		l.durable = target
+	}
+	l.completeWaitersLocked()
+	l.mu.Unlock()
+}
+
+// completeWaitersLocked 把已 fsync 的回调交给回调 goroutine，出错时交出全部回调
+func (l *Log) completeWaitersLocked() {
+	n := 0
+	for n < len(l.waiters) && l.waiters[n].seq <= l.durable {
+		n++
+	}
+	if l.err != nil {
+		n = len(l.waiters)
+	}
+	if n == 0 {
+		return
+	}
+	for _, w := range l.waiters[:n] {
+		cb := callback{done: w.done}
+		if w.seq > l.durable {
+			cb.err = l.err
+		}
+		l.callbacks = append(l.callbacks, cb)
+	}
+	l.waiters = append(l.waiters[:0], l.waiters[n:]...)
+	select {
+	case l.callbackC <- struct{}{}:
+	default:
+	}
+}
+
+// callbackLoop batch 和 interval 策略下的回调 goroutine，按追加顺序调用回调，
+// 与 syncLoop 分开，回调阻塞时 fsync 照常进行
+func (l *Log) callbackLoop() {
+	defer l.cbwg.Done()
+	var batch []callback
+	for {
+		l.mu.Lock()
+		batch, l.callbacks = l.callbacks, batch[:0]
+		done := l.callbacksDone
+		l.mu.Unlock()
+		for i, cb := range batch {
+			cb.done(cb.err)
+			batch[i] = callback{}
+		}
+		if len(batch) == 0 {
+			if done {
+				return
+			}
+			<-l.callbackC
+		}
+	}
+}
+
+// Close fsync 所有已追加的记录并关闭日志，等待中的回调在返回前被调用
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.quit)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	err := l.syncLocked()
+	l.completeWaitersLocked()
+	l.callbacksDone = true
+	select {
+	case l.callbackC <- struct{}{}:
+	default:
+	}
+	for _, rf := range l.retired {
+		rf.Close()
+	}
+	l.retired = nil
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	if l.lock != nil {
+		l.lock.Close()
+	}
+	l.mu.Unlock()
+	l.cbwg.Wait()
+	return err
+}
@@ -0,0 +1,408 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func openLog(t *testing.T, dir string, opts Options) *Log {
+	opts.Logger = discardLogger
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return l
+}
+
+func testRecord(i int) Record {
+	return Record{
+		Time:     time.Unix(1700000000, int64(i)),
+		ClientID: fmt.Sprintf("device-%d", i%3),
+		ID:       fmt.Sprintf("%08d", i),
+		Payload:  []byte(strings.Repeat("x", i%7)),
+	}
+}
+
+func replayAll(t *testing.T, dir string) []Record {
+	var records []Record
+	if err := Replay(dir, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	return records
+}
+
+func checkRecords(t *testing.T, records []Record, want []Record) {
+	if len(records) != len(want) {
+		t.Fatalf("want %d records,actual %d", len(want), len(records))
+	}
+	for i, rec := range records {
+		w := want[i]
+		if !rec.Time.Equal(w.Time) || rec.ClientID != w.ClientID || rec.ID != w.ID || string(rec.Payload) != string(w.Payload) {
+			t.Errorf("record %d: want %+v,actual %+v", i, w, rec)
+		}
+	}
+}
+
+func TestLog_AppendReplay(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, dir, Options{Sync: policy, SyncInterval: time.Millisecond})
+			var want []Record
+			for i := 0; i < 100; i++ {
+				rec := testRecord(i)
+				if err := l.Append(rec); err != nil {
+					t.Fatalf("want nil,actual %s", err.Error())
+				}
+				want = append(want, rec)
+			}
+			// Append 返回时记录已经 fsync，不需要 Close 就能读到
+			checkRecords(t, replayAll(t, dir), want)
+			if err := l.Close(); err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			if err := l.Append(testRecord(0)); err != ErrClosed {
+				t.Errorf("want %v,actual %v", ErrClosed, err)
+			}
+		})
+	}
+}
+
+func TestLog_AppendAsyncOrder(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncBatch})
+
+	var mu sync.Mutex
+	var acked []string
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		rec := testRecord(i)
+		l.AppendAsync(rec, func(err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("want nil,actual %s", err.Error())
+			}
+			mu.Lock()
+			acked = append(acked, rec.ID)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	for i, id := range acked {
+		if want := testRecord(i).ID; id != want {
+			t.Fatalf("want %s,actual %s", want, id)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if n := len(replayAll(t, dir)); n != 1000 {
+		t.Errorf("want 1000,actual %d", n)
+	}
+}
+
+func TestLog_BlockingCallback(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncBatch})
+
+	// 第一个回调阻塞时，之后的记录照常写入和 fsync，回调按追加顺序推迟
+	release, blocked := make(chan struct{}), make(chan struct{})
+	called := make(chan string, 11)
+	l.AppendAsync(testRecord(0), func(error) {
+		close(blocked)
+		<-release
+		called <- testRecord(0).ID
+	})
+	<-blocked
+	for i := 1; i <= 10; i++ {
+		id := testRecord(i).ID
+		l.AppendAsync(testRecord(i), func(error) { called <- id })
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.mu.Lock()
+		durable := l.durable
+		l.mu.Unlock()
+		if durable == 11 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 11 durable records,actual %d", durable)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkRecords(t, replayAll(t, dir)[:1], []Record{testRecord(0)})
+	if len(called) != 0 {
+		t.Errorf("want 0 callbacks,actual %d", len(called))
+	}
+
+	close(release)
+	for i := 0; i <= 10; i++ {
+		if id := <-called; id != testRecord(i).ID {
+			t.Errorf("want %s,actual %s", testRecord(i).ID, id)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+}
+
+func TestLog_ConcurrentAppend(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncBatch, SegmentSize: 1024})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := l.Append(testRecord(g*50 + i)); err != nil {
+					t.Errorf("want nil,actual %s", err.Error())
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	seen := make(map[string]bool)
+	for _, rec := range replayAll(t, dir) {
+		seen[rec.ID] = true
+	}
+	if len(seen) != 400 {
+		t.Errorf("want 400,actual %d", len(seen))
+	}
+}
+
+func TestLog_RotateAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncAlways, SegmentSize: 200})
+	var want []Record
+	for i := 0; i < 20; i++ {
+		rec := testRecord(i)
+		if err := l.Append(rec); err != nil {
+			t.Fatalf("want nil,actual %s", err.Error())
+		}
+		want = append(want, rec)
+	}
+	l.Close()
+
+	seqs, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if len(seqs) < 2 {
+		t.Fatalf("want multiple segments,actual %d", len(seqs))
+	}
+	for _, seq := range seqs {
+		if fi, _ := os.Stat(segmentPath(dir, seq)); fi.Size() > 200 {
+			t.Errorf("want at most 200 bytes,actual %d", fi.Size())
+		}
+	}
+
+	// 重新打开后追加到最后一个段
+	l = openLog(t, dir, Options{Sync: SyncAlways, SegmentSize: 200})
+	rec := testRecord(20)
+	if err := l.Append(rec); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	want = append(want, rec)
+	l.Close()
+	checkRecords(t, replayAll(t, dir), want)
+}
+
+func TestOpen_TornWrite(t *testing.T) {
+	full := appendRecord(nil, testRecord(99))
+	corrupt := append([]byte(nil), full...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"PartialHeader", full[:5]},
+		{"PartialBody", full[:len(full)-2]},
+		{"BadCRC", corrupt},
+		{"Zeroes", make([]byte, 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, dir, Options{Sync: SyncAlways})
+			var want []Record
+			for i := 0; i < 3; i++ {
+				want = append(want, testRecord(i))
+				l.Append(testRecord(i))
+			}
+			l.Close()
+
+			path := segmentPath(dir, 1)
+			fi, _ := os.Stat(path)
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			f.Write(tt.tail)
+			f.Close()
+			checkRecords(t, replayAll(t, dir), want)
+
+			l = openLog(t, dir, Options{Sync: SyncAlways})
+			if after, _ := os.Stat(path); after.Size() != fi.Size() {
+				t.Errorf("want %d,actual %d", fi.Size(), after.Size())
+			}
+			want = append(want, testRecord(3))
+			if err := l.Append(testRecord(3)); err != nil {
+				t.Fatalf("want nil,actual %s", err.Error())
+			}
+			l.Close()
+			checkRecords(t, replayAll(t, dir), want)
+		})
+	}
+}
+
+func TestReplay_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncAlways, SegmentSize: 100})
+	for i := 0; i < 10; i++ {
+		l.Append(testRecord(i))
+	}
+	l.Close()
+
+	// 不是最后一个段的损坏不能当作 torn write 忽略
+	path := segmentPath(dir, 1)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+	err := Replay(dir, func(Record) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want %v,actual %v", ErrCorrupt, err)
+	}
+
+	// fn 返回的错误原样返回
+	stop := errors.New("stop")
+	if err := Replay(dir, func(Record) error { return stop }); err != stop {
+		t.Errorf("want %v,actual %v", stop, err)
+	}
+	// 目录不存在时没有记录
+	if err := Replay(filepath.Join(dir, "missing"), func(Record) error { return stop }); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+}
+
+func TestReplaySince(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncAlways, SegmentSize: 100})
+	var want []Record
+	for i := 0; i < 10; i++ {
+		rec := testRecord(i)
+		if i >= 6 {
+			want = append(want, rec)
+		}
+		l.Append(rec)
+	}
+	l.Close()
+
+	// 修改时间早于 since 的段被跳过，即使其中有损坏也不影响
+	old := time.Unix(1600000000, 0)
+	os.Chtimes(segmentPath(dir, 1), old, old)
+	os.WriteFile(segmentPath(dir, 1), []byte("garbage"), 0o644)
+	os.Chtimes(segmentPath(dir, 1), old, old)
+
+	var records []Record
+	if err := ReplaySince(dir, testRecord(6).Time, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	checkRecords(t, records, want)
+}
+
+func TestLog_RemoveBefore(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, Options{Sync: SyncAlways, SegmentSize: 100})
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		l.Append(testRecord(i))
+	}
+	segs, err := l.Segments()
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if len(segs) < 4 {
+		t.Fatalf("want at least 4 segments,actual %d", len(segs))
+	}
+	if last := segs[len(segs)-1]; !last.Active || segs[0].Active {
+		t.Errorf("want only the last segment active,actual %+v", segs)
+	}
+
+	// 从最早的段开始删除，遇到较新的段时停止；正在写入的段即使较旧也不删除
+	old := time.Now().Add(-time.Hour)
+	for _, seg := range []Segment{segs[0], segs[1], segs[3], segs[len(segs)-1]} {
+		os.Chtimes(seg.Path, old, old)
+	}
+	n, err := l.RemoveBefore(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	if n != 2 {
+		t.Errorf("want 2,actual %d", n)
+	}
+	remaining, _ := l.Segments()
+	if len(remaining) != len(segs)-2 || remaining[0].Seq != segs[2].Seq {
+		t.Errorf("want segments from %d,actual %+v", segs[2].Seq, remaining)
+	}
+
+	// 删除后继续追加，剩下的记录仍然可以完整重放
+	if err := l.Append(testRecord(10)); err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	records := replayAll(t, dir)
+	if len(records) == 0 || records[len(records)-1].ID != testRecord(10).ID {
+		t.Errorf("want last record %s,actual %+v", testRecord(10).ID, records)
+	}
+
+	l.Close()
+	if _, err := l.RemoveBefore(time.Now()); err != ErrClosed {
+		t.Errorf("want ErrClosed,actual %v", err)
+	}
+}
+
+func TestLog_TooLarge(t *testing.T) {
+	l := openLog(t, t.TempDir(), Options{})
+	defer l.Close()
+	if err := l.Append(Record{ID: strings.Repeat("x", 1<<16)}); err != ErrTooLarge {
+		t.Errorf("want %v,actual %v", ErrTooLarge, err)
+	}
+	// ErrTooLarge 不影响后续的追加
+	if err := l.Append(testRecord(1)); err != nil {
+		t.Errorf("want nil,actual %s", err.Error())
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncBatch, SyncInterval} {
+		got, err := ParseSyncPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("want %s,actual %s %v", p, got, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("never"); err == nil {
+		t.Errorf("want error,actual nil")
+	}
+}
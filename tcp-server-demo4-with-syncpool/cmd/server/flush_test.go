@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/frame"
+	"github.com/sammyluck/tcp-server-demo4-with-syncpool/packet"
+)
+
+// countingConn 统计服务端连接上 Write 系统调用的次数
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+// startFlushServer 启动按 policy 刷新写缓存的服务端，返回连接到服务端的客户端和服务端写连接的次数
+func startFlushServer(tb testing.TB, policy flushPolicy) (net.Conn, *int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("want nil,actual %s", err.Error())
+	}
+	tb.Cleanup(func() { l.Close() })
+	writes := new(int64)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(&countingConn{Conn: c, writes: writes}, policy)
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatalf("want nil,actual %s", err.Error())
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c, writes
+}
+
+func encodeSubmitFrame(tb testing.TB, id string) []byte {
+	framePayload, err := packet.Encode(&packet.Submit{ID: id, Payload: []byte("hello gopher")})
+	if err != nil {
+		tb.Fatalf("want nil,actual %s", err.Error())
+	}
+	w := &frameBuffer{}
+	frame.NewMyFrameCodec().Encode(w, framePayload)
+	return w.b
+}
+
+type frameBuffer struct{ b []byte }
+
+func (f *frameBuffer) Write(p []byte) (int, error) {
+	f.b = append(f.b, p...)
+	return len(p), nil
+}
+
+func readSubmitAck(t *testing.T, c net.Conn) *packet.SubmitAck {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	framePayload, err := frame.NewMyFrameCodec().Decode(c)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	p, err := packet.Decode(framePayload)
+	if err != nil {
+		t.Fatalf("want nil,actual %s", err.Error())
+	}
+	ack, ok := p.(*packet.SubmitAck)
+	if !ok {
+		t.Fatalf("want *packet.SubmitAck,actual %T", p)
+	}
+	return ack
+}
+
+func TestFlushPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy flushPolicy
+	}{
+		{"OnIdle", flushPolicy{onIdle: true}},
+		{"Interval", flushPolicy{interval: 10 * time.Millisecond}},
+		{"Bytes", flushPolicy{bytes: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := startFlushServer(t, tt.policy)
+
+			// 请求/响应式客户端：发送一个 submit 后等待 ack，不关闭连接
+			for i := 0; i < 3; i++ {
+				id := fmt.Sprintf("%08d", i)
+				c.Write(encodeSubmitFrame(t, id))
+				if ack := readSubmitAck(t, c); ack.ID != id {
+					t.Errorf("want %s,actual %s", id, ack.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestFlushPolicyDisabled(t *testing.T) {
+	c, _ := startFlushServer(t, flushPolicy{})
+
+	// 不启用任何刷新条件时，响应停留在写缓存中
+	c.Write(encodeSubmitFrame(t, "00000001"))
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := frame.NewMyFrameCodec().Decode(c); err == nil {
+		t.Errorf("want timeout,actual nil")
+	}
+}
+
+var benchPolicies = []struct {
+	name   string
+	policy flushPolicy
+}{
+	{"OnIdle", flushPolicy{onIdle: true}},
+	{"Interval=1ms", flushPolicy{interval: time.Millisecond}},
+	{"Bytes=4096+Interval=1ms", flushPolicy{bytes: 4096, interval: time.Millisecond}},
+	{"Bytes=1", flushPolicy{bytes: 1}},
+}
+
+// BenchmarkFlushPolicy_RequestResponse 客户端发送一个请求后等待响应，衡量每种策略的往返延迟
+func BenchmarkFlushPolicy_RequestResponse(b *testing.B) {
+	for _, bp := range benchPolicies {
+		b.Run(bp.name, func(b *testing.B) {
+			c, writes := startFlushServer(b, bp.policy)
+			req := encodeSubmitFrame(b, "00000001")
+			codec := frame.NewMyFrameCodec()
+			rbuf := bufio.NewReader(c)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(req); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Decode(rbuf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// BenchmarkFlushPolicy_Pipelined 客户端持续发送请求，不等待响应，衡量每种策略的吞吐量和系统调用次数
+func BenchmarkFlushPolicy_Pipelined(b *testing.B) {
+	for _, bp := range benchPolicies {
+		b.Run(bp.name, func(b *testing.B) {
+			c, writes := startFlushServer(b, bp.policy)
+			req := encodeSubmitFrame(b, "00000001")
+			codec := frame.NewMyFrameCodec()
+
+			done := make(chan error, 1)
+			go func() {
+				rbuf := bufio.NewReader(c)
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.Decode(rbuf); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			b.ResetTimer()
+			wbuf := bufio.NewWriter(c)
+			for i := 0; i < b.N; i++ {
+				if _, err := wbuf.Write(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wbuf.Flush()
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(writes))/float64(b.N), "writes/op")
+		})
+	}
+}